@@ -104,6 +104,9 @@ func init() {
 	// RoundDuration determines the duration of a round in the Hare protocol
 	RootCmd.PersistentFlags().DurationVar(&config.HARE.RoundDuration, "hare-round-duration-ms",
 		config.HARE.RoundDuration, "Duration of round in the Hare protocol")
+	// Compress determines whether the values of sent Hare messages are compressed
+	RootCmd.PersistentFlags().BoolVar(&config.HARE.Compress, "hare-compress-values",
+		config.HARE.Compress, "Compress the values of sent Hare messages")
 
 	/**========================Consensus Flags ========================== **/
 	//todo: add this here
@@ -11,7 +11,7 @@ type Algorithm struct {
 }
 
 type Tortoise interface {
-	handleIncomingLayer(ll *mesh.Layer)
+	handleIncomingLayer(ll *mesh.Layer) error
 	latestComplete() mesh.LayerID
 	getVote(id mesh.BlockID) vec
 	getVotes() map[mesh.BlockID]vec
@@ -29,7 +29,10 @@ func (alg *Algorithm) HandleLateBlock(b *mesh.Block) {
 
 func (alg *Algorithm) HandleIncomingLayer(ll *mesh.Layer) (mesh.LayerID, mesh.LayerID) {
 	oldPbase := alg.latestComplete()
-	alg.Tortoise.handleIncomingLayer(ll)
+	if err := alg.Tortoise.handleIncomingLayer(ll); err != nil {
+		log.Error("failed to process layer %d: %v", ll.Index(), err)
+		return oldPbase, oldPbase
+	}
 	newPbase := alg.latestComplete()
 	updateMetrics(alg, ll)
 	return oldPbase, newPbase
@@ -0,0 +1,322 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"sort"
+)
+
+// ErrRevertBelowGenesis is returned when reverting a tortoise that didn't process the genesis layer
+var ErrRevertBelowGenesis = errors.New("cannot revert below the genesis layer")
+
+// TortoiseCheckpoint is the partial state needed to resume the tortoise: pBase with its tally and opinion,
+// the good and complete patterns and the blocks of the last window layers with their votes by the layer voted for
+// and their correction vectors
+type TortoiseCheckpoint struct {
+	PBase       votingPattern
+	PBaseTally  map[mesh.BlockID]vec
+	PBaseVotes  map[mesh.BlockID]vec
+	Good        map[mesh.LayerID]votingPattern
+	Complete    map[votingPattern]struct{}
+	LayerBlocks map[mesh.LayerID][]*mesh.Block
+	BlockVotes  map[mesh.BlockID]map[mesh.LayerID]map[mesh.BlockID]struct{}
+	Correct     map[mesh.BlockID]map[mesh.BlockID]vec
+}
+
+// Checkpoint returns a copy of the partial state of the tortoise that can be restored with RecoverFrom
+func (ni *ninjaTortoise) Checkpoint() *TortoiseCheckpoint {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	cp := &TortoiseCheckpoint{
+		PBase:       ni.pBase,
+		PBaseTally:  make(map[mesh.BlockID]vec, len(ni.tTally[ni.pBase])),
+		PBaseVotes:  make(map[mesh.BlockID]vec, len(ni.tVote[ni.pBase])),
+		Good:        make(map[mesh.LayerID]votingPattern, len(ni.tGood)),
+		Complete:    make(map[votingPattern]struct{}, len(ni.tComplete)),
+		LayerBlocks: make(map[mesh.LayerID][]*mesh.Block, ni.cfg.Window),
+		BlockVotes:  make(map[mesh.BlockID]map[mesh.LayerID]map[mesh.BlockID]struct{}),
+		Correct:     make(map[mesh.BlockID]map[mesh.BlockID]vec),
+	}
+	for id, v := range ni.tTally[ni.pBase] {
+		cp.PBaseTally[id] = v
+	}
+	for id, v := range ni.tVote[ni.pBase] {
+		cp.PBaseVotes[id] = v
+	}
+	for l, p := range ni.tGood {
+		cp.Good[l] = p
+	}
+	for p := range ni.tComplete {
+		cp.Complete[p] = struct{}{}
+	}
+
+	start, end := ni.layerWindow()
+	for idx := start; idx <= end; idx++ {
+		blocks := make([]*mesh.Block, 0, len(ni.layerBlocks[idx]))
+		for _, bid := range ni.layerBlocks[idx] {
+			blocks = append(blocks, ni.blocks[bid])
+			votes := make(map[mesh.LayerID]map[mesh.BlockID]struct{}, len(ni.tExplicit[bid]))
+			for l, p := range ni.tExplicit[bid] {
+				set := make(map[mesh.BlockID]struct{}, len(ni.tPattern[p]))
+				for id := range ni.tPattern[p] {
+					set[id] = struct{}{}
+				}
+				votes[l] = set
+			}
+			cp.BlockVotes[bid] = votes
+			if correct, found := ni.tCorrect[bid]; found {
+				cp.Correct[bid] = make(map[mesh.BlockID]vec, len(correct))
+				for id, v := range correct {
+					cp.Correct[bid][id] = v
+				}
+			}
+		}
+		cp.LayerBlocks[idx] = blocks
+	}
+	return cp
+}
+
+func (cp *TortoiseCheckpoint) validate() error {
+	if cp == nil {
+		return fmt.Errorf("checkpoint is nil")
+	}
+	if _, found := cp.Complete[cp.PBase]; !found && cp.PBase.Layer() != Genesis {
+		return fmt.Errorf("pbase %d of layer %d is not complete", cp.PBase.id, cp.PBase.Layer())
+	}
+	if good, found := cp.Good[cp.PBase.Layer()]; !found || good != cp.PBase {
+		return fmt.Errorf("pbase %d is not the good pattern of layer %d", cp.PBase.id, cp.PBase.Layer())
+	}
+	if len(cp.LayerBlocks) == 0 {
+		return fmt.Errorf("checkpoint has no layers")
+	}
+
+	layers := cp.layers()
+	first, last := layers[0], layers[len(layers)-1]
+	if last-first+1 != mesh.LayerID(len(layers)) {
+		return fmt.Errorf("checkpoint layers %d to %d are not contiguous", first, last)
+	}
+	if cp.PBase.Layer() < first || cp.PBase.Layer() > last {
+		return fmt.Errorf("pbase layer %d is not in checkpoint layers %d to %d", cp.PBase.Layer(), first, last)
+	}
+	for idx, blocks := range cp.LayerBlocks {
+		if idx > cp.PBase.Layer() {
+			continue
+		}
+		for _, b := range blocks {
+			if _, found := cp.BlockVotes[b.ID()]; !found && len(b.BlockVotes) > 0 {
+				return fmt.Errorf("checkpoint has no votes of block %d", b.ID())
+			}
+		}
+	}
+	return nil
+}
+
+// layers returns the sorted layers of the checkpoint blocks
+func (cp *TortoiseCheckpoint) layers() []mesh.LayerID {
+	layers := make([]mesh.LayerID, 0, len(cp.LayerBlocks))
+	for l := range cp.LayerBlocks {
+		layers = append(layers, l)
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i] < layers[j] })
+	return layers
+}
+
+// RecoverFrom replaces the state of the tortoise with checkpoint. layers up to pBase are restored as is,
+// layers after it are replayed so the tortoise can continue with the layer following the checkpoint
+func (ni *ninjaTortoise) RecoverFrom(checkpoint *TortoiseCheckpoint) error {
+	if err := checkpoint.validate(); err != nil {
+		return err
+	}
+
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	if err := ni.recoverFrom(checkpoint); err != nil {
+		return err
+	}
+	ni.Info("recovered from checkpoint, pbase is %d", ni.pBase.Layer())
+	return nil
+}
+
+// recoverFrom is RecoverFrom without locking and validation
+func (ni *ninjaTortoise) recoverFrom(checkpoint *TortoiseCheckpoint) error {
+	ni.initTables()
+	ni.checkpoint = checkpoint
+	ni.pBase = checkpoint.PBase
+	ni.tTally[ni.pBase] = make(map[mesh.BlockID]vec, len(checkpoint.PBaseTally))
+	for id, v := range checkpoint.PBaseTally {
+		ni.tTally[ni.pBase][id] = v
+	}
+	ni.tVote[ni.pBase] = make(map[mesh.BlockID]vec, len(checkpoint.PBaseVotes))
+	for id, v := range checkpoint.PBaseVotes {
+		ni.tVote[ni.pBase][id] = v
+	}
+	for l, p := range checkpoint.Good {
+		ni.tGood[l] = p
+	}
+	for p := range checkpoint.Complete {
+		ni.tComplete[p] = struct{}{}
+	}
+	// corrections for blocks before the checkpoint can't be recomputed when replaying the layers after pBase
+	for id, correct := range checkpoint.Correct {
+		ni.tCorrect[id] = make(map[mesh.BlockID]vec, len(correct))
+		for bid, v := range correct {
+			ni.tCorrect[id][bid] = v
+		}
+	}
+
+	for _, idx := range checkpoint.layers() {
+		blocks := checkpoint.LayerBlocks[idx]
+		if idx > ni.pBase.Layer() {
+			if err := ni.updateTables(mesh.NewExistingLayer(idx, blocks)); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, b := range blocks {
+			ni.restoreBlock(b, checkpoint.BlockVotes[b.ID()])
+			ni.blocks[b.ID()] = b
+			ni.addLayerBlock(idx, b.ID())
+		}
+	}
+	return nil
+}
+
+// restoreBlock sets the patterns of a block already decided by pBase from its votes by layer, which include
+// the votes for blocks before the checkpoint so its patterns are the ones it had before the checkpoint
+func (ni *ninjaTortoise) restoreBlock(b *mesh.Block, votes map[mesh.LayerID]map[mesh.BlockID]struct{}) {
+	if b.Layer() == Genesis {
+		return
+	}
+	ni.addBlockPatterns(b.ID(), votes)
+}
+
+// Recover re-derives the effective patterns, the patterns and the layer blocks of all cached blocks from the blocks
+// themselves, repairing the tables after a partial crash. the good and complete patterns and pBase are not modified
+func (ni *ninjaTortoise) Recover() error {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	blocks := make([]*mesh.Block, 0, len(ni.blocks))
+	for _, b := range ni.blocks {
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Layer() != blocks[j].Layer() {
+			return blocks[i].Layer() < blocks[j].Layer()
+		}
+		return blocks[i].ID() < blocks[j].ID()
+	})
+
+	inLayer := make(map[mesh.BlockID]struct{}, len(ni.blocks))
+	for _, ids := range ni.layerBlocks {
+		for _, id := range ids {
+			inLayer[id] = struct{}{}
+		}
+	}
+
+	for _, b := range blocks {
+		if _, found := inLayer[b.ID()]; !found {
+			ni.addLayerBlock(b.Layer(), b.ID())
+		}
+		if b.Layer() == Genesis {
+			continue
+		}
+
+		patternMap := make(map[mesh.LayerID]map[mesh.BlockID]struct{})
+		for _, bid := range b.BlockVotes {
+			bl, found := ni.blocks[bid]
+			if !found {
+				return fmt.Errorf("block %d votes for unknown block %d", b.ID(), bid)
+			}
+			if _, found := patternMap[bl.Layer()]; !found {
+				patternMap[bl.Layer()] = map[mesh.BlockID]struct{}{}
+			}
+			patternMap[bl.Layer()][bl.ID()] = struct{}{}
+		}
+
+		var effective votingPattern
+		for layerId, v := range patternMap {
+			vp := votingPattern{id: ni.getIdsFromSet(v), LayerID: layerId}
+			ni.tPattern[vp] = v
+			if layerId >= effective.Layer() {
+				effective = vp
+			}
+		}
+		ni.tEffective[b.ID()] = effective
+	}
+
+	ni.Info("recovered tables of %d blocks", len(blocks))
+	return nil
+}
+
+// Revert rebuilds the tables from the layers up to toLayer, so the layers after it can be processed again. the kept
+// layers are processed again from genesis, or from the checkpoint the tortoise was recovered from, so the support,
+// the patterns and pBase are the same as right after toLayer was first processed. pending blocks are kept and if the
+// replay fails the tables are left as they were. since all kept layers are replayed a revert gets slower as the mesh
+// grows, unless the tortoise was recovered from a recent checkpoint
+func (ni *ninjaTortoise) Revert(toLayer mesh.LayerID) error {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	first := mesh.LayerID(Genesis)
+	if ni.checkpoint != nil {
+		layers := ni.checkpoint.layers()
+		first = layers[len(layers)-1] + 1
+		if toLayer+1 < first {
+			return fmt.Errorf("cannot revert to layer %d before the checkpoint layer %d", toLayer, first-1)
+		}
+	} else if _, found := ni.tGood[Genesis]; !found {
+		return ErrRevertBelowGenesis
+	}
+	if toLayer >= ni.latestLayer() {
+		return nil
+	}
+
+	var replay []*mesh.Layer
+	for idx := first; idx <= toLayer; idx++ {
+		ids, found := ni.layerBlocks[idx]
+		if !found {
+			continue
+		}
+		blocks := make([]*mesh.Block, 0, len(ids))
+		for _, id := range ids {
+			blocks = append(blocks, ni.blocks[id])
+		}
+		replay = append(replay, mesh.NewExistingLayer(idx, blocks))
+	}
+
+	// replaying doesn't call the hooks again or count in the exported metrics
+	checkpoint, pending, timers := ni.checkpoint, ni.pendingBlocks, ni.flushTimers
+	metrics, staleness, audit := ni.metrics, ni.stalenessHook, ni.correctnessAudit
+	ni.metrics, ni.stalenessHook, ni.correctnessAudit = newTortoiseMetrics(), nil, nil
+	defer func() {
+		ni.metrics, ni.stalenessHook, ni.correctnessAudit = metrics, staleness, audit
+		ni.pendingBlocks, ni.flushTimers = pending, timers
+	}()
+
+	backup, stale := ni.copyTables(), ni.stalePBase
+	rollback := func(err error) error {
+		ni.restoreTables(backup)
+		ni.checkpoint, ni.stalePBase = checkpoint, stale
+		return err
+	}
+
+	if checkpoint != nil {
+		if err := ni.recoverFrom(checkpoint); err != nil {
+			return rollback(err)
+		}
+	} else {
+		ni.initTables()
+	}
+	for _, l := range replay {
+		if err := ni.updateTables(l); err != nil {
+			return rollback(fmt.Errorf("failed to replay layer %d: %v", l.Index(), err))
+		}
+	}
+
+	ni.Info("reverted to layer %d, pbase is %d", toLayer, ni.pBase.Layer())
+	return nil
+}
@@ -0,0 +1,281 @@
+package consensus
+
+import (
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestNinjaTortoise_RecoverFrom(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_RecoverFrom", "", ""))
+	layers := []*mesh.Layer{GenesisLayer()}
+	alg.handleIncomingLayer(layers[0])
+	for i := 1; i <= 110; i++ {
+		layers = append(layers, createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{layers[i-1]}, 3, 3))
+	}
+	for _, l := range layers[1:101] {
+		alg.handleIncomingLayer(l)
+	}
+	checkpoint := alg.Checkpoint()
+	assert.Equal(t, mesh.LayerID(99), checkpoint.PBase.Layer())
+	assert.Equal(t, Window, len(checkpoint.LayerBlocks))
+
+	recovered := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_RecoverFrom", "", ""))
+	assert.NoError(t, recovered.RecoverFrom(checkpoint))
+	assert.Equal(t, alg.pBase, recovered.pBase)
+
+	for _, l := range layers[101:] {
+		alg.handleIncomingLayer(l)
+		recovered.handleIncomingLayer(l)
+		assert.Equal(t, alg.pBase, recovered.pBase)
+	}
+	assert.Equal(t, mesh.LayerID(109), recovered.pBase.Layer())
+	assert.Equal(t, alg.tVote[alg.pBase], recovered.tVote[recovered.pBase])
+}
+
+// createLayerWithOlderVotes creates a layer whose blocks vote for all blocks of prev[0] and each for a random
+// choice of the older layers in prev, so blocks of the same layer have different explicit patterns
+func createLayerWithOlderVotes(index mesh.LayerID, prev []*mesh.Layer, blocksInLayer int, rng *rand.Rand) *mesh.Layer {
+	l := mesh.NewLayer(index)
+	for i := 0; i < blocksInLayer; i++ {
+		bl := mesh.NewBlock(false, []byte("data"), time.Now(), 1)
+		for _, b := range prev[0].Blocks() {
+			bl.AddVote(b.ID())
+			bl.AddView(b.ID())
+		}
+		for _, older := range prev[1:] {
+			if rng.Intn(2) == 0 {
+				continue
+			}
+			for _, b := range older.Blocks() {
+				bl.AddVote(b.ID())
+			}
+		}
+		l.AddBlock(bl)
+	}
+	return l
+}
+
+func TestNinjaTortoise_RecoverFromOlderVotes(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	cfg := DefaultTortoiseConfig()
+	cfg.Window = 10
+	alg := NewNinjaTortoise(uint32(4), cfg, log.New("TestNinjaTortoise_RecoverFromOlderVotes", "", ""))
+	layers := []*mesh.Layer{GenesisLayer()}
+	for i := 1; i <= 30; i++ {
+		prev := []*mesh.Layer{layers[i-1]}
+		for j := i - 2; j >= 0 && j >= i-3; j-- {
+			prev = append(prev, layers[j])
+		}
+		layers = append(layers, createLayerWithOlderVotes(mesh.LayerID(i), prev, 4, rng))
+	}
+	for _, l := range layers[:21] {
+		alg.handleIncomingLayer(l)
+	}
+	checkpoint := alg.Checkpoint()
+
+	recovered := NewNinjaTortoise(uint32(4), cfg, log.New("TestNinjaTortoise_RecoverFromOlderVotes", "", ""))
+	assert.NoError(t, recovered.RecoverFrom(checkpoint))
+	assert.Equal(t, alg.pBase, recovered.pBase)
+
+	// blocks of the first checkpoint layers vote for blocks before the checkpoint and keep their patterns
+	for idx, blocks := range checkpoint.LayerBlocks {
+		for _, b := range blocks {
+			assert.Equal(t, alg.tExplicit[b.ID()], recovered.tExplicit[b.ID()], "layer %d", idx)
+			assert.Equal(t, alg.tEffective[b.ID()], recovered.tEffective[b.ID()], "layer %d", idx)
+		}
+	}
+
+	delete(checkpoint.BlockVotes, checkpoint.LayerBlocks[checkpoint.PBase.Layer()][0].ID())
+	assert.Error(t, NewNinjaTortoise(uint32(4), cfg, log.New("TestNinjaTortoise_RecoverFromOlderVotes", "", "")).RecoverFrom(checkpoint))
+
+	for _, l := range layers[21:] {
+		alg.handleIncomingLayer(l)
+		recovered.handleIncomingLayer(l)
+		assert.Equal(t, alg.pBase, recovered.pBase)
+		assert.Equal(t, alg.tVote[alg.pBase], recovered.tVote[recovered.pBase])
+		assert.Equal(t, alg.tTally[alg.pBase], recovered.tTally[recovered.pBase])
+	}
+	assert.Equal(t, mesh.LayerID(29), recovered.pBase.Layer())
+}
+
+func TestNinjaTortoise_RecoverFromInvalid(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_RecoverFromInvalid", "", ""))
+	assert.Error(t, alg.RecoverFrom(nil))
+
+	l0 := GenesisLayer()
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 3)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	alg.handleIncomingLayer(l0)
+	alg.handleIncomingLayer(l1)
+	alg.handleIncomingLayer(l2)
+
+	checkpoint := alg.Checkpoint()
+	checkpoint.PBase = votingPattern{id: 1, LayerID: 1}
+	assert.Error(t, alg.RecoverFrom(checkpoint))
+
+	checkpoint = alg.Checkpoint()
+	delete(checkpoint.Good, checkpoint.PBase.Layer())
+	assert.Error(t, alg.RecoverFrom(checkpoint))
+
+	checkpoint = alg.Checkpoint()
+	delete(checkpoint.LayerBlocks, 1)
+	assert.Error(t, alg.RecoverFrom(checkpoint))
+
+	// a failed recovery leaves the state untouched
+	assert.Equal(t, mesh.LayerID(1), alg.pBase.Layer())
+	assert.NoError(t, alg.RecoverFrom(alg.Checkpoint()))
+	assert.Equal(t, mesh.LayerID(1), alg.pBase.Layer())
+}
+
+func TestNinjaTortoise_Recover(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(5), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_Recover", "", ""))
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	for i := 1; i <= 10; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 5, 3)
+		alg.handleIncomingLayer(l)
+	}
+
+	effective := make(map[mesh.BlockID]votingPattern, len(alg.tEffective))
+	for id, p := range alg.tEffective {
+		effective[id] = p
+	}
+	pBase := alg.pBase
+	layer5 := alg.layerBlocks[5]
+	pattern := alg.tEffective[layer5[0]]
+	patternBlocks := alg.tPattern[pattern]
+
+	for _, id := range alg.layerBlocks[7] {
+		delete(alg.tEffective, id)
+	}
+	delete(alg.tEffective, layer5[0])
+	delete(alg.tPattern, pattern)
+	delete(alg.layerBlocks, 5)
+
+	assert.NoError(t, alg.Recover())
+	assert.Equal(t, effective, alg.tEffective)
+	assert.Equal(t, patternBlocks, alg.tPattern[pattern])
+	assert.ElementsMatch(t, layer5, alg.layerBlocks[5])
+	assert.Equal(t, pBase, alg.pBase)
+
+	// a vote for a block that isn't cached can't be recovered
+	b := mesh.NewBlock(false, nil, time.Now(), 11)
+	b.AddVote(mesh.BlockID(123456789))
+	alg.blocks[b.ID()] = b
+	assert.Error(t, alg.Recover())
+}
+
+func TestNinjaTortoise_Revert(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_Revert", "", ""))
+	assert.Equal(t, ErrRevertBelowGenesis, alg.Revert(0))
+
+	layers := []*mesh.Layer{GenesisLayer()}
+	for i := 1; i <= 10; i++ {
+		layers = append(layers, createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{layers[i-1]}, 3, 3))
+	}
+	var pBases []votingPattern
+	for _, l := range layers {
+		alg.handleIncomingLayer(l)
+		pBases = append(pBases, alg.pBase)
+	}
+	assert.Equal(t, mesh.LayerID(9), alg.pBase.Layer())
+
+	assert.NoError(t, alg.Revert(6))
+	assert.Equal(t, pBases[6], alg.pBase)
+	assert.Equal(t, mesh.LayerID(6), alg.latestLayer())
+	for _, l := range layers[7:] {
+		for _, b := range l.Blocks() {
+			_, found := alg.blocks[b.ID()]
+			assert.False(t, found)
+			_, found = alg.tEffective[b.ID()]
+			assert.False(t, found)
+		}
+	}
+	assert.False(t, alg.InLayer(layers[7].Blocks()[0].ID(), 7))
+	for l := range alg.tGood {
+		assert.True(t, l <= 6)
+	}
+	for p := range alg.tComplete {
+		assert.True(t, p.Layer() <= 6)
+	}
+	for p := range alg.tVote {
+		assert.True(t, p.Layer() <= 6)
+	}
+
+	// the reverted layers can be processed again
+	for i, l := range layers[7:] {
+		alg.handleIncomingLayer(l)
+		assert.Equal(t, pBases[i+7], alg.pBase)
+	}
+
+	assert.NoError(t, alg.Revert(0))
+	assert.Equal(t, pBases[0], alg.pBase)
+	assert.Equal(t, mesh.LayerID(0), alg.latestLayer())
+}
+
+func TestNinjaTortoise_RevertReplayFailure(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_RevertReplayFailure", "", ""))
+
+	layers := []*mesh.Layer{GenesisLayer()}
+	for i := 1; i <= 10; i++ {
+		layers = append(layers, createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{layers[i-1]}, 3, 3))
+	}
+	for _, l := range layers {
+		alg.handleIncomingLayer(l)
+	}
+	pBase, support, blocks := alg.pBase, copySupport(alg.tSupport), len(alg.blocks)
+
+	// a kept block voting for an unknown block fails the replay
+	b := layers[4].Blocks()[0]
+	b.BlockVotes = append(b.BlockVotes, mesh.BlockID(123456))
+	assert.Error(t, alg.Revert(6))
+
+	assert.Equal(t, pBase, alg.pBase)
+	assert.Equal(t, support, alg.tSupport)
+	assert.Equal(t, blocks, len(alg.blocks))
+	assert.Equal(t, mesh.LayerID(10), alg.latestLayer())
+}
+
+func copySupport(support map[votingPattern]int) map[votingPattern]int {
+	res := make(map[votingPattern]int, len(support))
+	for p, s := range support {
+		res[p] = s
+	}
+	return res
+}
+
+func TestNinjaTortoise_RevertReplay(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(5), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_RevertReplay", "", ""))
+
+	layers := []*mesh.Layer{GenesisLayer()}
+	for i := 1; i <= 12; i++ {
+		layers = append(layers, createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{layers[i-1]}, 5, 3))
+	}
+	var pBases []votingPattern
+	var supports []map[votingPattern]int
+	for _, l := range layers {
+		alg.handleIncomingLayer(l)
+		pBases = append(pBases, alg.pBase)
+		supports = append(supports, copySupport(alg.tSupport))
+	}
+
+	assert.NoError(t, alg.Revert(5))
+	assert.Equal(t, pBases[5], alg.pBase)
+	assert.Equal(t, supports[5], alg.tSupport)
+
+	for i, l := range layers[6:] {
+		alg.handleIncomingLayer(l)
+		assert.Equal(t, pBases[i+6], alg.pBase)
+		assert.Equal(t, supports[i+6], alg.tSupport)
+	}
+
+	// a recovered tortoise replays from its checkpoint and cannot revert before it
+	recovered := NewNinjaTortoise(uint32(5), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_RevertReplay", "", ""))
+	assert.NoError(t, recovered.RecoverFrom(alg.Checkpoint()))
+	assert.Error(t, recovered.Revert(0))
+	assert.NoError(t, recovered.Revert(alg.latestLayer()))
+}
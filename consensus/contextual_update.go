@@ -0,0 +1,161 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+)
+
+// tortoiseTables is a copy of the tables modified when processing a layer
+type tortoiseTables struct {
+	pBase              votingPattern
+	blocks             map[mesh.BlockID]*mesh.Block
+	tEffective         map[mesh.BlockID]votingPattern
+	tCorrect           map[mesh.BlockID]map[mesh.BlockID]vec
+	tExplicit          map[mesh.BlockID]map[mesh.LayerID]votingPattern
+	layerBlocks        map[mesh.LayerID][]mesh.BlockID
+	layerBlockSet      map[mesh.LayerID]map[mesh.BlockID]struct{}
+	tGood              map[mesh.LayerID]votingPattern
+	tSupport           map[votingPattern]int
+	layerWeight        map[mesh.LayerID]int
+	latest             mesh.LayerID
+	tComplete          map[votingPattern]struct{}
+	tEffectiveToBlocks map[votingPattern][]mesh.BlockID
+	tVote              map[votingPattern]map[mesh.BlockID]vec
+	tTally             map[votingPattern]map[mesh.BlockID]vec
+	tPattern           map[votingPattern]map[mesh.BlockID]struct{}
+	tPatSupport        map[votingPattern]map[mesh.LayerID]votingPattern
+	equivocatingMiners map[string]struct{}
+}
+
+// ContextualUpdate processes the blocks of layer like AddBatchBlocks. if ctx is done before the tables are modified ctx's
+// error is returned and the layer is not processed, once the update began it isn't interrupted
+func (ni *ninjaTortoise) ContextualUpdate(ctx context.Context, blocks []*mesh.Block, layer mesh.LayerID) (mesh.LayerID, error) {
+	for _, b := range blocks {
+		if b.Layer() != layer {
+			return 0, fmt.Errorf("block %d is in layer %d, expected layer %d", b.ID(), b.Layer(), layer)
+		}
+	}
+
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	if err := ni.updateTablesContext(ctx, mesh.NewExistingLayer(layer, blocks)); err != nil {
+		ni.Warning("update of layer %d failed: %v", layer, err)
+		return ni.pBase.Layer(), err
+	}
+	return ni.pBase.Layer(), nil
+}
+
+// copyTables returns a copy of the tables that is not affected by processing more layers, must be called under mutex
+func (ni *ninjaTortoise) copyTables() *tortoiseTables {
+	t := &tortoiseTables{
+		pBase:              ni.pBase,
+		latest:             ni.latest,
+		blocks:             make(map[mesh.BlockID]*mesh.Block, len(ni.blocks)),
+		tEffective:         make(map[mesh.BlockID]votingPattern, len(ni.tEffective)),
+		tCorrect:           make(map[mesh.BlockID]map[mesh.BlockID]vec, len(ni.tCorrect)),
+		tExplicit:          make(map[mesh.BlockID]map[mesh.LayerID]votingPattern, len(ni.tExplicit)),
+		layerBlocks:        make(map[mesh.LayerID][]mesh.BlockID, len(ni.layerBlocks)),
+		layerBlockSet:      make(map[mesh.LayerID]map[mesh.BlockID]struct{}, len(ni.layerBlockSet)),
+		tGood:              make(map[mesh.LayerID]votingPattern, len(ni.tGood)),
+		tSupport:           make(map[votingPattern]int, len(ni.tSupport)),
+		layerWeight:        make(map[mesh.LayerID]int, len(ni.layerWeight)),
+		tComplete:          make(map[votingPattern]struct{}, len(ni.tComplete)),
+		tEffectiveToBlocks: make(map[votingPattern][]mesh.BlockID, len(ni.tEffectiveToBlocks)),
+		tVote:              copyVecTable(ni.tVote),
+		tTally:             copyVecTable(ni.tTally),
+		tPattern:           make(map[votingPattern]map[mesh.BlockID]struct{}, len(ni.tPattern)),
+		tPatSupport:        make(map[votingPattern]map[mesh.LayerID]votingPattern, len(ni.tPatSupport)),
+		equivocatingMiners: make(map[string]struct{}, len(ni.equivocatingMiners)),
+	}
+	for k, v := range ni.blocks {
+		t.blocks[k] = v
+	}
+	for k, v := range ni.tEffective {
+		t.tEffective[k] = v
+	}
+	for k, v := range ni.tCorrect {
+		t.tCorrect[k] = make(map[mesh.BlockID]vec, len(v))
+		for b, c := range v {
+			t.tCorrect[k][b] = c
+		}
+	}
+	for k, v := range ni.tExplicit {
+		t.tExplicit[k] = make(map[mesh.LayerID]votingPattern, len(v))
+		for l, p := range v {
+			t.tExplicit[k][l] = p
+		}
+	}
+	// appending to the slices doesn't change the copied slice headers
+	for k, v := range ni.layerBlocks {
+		t.layerBlocks[k] = v
+	}
+	for k, v := range ni.layerBlockSet {
+		t.layerBlockSet[k] = make(map[mesh.BlockID]struct{}, len(v))
+		for b := range v {
+			t.layerBlockSet[k][b] = struct{}{}
+		}
+	}
+	for k, v := range ni.tEffectiveToBlocks {
+		t.tEffectiveToBlocks[k] = v
+	}
+	for k, v := range ni.tGood {
+		t.tGood[k] = v
+	}
+	for k, v := range ni.tSupport {
+		t.tSupport[k] = v
+	}
+	for k, v := range ni.layerWeight {
+		t.layerWeight[k] = v
+	}
+	for k := range ni.tComplete {
+		t.tComplete[k] = struct{}{}
+	}
+	// pattern block sets are never modified once created
+	for k, v := range ni.tPattern {
+		t.tPattern[k] = v
+	}
+	for k, v := range ni.tPatSupport {
+		t.tPatSupport[k] = make(map[mesh.LayerID]votingPattern, len(v))
+		for l, p := range v {
+			t.tPatSupport[k][l] = p
+		}
+	}
+	for k := range ni.equivocatingMiners {
+		t.equivocatingMiners[k] = struct{}{}
+	}
+	return t
+}
+
+func copyVecTable(table map[votingPattern]map[mesh.BlockID]vec) map[votingPattern]map[mesh.BlockID]vec {
+	res := make(map[votingPattern]map[mesh.BlockID]vec, len(table))
+	for p, votes := range table {
+		res[p] = make(map[mesh.BlockID]vec, len(votes))
+		for b, v := range votes {
+			res[p][b] = v
+		}
+	}
+	return res
+}
+
+// restoreTables replaces the tables with t, must be called under mutex
+func (ni *ninjaTortoise) restoreTables(t *tortoiseTables) {
+	ni.pBase = t.pBase
+	ni.blocks = t.blocks
+	ni.tEffective = t.tEffective
+	ni.tCorrect = t.tCorrect
+	ni.tExplicit = t.tExplicit
+	ni.layerBlocks = t.layerBlocks
+	ni.layerBlockSet = t.layerBlockSet
+	ni.tGood = t.tGood
+	ni.tSupport = t.tSupport
+	ni.layerWeight = t.layerWeight
+	ni.latest = t.latest
+	ni.tComplete = t.tComplete
+	ni.tEffectiveToBlocks = t.tEffectiveToBlocks
+	ni.tVote = t.tVote
+	ni.tTally = t.tTally
+	ni.tPattern = t.tPattern
+	ni.tPatSupport = t.tPatSupport
+	ni.equivocatingMiners = t.equivocatingMiners
+}
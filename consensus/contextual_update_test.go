@@ -0,0 +1,53 @@
+package consensus
+
+import (
+	"context"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNinjaTortoise_ContextualUpdate(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(5), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_ContextualUpdate", "", ""))
+	expected := NewNinjaTortoise(uint32(5), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_ContextualUpdate", "", ""))
+	l := GenesisLayer()
+	for i := 0; i <= 10; i++ {
+		if i > 0 {
+			l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 5, 3)
+		}
+		pBase, err := alg.ContextualUpdate(context.Background(), l.Blocks(), l.Index())
+		assert.NoError(t, err)
+		expected.handleIncomingLayer(l)
+		assert.Equal(t, expected.pBase.Layer(), pBase)
+	}
+
+	// a done context stops the update before the tables are modified
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := alg.copyTables()
+	l = createLayerWithRandVoting(11, []*mesh.Layer{l}, 5, 3)
+	_, err := alg.ContextualUpdate(ctx, l.Blocks(), l.Index())
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, before, alg.copyTables())
+
+	// the canceled layer can be processed again
+	pBase, err := alg.ContextualUpdate(context.Background(), l.Blocks(), l.Index())
+	assert.NoError(t, err)
+	expected.handleIncomingLayer(l)
+	assert.Equal(t, expected.pBase.Layer(), pBase)
+	assert.Equal(t, expected.copyTables(), alg.copyTables())
+
+	// canceling while the correction vectors of the new good pattern are updated doesn't interrupt the update
+	ctx, cancel = context.WithCancel(context.Background())
+	alg.SetCorrectnessAuditHook(func(mesh.BlockID, votingPattern, *vec) { cancel() })
+	l = createLayerWithRandVoting(12, []*mesh.Layer{l}, 5, 3)
+	pBase, err = alg.ContextualUpdate(ctx, l.Blocks(), l.Index())
+	assert.NoError(t, err)
+	expected.handleIncomingLayer(l)
+	assert.Equal(t, expected.pBase.Layer(), pBase)
+	assert.Equal(t, expected.copyTables(), alg.copyTables())
+
+	_, err = alg.ContextualUpdate(context.Background(), l.Blocks(), 13)
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package consensus
+
+import (
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"unsafe"
+)
+
+// MemoryProfile returns the estimated number of bytes held by each of the major tables of the tortoise.
+// the estimate counts keys, values and the contents of slices and nested maps but not the overhead of the maps
+func (ni *ninjaTortoise) MemoryProfile() map[string]int64 {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	var (
+		blockIdSize = int64(unsafe.Sizeof(mesh.BlockID(0)))
+		layerIdSize = int64(unsafe.Sizeof(mesh.LayerID(0)))
+		patternSize = int64(unsafe.Sizeof(votingPattern{}))
+		vecSize     = int64(unsafe.Sizeof(vec{}))
+		sliceSize   = int64(unsafe.Sizeof([]mesh.BlockID{}))
+		ptrSize     = int64(unsafe.Sizeof(&mesh.Block{}))
+	)
+
+	var blocks int64
+	for _, b := range ni.blocks {
+		blocks += blockIdSize + ptrSize + int64(unsafe.Sizeof(*b))
+		blocks += int64(cap(b.BlockVotes)+cap(b.ViewEdges))*blockIdSize + int64(cap(b.Data))
+	}
+
+	vecTable := func(table map[votingPattern]map[mesh.BlockID]vec) int64 {
+		var size int64
+		for _, votes := range table {
+			size += patternSize + int64(len(votes))*(blockIdSize+vecSize)
+		}
+		return size
+	}
+
+	var correct int64
+	for _, corrections := range ni.tCorrect {
+		correct += blockIdSize + int64(len(corrections))*(blockIdSize+vecSize)
+	}
+
+	var explicit int64
+	for _, patterns := range ni.tExplicit {
+		explicit += blockIdSize + int64(len(patterns))*(layerIdSize+patternSize)
+	}
+
+	var layers int64
+	for _, ids := range ni.layerBlocks {
+		layers += layerIdSize + sliceSize + int64(cap(ids))*blockIdSize
+	}
+
+	return map[string]int64{
+		"blocks":      blocks,
+		"tTally":      vecTable(ni.tTally),
+		"tVote":       vecTable(ni.tVote),
+		"tCorrect":    correct,
+		"tExplicit":   explicit,
+		"layerBlocks": layers,
+	}
+}
@@ -0,0 +1,43 @@
+package consensus
+
+import (
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNinjaTortoise_MemoryProfile(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_MemoryProfile", "", ""))
+	empty := alg.MemoryProfile()
+	assert.Equal(t, 6, len(empty))
+	for name, size := range empty {
+		assert.Equal(t, int64(0), size, name)
+	}
+
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	for i := 1; i <= 50; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 10, 7)
+		alg.handleIncomingLayer(l)
+	}
+	half := alg.MemoryProfile()
+	for i := 51; i <= 100; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 10, 7)
+		alg.handleIncomingLayer(l)
+	}
+	full := alg.MemoryProfile()
+
+	// tables grow linearly with the number of layers, except for tTally and tVote which hold an opinion on every
+	// block before each good pattern and grow quadratically until the window is full
+	for name, size := range full {
+		t.Logf("%v: %d bytes after 50 layers, %d bytes after 100 layers", name, half[name], size)
+		assert.True(t, half[name] > 0, name)
+		assert.True(t, size > half[name], name)
+		if name == "tTally" || name == "tVote" {
+			assert.True(t, size < 5*half[name], name)
+		} else {
+			assert.True(t, size < 3*half[name], name)
+		}
+	}
+}
@@ -22,3 +22,57 @@ var (
 	validBlocks    = blockVotes.With("validity", "valid")
 	invalidBlocks  = blockVotes.With("validity", "invalid")
 )
+
+// tortoiseMetrics are the metrics of a single ninjaTortoise, exported once registered with RegisterMetrics
+type tortoiseMetrics struct {
+	layerDuration    prometheus.Histogram
+	completePatterns prometheus.Gauge
+	blocksAgainst    prometheus.Counter
+}
+
+func newTortoiseMetrics() *tortoiseMetrics {
+	return &tortoiseMetrics{
+		layerDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "layer_update_duration_seconds",
+			Help:      "Time it took the tortoise to update its tables with a layer.",
+		}),
+		completePatterns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "complete_patterns",
+			Help:      "Number of complete voting patterns.",
+		}),
+		blocksAgainst: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "blocks_against_total",
+			Help:      "Number of blocks pbase voted against when it advanced.",
+		}),
+	}
+}
+
+// RegisterMetrics registers the metrics of the tortoise with r, e.g. prometheus.DefaultRegisterer
+func (ni *ninjaTortoise) RegisterMetrics(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{ni.metrics.layerDuration, ni.metrics.completePatterns, ni.metrics.blocksAgainst} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countAgainst returns the number of blocks the opinion of pBase votes against in the layers that were decided
+// since prevBase, the opinion of a pattern decides the layers before it
+func (ni *ninjaTortoise) countAgainst(prevBase votingPattern) int {
+	var count int
+	for idx := prevBase.Layer(); idx < ni.pBase.Layer(); idx++ {
+		for _, bid := range ni.layerBlocks[idx] {
+			if ni.tVote[ni.pBase][bid] == Against {
+				count++
+			}
+		}
+	}
+	return count
+}
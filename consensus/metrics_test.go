@@ -0,0 +1,48 @@
+package consensus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNinjaTortoise_RegisterMetrics(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_RegisterMetrics", "", ""))
+	reg := prometheus.NewRegistry()
+	require.NoError(t, alg.RegisterMetrics(reg))
+	assert.Error(t, alg.RegisterMetrics(reg))
+
+	l0 := createMulExplicitLayer(0, map[mesh.LayerID]*mesh.Layer{}, nil, 1)
+	l1 := createMulExplicitLayer(1, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0}, map[mesh.LayerID][]int{0: {0}}, 3)
+	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0, l1.Index(): l1}, map[mesh.LayerID][]int{0: {0}, 1: {0, 2}}, 3)
+	l3 := createMulExplicitLayer(3, map[mesh.LayerID]*mesh.Layer{l1.Index(): l1, l2.Index(): l2}, map[mesh.LayerID][]int{1: {0, 2}, 2: {0, 1, 2}}, 3)
+	for _, l := range []*mesh.Layer{l0, l1, l2, l3} {
+		alg.handleIncomingLayer(l)
+	}
+	assert.Equal(t, mesh.LayerID(2), alg.pBase.Layer())
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	metrics := make(map[string]float64)
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		switch {
+		case m.Histogram != nil:
+			metrics[f.GetName()] = float64(m.Histogram.GetSampleCount())
+		case m.Gauge != nil:
+			metrics[f.GetName()] = m.Gauge.GetValue()
+		case m.Counter != nil:
+			metrics[f.GetName()] = m.Counter.GetValue()
+		}
+	}
+
+	// genesis isn't counted, the second block of layer 1 isn't voted for
+	assert.Equal(t, map[string]float64{
+		"spacemesh_consensus_layer_update_duration_seconds": 3,
+		"spacemesh_consensus_complete_patterns":             float64(len(alg.tComplete)),
+		"spacemesh_consensus_blocks_against_total":          1,
+	}, metrics)
+}
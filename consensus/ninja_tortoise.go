@@ -2,17 +2,23 @@ package consensus
 
 import (
 	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/spacemeshos/go-spacemesh/common"
 	"github.com/spacemeshos/go-spacemesh/log"
 	"github.com/spacemeshos/go-spacemesh/mesh"
-	"hash/fnv"
+	"golang.org/x/crypto/blake2b"
+	"io"
 	"math"
 	"sort"
+	"sync"
+	"time"
 )
 
 type vec [2]int
-type PatternId uint32
+type PatternId uint64
 type LayerId mesh.LayerID
 
 const ( //Threshold
@@ -21,8 +27,29 @@ const ( //Threshold
 	LocalThreshold  = 0.8 //ThetaL
 	GlobalThreshold = 0.6 //ThetaG
 	Genesis         = 0
+	LayersPerEpoch  = 1000 //number of layers in an epoch
 )
 
+// TortoiseConfig holds the parameters of the tortoise
+type TortoiseConfig struct {
+	K               mesh.LayerID // number of explicit layers to vote for
+	Window          mesh.LayerID // number of layers a new good pattern recounts votes for
+	LocalThreshold  float64      // ThetaL
+	GlobalThreshold float64      // ThetaG
+	LayersPerEpoch  mesh.LayerID // number of layers in an epoch for epoch weights, 0 puts all layers in epoch 0
+}
+
+// DefaultTortoiseConfig returns the config with the default K, Window, thresholds and epoch length
+func DefaultTortoiseConfig() TortoiseConfig {
+	return TortoiseConfig{
+		K:               K,
+		Window:          Window,
+		LocalThreshold:  LocalThreshold,
+		GlobalThreshold: GlobalThreshold,
+		LayersPerEpoch:  LayersPerEpoch,
+	}
+}
+
 var ( //correction vectors type
 	//Opinion
 	Support = vec{1, 0}
@@ -30,6 +57,30 @@ var ( //correction vectors type
 	Abstain = vec{0, 0}
 )
 
+// ErrBlockNotKnown is returned when querying a block the tortoise hasn't processed
+var ErrBlockNotKnown = errors.New("block not known")
+
+// ErrBlockNotInPattern is returned when a pattern's tally has no entry for a block
+var ErrBlockNotInPattern = errors.New("block not in pattern tally")
+
+// ErrNoExplicitVote is returned when a block has no explicit vote for a layer
+var ErrNoExplicitVote = errors.New("no explicit vote for layer")
+
+// ErrEpochNotFinalized is returned when pBase hasn't advanced past the last layer of an epoch
+var ErrEpochNotFinalized = errors.New("epoch not finalized")
+
+// ErrBlockNotYetVoted is returned when pBase has no tally for a block
+var ErrBlockNotYetVoted = errors.New("block not yet voted")
+
+// ErrNoBase is returned when the tortoise has no opinion since no complete pattern was found yet
+var ErrNoBase = errors.New("no complete base pattern")
+
+// ErrUndecided is returned when the pBase opinion neither supports nor votes against a block
+var ErrUndecided = errors.New("block validity undecided")
+
+// ErrInconsistentLayer is returned in strict mode when a block of a layer views a block of the same or a later layer
+var ErrInconsistentLayer = errors.New("layer has blocks viewing blocks of the same or later layers")
+
 func Max(i mesh.LayerID, j mesh.LayerID) mesh.LayerID {
 	if i > j {
 		return i
@@ -62,53 +113,241 @@ func (vp votingPattern) Layer() mesh.LayerID {
 	return vp.LayerID
 }
 
+// PatternInfo describes a voting pattern, Blocks are the sorted ids of the blocks in the pattern
+type PatternInfo struct {
+	PatternID uint64
+	Layer     mesh.LayerID
+	Blocks    []mesh.BlockID
+}
+
+// SyncStatus describes how far behind the latest known layer the tortoise is
+type SyncStatus struct {
+	PBaseLayer  mesh.LayerID
+	LatestKnown mesh.LayerID
+	Lag         mesh.LayerID
+	IsSynced    bool // true if the lag is at most K layers
+}
+
+// TieBreaker returns the good pattern out of two patterns of the same layer with equal support
+type TieBreaker func(p1, p2 votingPattern) votingPattern
+
+// lowerPatternId is the default TieBreaker, the pattern with the numerically lower id wins
+func lowerPatternId(p1, p2 votingPattern) votingPattern {
+	if p2.id < p1.id {
+		return p2
+	}
+	return p1
+}
+
 //todo memory optimizations
 type ninjaTortoise struct {
 	log.Log
+	mutex              sync.Mutex
+	cfg                TortoiseConfig
 	avgLayerSize       uint32
+	adaptiveLayerSize  bool
+	strict             bool
 	pBase              votingPattern
 	blocks             map[mesh.BlockID]*mesh.Block                     //block cache
 	tEffective         map[mesh.BlockID]votingPattern                   //Explicit voting pattern of latest layer for a block
 	tCorrect           map[mesh.BlockID]map[mesh.BlockID]vec            //correction vectors
 	tExplicit          map[mesh.BlockID]map[mesh.LayerID]votingPattern  //explict votes from block to layer pattern
 	layerBlocks        map[mesh.LayerID][]mesh.BlockID                  //block ids in each layer
+	layerBlockSet      map[mesh.LayerID]map[mesh.BlockID]struct{}       //set of block ids in each layer, same as layerBlocks
 	tGood              map[mesh.LayerID]votingPattern                   //good pattern for layer i
-	tSupport           map[votingPattern]int                            //for pattern p the number of blocks that support p
+	tSupport           map[votingPattern]int                            //for pattern p the weight of the blocks that support p
+	layerWeight        map[mesh.LayerID]int                             //the weight of the blocks in each layer
+	latest             mesh.LayerID                                     //the highest layer in layerBlocks
 	tComplete          map[votingPattern]struct{}                       //complete voting patterns
 	tEffectiveToBlocks map[votingPattern][]mesh.BlockID                 //inverse blocks effective pattern
 	tVote              map[votingPattern]map[mesh.BlockID]vec           //global opinion
 	tTally             map[votingPattern]map[mesh.BlockID]vec           //for pattern p and block b count votes for b according to p
 	tPattern           map[votingPattern]map[mesh.BlockID]struct{}      //set of blocks that comprise pattern p
 	tPatSupport        map[votingPattern]map[mesh.LayerID]votingPattern //pattern support count
+	patternHash        func([]mesh.BlockID) uint64                      //hashes the sorted block ids of a pattern, nil for fnv
+	tieBreaker         TieBreaker                                       //picks the good pattern between patterns with equal support
+	correctnessAudit   func(mesh.BlockID, votingPattern, *vec)          //called with every computed correction vector, nil if not set
+	epochWeight        func(mesh.BlockID, uint32) uint64                //weight of the votes of a block in an epoch, nil weighs all votes 1
+	workerPoolSize     int                                              //number of goroutines updating pattern tallies, sequential if less than 2
+	isEquivocation     func(b1, b2 *mesh.Block) bool                    //returns true if both blocks are from the same miner for the same layer
+	equivocatingMiners map[string]struct{}                              //miners that submitted more than one block for a layer
+	pendingBlocks      map[mesh.LayerID][]*mesh.Block                   //blocks submitted for layers not yet processed
+	flushTimers        map[mesh.LayerID]*time.Timer                     //flushes a pending layer after flushTimeout
+	flushTimeout       time.Duration                                    //time to wait for the blocks of a layer after the first is submitted
+	stalenessThreshold uint32                                           //number of layers pBase may lag behind before it is stale, 0 disables
+	stalenessHook      func(mesh.LayerID, mesh.LayerID)                 //called with the current and pBase layers once pBase is stale
+	stalePBase         *mesh.LayerID                                    //the pBase layer the staleness hook was called for, nil if not stale
+	metrics            *tortoiseMetrics                                 //exported once registered with RegisterMetrics
+	checkpoint         *TortoiseCheckpoint                              //the checkpoint the tables were recovered from, nil if they start at genesis
+}
+
+// Option configures a ninjaTortoise on creation
+type Option func(ni *ninjaTortoise)
+
+// WithPatternHashFn sets the function used to hash the sorted block ids of a voting pattern to its id
+func WithPatternHashFn(fn func([]mesh.BlockID) uint64) Option {
+	return func(ni *ninjaTortoise) {
+		ni.patternHash = fn
+	}
+}
+
+// WithStalenessHook sets the function called when pBase has not advanced for more than the staleness threshold layers,
+// it is called once per stall and again only after pBase advances
+func WithStalenessHook(fn func(currentLayer mesh.LayerID, pBaseLayer mesh.LayerID)) Option {
+	return func(ni *ninjaTortoise) {
+		ni.stalenessHook = fn
+	}
+}
+
+// WithTieBreaker sets the function picking the good pattern of a layer when two of its patterns have equal support
+func WithTieBreaker(fn TieBreaker) Option {
+	return func(ni *ninjaTortoise) {
+		ni.tieBreaker = fn
+	}
+}
+
+// WithEpochWeightFn sets the function returning the weight of the votes of a block given the epoch of its layer,
+// like SetEpochWeightFn
+func WithEpochWeightFn(fn func(blockID mesh.BlockID, epoch uint32) uint64) Option {
+	return func(ni *ninjaTortoise) {
+		ni.epochWeight = fn
+	}
+}
+
+// WithWorkerPoolSize sets the number of goroutines used to update the tally of a new good pattern
+func WithWorkerPoolSize(n int) Option {
+	return func(ni *ninjaTortoise) {
+		ni.workerPoolSize = n
+	}
+}
+
+func NewNinjaTortoise(layerSize uint32, cfg TortoiseConfig, log log.Log, opts ...Option) *ninjaTortoise {
+	ni := &ninjaTortoise{
+		Log:          log,
+		cfg:          cfg,
+		avgLayerSize: layerSize,
+		flushTimeout: DefaultFlushTimeout,
+		tieBreaker:   lowerPatternId,
+		metrics:      newTortoiseMetrics(),
+	}
+	ni.initTables()
+
+	for _, opt := range opts {
+		opt(ni)
+	}
+	return ni
+}
+
+func (ni *ninjaTortoise) initTables() {
+	ni.pBase = votingPattern{}
+	ni.blocks = map[mesh.BlockID]*mesh.Block{}
+	ni.tEffective = map[mesh.BlockID]votingPattern{}
+	ni.tCorrect = map[mesh.BlockID]map[mesh.BlockID]vec{}
+	ni.layerBlocks = map[mesh.LayerID][]mesh.BlockID{}
+	ni.layerBlockSet = map[mesh.LayerID]map[mesh.BlockID]struct{}{}
+	ni.tExplicit = map[mesh.BlockID]map[mesh.LayerID]votingPattern{}
+	ni.tGood = map[mesh.LayerID]votingPattern{}
+	ni.tSupport = map[votingPattern]int{}
+	ni.layerWeight = map[mesh.LayerID]int{}
+	ni.latest = 0
+	ni.tPattern = map[votingPattern]map[mesh.BlockID]struct{}{}
+	ni.tVote = map[votingPattern]map[mesh.BlockID]vec{}
+	ni.tTally = map[votingPattern]map[mesh.BlockID]vec{}
+	ni.tComplete = map[votingPattern]struct{}{}
+	ni.tEffectiveToBlocks = map[votingPattern][]mesh.BlockID{}
+	ni.tPatSupport = map[votingPattern]map[mesh.LayerID]votingPattern{}
+	ni.equivocatingMiners = map[string]struct{}{}
+	ni.pendingBlocks = map[mesh.LayerID][]*mesh.Block{}
+	ni.flushTimers = map[mesh.LayerID]*time.Timer{}
+	ni.stalePBase = nil
+	ni.checkpoint = nil
 }
 
-func NewNinjaTortoise(layerSize uint32, log log.Log) *ninjaTortoise {
-	return &ninjaTortoise{
-		Log:                log,
-		avgLayerSize:       layerSize,
-		pBase:              votingPattern{},
-		blocks:             map[mesh.BlockID]*mesh.Block{},
-		tEffective:         map[mesh.BlockID]votingPattern{},
-		tCorrect:           map[mesh.BlockID]map[mesh.BlockID]vec{},
-		layerBlocks:        map[mesh.LayerID][]mesh.BlockID{},
-		tExplicit:          map[mesh.BlockID]map[mesh.LayerID]votingPattern{},
-		tGood:              map[mesh.LayerID]votingPattern{},
-		tSupport:           map[votingPattern]int{},
-		tPattern:           map[votingPattern]map[mesh.BlockID]struct{}{},
-		tVote:              map[votingPattern]map[mesh.BlockID]vec{},
-		tTally:             map[votingPattern]map[mesh.BlockID]vec{},
-		tComplete:          map[votingPattern]struct{}{},
-		tEffectiveToBlocks: map[votingPattern][]mesh.BlockID{},
-		tPatSupport:        map[votingPattern]map[mesh.LayerID]votingPattern{},
+// Reset clears all the state of the tortoise while keeping its configuration, the next layer processed should be genesis
+func (ni *ninjaTortoise) Reset() {
+	ni.mutex.Lock()
+	ni.initTables()
+	ni.mutex.Unlock()
+}
+
+// SetStalenessThreshold sets the number of layers pBase may lag behind the latest layer before the staleness hook
+// is called, 0 disables staleness detection
+func (ni *ninjaTortoise) SetStalenessThreshold(n uint32) {
+	ni.mutex.Lock()
+	ni.stalenessThreshold = n
+	ni.mutex.Unlock()
+}
+
+// checkStaleness calls the staleness hook if pBase is more than stalenessThreshold layers behind layer,
+// unless it was already called for the current pBase
+func (ni *ninjaTortoise) checkStaleness(layer mesh.LayerID) {
+	if ni.stalenessHook == nil || ni.stalenessThreshold == 0 {
+		return
+	}
+
+	pBaseLayer := ni.pBase.Layer()
+	if ni.stalePBase != nil && *ni.stalePBase == pBaseLayer {
+		return
+	}
+	ni.stalePBase = nil
+	if layer-pBaseLayer <= mesh.LayerID(ni.stalenessThreshold) {
+		return
 	}
+
+	ni.Warning("pbase %d did not advance for %d layers", pBaseLayer, layer-pBaseLayer)
+	ni.stalePBase = &pBaseLayer
+	ni.stalenessHook(layer, pBaseLayer)
 }
 
-func (ni *ninjaTortoise) processBlock(b *mesh.Block) {
+// SetAdaptiveLayerSize sets whether thresholds use the estimated layer size when a layer has less blocks than expected
+func (ni *ninjaTortoise) SetAdaptiveLayerSize(enabled bool) {
+	ni.mutex.Lock()
+	ni.adaptiveLayerSize = enabled
+	ni.mutex.Unlock()
+}
+
+// estimateLayerSize returns the layer size used for thresholds of layer.
+// when adaptive and the layer has less blocks than expected, it is the average block count of the Window most recent finalized layers
+func (ni *ninjaTortoise) estimateLayerSize(layer mesh.LayerID) uint32 {
+	if !ni.adaptiveLayerSize || uint32(len(ni.layerBlocks[layer])) >= ni.avgLayerSize {
+		return ni.avgLayerSize
+	}
+
+	var bottom mesh.LayerID
+	if ni.pBase.Layer() >= ni.cfg.Window {
+		bottom = ni.pBase.Layer() - ni.cfg.Window + 1
+	}
+
+	var sum, count uint32
+	for i := bottom; i <= ni.pBase.Layer(); i++ {
+		if blocks, found := ni.layerBlocks[i]; found {
+			sum += uint32(len(blocks))
+			count++
+		}
+	}
+
+	if count == 0 {
+		return ni.avgLayerSize
+	}
+
+	estimate := sum / count
+	if estimate == 0 {
+		estimate = 1
+	}
+	if estimate > ni.avgLayerSize {
+		return ni.avgLayerSize
+	}
+	return estimate
+}
+
+// processBlock adds the voting patterns of b to the tables, it returns an error without modifying the tables if b
+// votes for a block that wasn't processed
+func (ni *ninjaTortoise) processBlock(b *mesh.Block) error {
 
 	ni.Debug("process block: %d layer: %d  ", b.Id, b.Layer())
 
 	if b.Layer() == Genesis {
-		return
+		return nil
 	}
 
 	patternMap := make(map[mesh.LayerID]map[mesh.BlockID]struct{})
@@ -116,7 +355,7 @@ func (ni *ninjaTortoise) processBlock(b *mesh.Block) {
 		ni.Debug("block votes %d", bid)
 		bl, found := ni.blocks[bid]
 		if !found {
-			panic(fmt.Sprintf("error block not found ID %d", bid))
+			return fmt.Errorf("block %d votes for unknown block %d", b.ID(), bid)
 		}
 		if _, found := patternMap[bl.Layer()]; !found {
 			patternMap[bl.Layer()] = map[mesh.BlockID]struct{}{}
@@ -124,49 +363,67 @@ func (ni *ninjaTortoise) processBlock(b *mesh.Block) {
 		patternMap[bl.Layer()][bl.ID()] = struct{}{}
 	}
 
+	ni.addBlockPatterns(b.ID(), patternMap)
+	return nil
+}
+
+// addBlockPatterns sets the explicit and effective patterns of block id from its votes by the layer voted for
+func (ni *ninjaTortoise) addBlockPatterns(id mesh.BlockID, patternMap map[mesh.LayerID]map[mesh.BlockID]struct{}) {
 	var effective votingPattern
-	ni.tExplicit[b.ID()] = make(map[mesh.LayerID]votingPattern, K)
+	ni.tExplicit[id] = make(map[mesh.LayerID]votingPattern, ni.cfg.K)
 	for layerId, v := range patternMap {
-		vp := votingPattern{id: getIdsFromSet(v), LayerID: layerId}
+		vp := votingPattern{id: ni.getIdsFromSet(v), LayerID: layerId}
 		ni.tPattern[vp] = v
-		ni.tExplicit[b.ID()][layerId] = vp
+		ni.tExplicit[id][layerId] = vp
 		if layerId >= effective.Layer() {
 			effective = vp
 		}
 	}
 
-	ni.tEffective[b.ID()] = effective
+	ni.tEffective[id] = effective
 
 	v, found := ni.tEffectiveToBlocks[effective]
 	if !found {
 		v = make([]mesh.BlockID, 0, ni.avgLayerSize)
 	}
 	var pattern []mesh.BlockID = nil
-	pattern = append(v, b.ID())
+	pattern = append(v, id)
 	ni.tEffectiveToBlocks[effective] = pattern
 	ni.Debug("effective pattern to blocks %d %d", effective, pattern)
-
-	return
 }
 
+// patternHashKey is the key of the BLAKE2b hash of voting patterns
+var patternHashKey = []byte("spacemesh ninja tortoise voting pattern")
+
+// getId returns the first 64 bits of the keyed BLAKE2b-256 hash of the sorted bids
 func getId(bids []mesh.BlockID) PatternId {
 	sort.Slice(bids, func(i, j int) bool { return bids[i] < bids[j] })
-	// calc
-	h := fnv.New32()
+	h, err := blake2b.New256(patternHashKey)
+	if err != nil {
+		panic(fmt.Sprintf("error creating pattern hash %v", err))
+	}
 	for i := 0; i < len(bids); i++ {
 		h.Write(common.Uint32ToBytes(uint32(bids[i])))
 	}
-	// update
-	sum := h.Sum32()
-	return PatternId(sum)
+	return PatternId(binary.LittleEndian.Uint64(h.Sum(nil)))
 }
 
-func getIdsFromSet(bids map[mesh.BlockID]struct{}) PatternId {
+// getId returns the pattern id of bids using the configured pattern hash
+func (ni *ninjaTortoise) getId(bids []mesh.BlockID) PatternId {
+	if ni.patternHash == nil {
+		return getId(bids)
+	}
+	sort.Slice(bids, func(i, j int) bool { return bids[i] < bids[j] })
+	h := ni.patternHash(bids)
+	return PatternId(h)
+}
+
+func (ni *ninjaTortoise) getIdsFromSet(bids map[mesh.BlockID]struct{}) PatternId {
 	keys := make([]mesh.BlockID, 0, len(bids))
 	for k := range bids {
 		keys = append(keys, k)
 	}
-	return getId(keys)
+	return ni.getId(keys)
 }
 
 func forBlockInView(blocks map[mesh.BlockID]struct{}, blockCache map[mesh.BlockID]*mesh.Block, layer mesh.LayerID, foo func(block *mesh.Block)) {
@@ -195,8 +452,8 @@ func forBlockInView(blocks map[mesh.BlockID]struct{}, blockCache map[mesh.BlockI
 	return
 }
 
-func globalOpinion(v vec, layerSize uint32, delta float64) vec {
-	threshold := float64(GlobalThreshold*delta) * float64(layerSize)
+// globalOpinion returns the opinion of a tally given the threshold one of its sides has to exceed
+func globalOpinion(v vec, threshold float64) vec {
 	if float64(v[0]) > threshold {
 		return Support
 	} else if float64(v[1]) > threshold {
@@ -206,6 +463,93 @@ func globalOpinion(v vec, layerSize uint32, delta float64) vec {
 	}
 }
 
+// SupportRatio returns the support votes for blockID in pattern's tally relative to the global threshold
+func (ni *ninjaTortoise) SupportRatio(pattern votingPattern, blockID mesh.BlockID) (float64, error) {
+	return ni.tallyRatio(pattern, blockID, 0)
+}
+
+// AgainstRatio returns the against votes for blockID in pattern's tally relative to the global threshold
+func (ni *ninjaTortoise) AgainstRatio(pattern votingPattern, blockID mesh.BlockID) (float64, error) {
+	return ni.tallyRatio(pattern, blockID, 1)
+}
+
+// TallyForBlock returns a copy of the raw support/against tally of blockID in pattern
+func (ni *ninjaTortoise) TallyForBlock(pattern votingPattern, blockID mesh.BlockID) (*vec, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	v, found := ni.tTally[pattern][blockID]
+	if !found {
+		return nil, ErrBlockNotInPattern
+	}
+	return &v, nil
+}
+
+// TallyThreshold returns the threshold globalOpinion uses in pattern's tally for the blocks of the layer below the
+// pattern, a block is decided once one side of its tally exceeds it. returns 0 for a pattern of the genesis layer
+func (ni *ninjaTortoise) TallyThreshold(pattern votingPattern) int {
+	if pattern.Layer() == Genesis {
+		return 0
+	}
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	return int(ni.globalThreshold(pattern, pattern.Layer()-1))
+}
+
+// globalThreshold returns the tally a block of layer needs in pattern to get a global opinion, layer must be below pattern
+func (ni *ninjaTortoise) globalThreshold(pattern votingPattern, layer mesh.LayerID) float64 {
+	return ni.cfg.GlobalThreshold * ni.voterWeight(layer, pattern.Layer())
+}
+
+// voterWeight returns the weight of the votes on blocks of layer from the layers after it up to top. it is the layer
+// size estimate times the number of layers if no epoch weight is set, otherwise the weight of the blocks of those layers
+func (ni *ninjaTortoise) voterWeight(layer mesh.LayerID, top mesh.LayerID) float64 {
+	if ni.epochWeight == nil {
+		return float64(top-layer) * float64(ni.estimateLayerSize(layer))
+	}
+	var sum int
+	for l := layer + 1; l <= top; l++ {
+		sum += ni.layerWeight[l]
+	}
+	return float64(sum)
+}
+
+// ConfidenceLevel returns the support tally of blockID in pBase relative to the global threshold, clamped to [0, 1].
+// 1 means pBase supports the block
+func (ni *ninjaTortoise) ConfidenceLevel(blockID mesh.BlockID) (float64, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	tally, found := ni.tTally[ni.pBase][blockID]
+	block, known := ni.blocks[blockID]
+	if !found || !known || block.Layer() >= ni.pBase.Layer() {
+		return 0, ErrBlockNotYetVoted
+	}
+
+	return math.Min(math.Max(float64(tally[0])/ni.globalThreshold(ni.pBase, block.Layer()), 0), 1), nil
+}
+
+func (ni *ninjaTortoise) tallyRatio(pattern votingPattern, blockID mesh.BlockID, idx int) (float64, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	tally, found := ni.tTally[pattern]
+	if !found {
+		return 0, fmt.Errorf("no tally for pattern %d layer %d", pattern.id, pattern.Layer())
+	}
+
+	block, found := ni.blocks[blockID]
+	if !found {
+		return 0, fmt.Errorf("block %d not found", blockID)
+	}
+
+	if block.Layer() >= pattern.Layer() {
+		return 0, fmt.Errorf("block %d layer %d is not below pattern layer %d", blockID, block.Layer(), pattern.Layer())
+	}
+
+	return float64(tally[blockID][idx]) / ni.globalThreshold(pattern, block.Layer()), nil
+}
+
 func (ni *ninjaTortoise) updateCorrectionVectors(p votingPattern, bottomOfWindow mesh.LayerID) {
 	foo := func(x *mesh.Block) {
 		for _, bid := range ni.tEffectiveToBlocks[p] { //for all b who's effective vote is p
@@ -218,6 +562,10 @@ func (ni *ninjaTortoise) updateCorrectionVectors(p votingPattern, bottomOfWindow
 				vo := ni.tVote[p][x.ID()]
 				ni.Debug("vote from pattern %d to block %d layer %d vote %d ", p, x.ID(), x.Layer(), vo)
 				ni.tCorrect[b.Id][x.ID()] = vo.Negate() //Tcorrect[b][x] = -Tvote[p][x]
+				if ni.correctnessAudit != nil {
+					correction := ni.tCorrect[b.Id][x.ID()]
+					ni.correctnessAudit(b.ID(), p, &correction)
+				}
 				ni.Debug("update correction vector for block %d layer %d , pattern %d vote %d for block %d ", b.ID(), b.Layer(), p, ni.tCorrect[b.Id][x.ID()], x.ID())
 			} else {
 				ni.Debug("block %d from layer %d dose'nt explicitly vote for layer %d", b.ID(), b.Layer(), x.Layer())
@@ -230,6 +578,10 @@ func (ni *ninjaTortoise) updateCorrectionVectors(p votingPattern, bottomOfWindow
 
 func (ni *ninjaTortoise) updatePatternTally(newMinGood votingPattern, botomOfWindow mesh.LayerID, correctionMap map[mesh.BlockID]vec, effCountMap map[mesh.LayerID]int) {
 	ni.Debug("update tally pbase id:%d layer:%d p id:%d layer:%d", ni.pBase.id, ni.pBase.Layer(), newMinGood.id, newMinGood.Layer())
+	if ni.workerPoolSize > 1 {
+		ni.updatePatternTallyConcurrently(newMinGood, correctionMap, effCountMap)
+		return
+	}
 	for idx, effc := range effCountMap {
 		g := ni.tGood[idx]
 		for b, v := range ni.tVote[g] {
@@ -246,6 +598,51 @@ func (ni *ninjaTortoise) updatePatternTally(newMinGood votingPattern, botomOfWin
 	}
 }
 
+// updatePatternTallyConcurrently is updatePatternTally split by block between workerPoolSize goroutines.
+// the workers only read the tables and the tally is updated once they are done
+func (ni *ninjaTortoise) updatePatternTallyConcurrently(newMinGood votingPattern, correctionMap map[mesh.BlockID]vec, effCountMap map[mesh.LayerID]int) {
+	blocks := make(map[mesh.BlockID]struct{})
+	for idx := range effCountMap {
+		for b := range ni.tVote[ni.tGood[idx]] {
+			blocks[b] = struct{}{}
+		}
+	}
+
+	type tallyDelta struct {
+		block mesh.BlockID
+		delta vec
+	}
+	jobs := make(chan mesh.BlockID, len(blocks))
+	results := make(chan tallyDelta, len(blocks))
+	var wg sync.WaitGroup
+	for i := 0; i < ni.workerPoolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				var delta vec
+				for idx, effc := range effCountMap {
+					if v, found := ni.tVote[ni.tGood[idx]][b]; found {
+						delta = delta.Add(v.Multiply(effc)).Add(correctionMap[b])
+					}
+				}
+				results <- tallyDelta{b, delta}
+			}
+		}()
+	}
+
+	for b := range blocks {
+		jobs <- b
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	for r := range results {
+		ni.tTally[newMinGood][r.block] = ni.tTally[newMinGood][r.block].Add(r.delta)
+	}
+}
+
 func (ni *ninjaTortoise) getCorrEffCounter() (map[mesh.BlockID]vec, map[mesh.LayerID]int, func(b *mesh.Block)) {
 	correctionMap := make(map[mesh.BlockID]vec)
 	effCountMap := make(map[mesh.LayerID]int)
@@ -253,9 +650,10 @@ func (ni *ninjaTortoise) getCorrEffCounter() (map[mesh.BlockID]vec, map[mesh.Lay
 		if b.Layer() > ni.pBase.Layer() { //because we already copied pbase's votes
 			if eff, found := ni.tEffective[b.ID()]; found {
 				if p, found := ni.tGood[eff.Layer()]; found && eff == p {
-					effCountMap[eff.Layer()] = effCountMap[eff.Layer()] + 1
+					w := ni.voteWeight(b)
+					effCountMap[eff.Layer()] = effCountMap[eff.Layer()] + w
 					for k, v := range ni.tCorrect[b.ID()] {
-						correctionMap[k] = correctionMap[k].Add(v)
+						correctionMap[k] = correctionMap[k].Add(v.Multiply(w))
 					}
 				}
 			}
@@ -270,10 +668,10 @@ func (ni *ninjaTortoise) findMinimalNewlyGoodLayer(layer *mesh.Layer) mesh.Layer
 	minGood := mesh.LayerID(math.MaxUint32)
 
 	var j mesh.LayerID
-	if Window > layer.Index() {
+	if ni.cfg.Window > layer.Index() {
 		j = ni.pBase.Layer() + 1
 	} else {
-		j = Max(ni.pBase.Layer()+1, layer.Index()-Window+1)
+		j = Max(ni.pBase.Layer()+1, layer.Index()-ni.cfg.Window+1)
 	}
 
 	for ; j < layer.Index(); j++ {
@@ -285,9 +683,13 @@ func (ni *ninjaTortoise) findMinimalNewlyGoodLayer(layer *mesh.Layer) mesh.Layer
 			//if a majority supports p (p is good)
 			//according to tal we dont have to know the exact amount, we can multiply layer size by number of layers
 			jGood, found := ni.tGood[j]
-			threshold := 0.5 * float64(mesh.LayerID(ni.avgLayerSize)*(layer.Index()-p.Layer()))
+			threshold := 0.5 * ni.voterWeight(p.Layer(), layer.Index())
 
 			if (jGood != p || !found) && float64(ni.tSupport[p]) > threshold {
+				//keep the current good pattern if it wins a tie
+				if found && ni.tSupport[jGood] == ni.tSupport[p] && ni.tieBreaker(jGood, p) != p {
+					continue
+				}
 				ni.tGood[p.Layer()] = p
 				//if p is the new minimal good layer
 				if p.Layer() < minGood {
@@ -305,17 +707,18 @@ func (ni *ninjaTortoise) updateBlocksSupport(b []*mesh.Block, j mesh.LayerID) ma
 	sUpdated := map[votingPattern]struct{}{}
 	for _, block := range b {
 		//check if block votes for layer j explicitly or implicitly
+		w := ni.voteWeight(block)
 		p, found := ni.tExplicit[block.ID()][j]
 		if found {
 			//explicit
-			ni.tSupport[p]++         //add to supporting patterns
+			ni.tSupport[p] += w      //add to supporting patterns
 			sUpdated[p] = struct{}{} //add to updated patterns
 
 			//implicit
 		} else if eff, effFound := ni.tEffective[block.ID()]; effFound {
 			p, found = ni.tPatSupport[eff][j]
 			if found {
-				ni.tSupport[p]++         //add to supporting patterns
+				ni.tSupport[p] += w      //add to supporting patterns
 				sUpdated[p] = struct{}{} //add to updated patterns
 			}
 		}
@@ -331,6 +734,7 @@ func (ni *ninjaTortoise) addPatternVote(p votingPattern, view map[mesh.BlockID]s
 		if bl.Layer() <= ni.pBase.Layer() {
 			return
 		}
+		w := ni.voteWeight(bl)
 
 		if vp, found = ni.tExplicit[b]; !found {
 			panic(fmt.Sprintf("block %d has no explicit voting, something went wrong ", b))
@@ -338,9 +742,9 @@ func (ni *ninjaTortoise) addPatternVote(p votingPattern, view map[mesh.BlockID]s
 		for _, ex := range vp {
 			for _, bl := range ni.layerBlocks[ex.Layer()] {
 				if _, found := ni.tPattern[ex][bl]; found {
-					ni.tTally[p][bl] = ni.tTally[p][bl].Add(Support)
+					ni.tTally[p][bl] = ni.tTally[p][bl].Add(Support.Multiply(w))
 				} else if _, inSet := view[bl]; inSet { //in view but not in pattern
-					ni.tTally[p][bl] = ni.tTally[p][bl].Add(Against)
+					ni.tTally[p][bl] = ni.tTally[p][bl].Add(Against.Multiply(w))
 				}
 			}
 		}
@@ -348,6 +752,23 @@ func (ni *ninjaTortoise) addPatternVote(p votingPattern, view map[mesh.BlockID]s
 	return addPatternVote
 }
 
+// voteWeight returns the weight of the votes of b in the epoch of its layer, 1 if no epoch weight is set.
+// weights are capped at math.MaxInt32 so the sums of a window of weights don't overflow
+func (ni *ninjaTortoise) voteWeight(b *mesh.Block) int {
+	if ni.epochWeight == nil {
+		return 1
+	}
+	var epoch uint32
+	if ni.cfg.LayersPerEpoch > 0 {
+		epoch = uint32(b.Layer() / ni.cfg.LayersPerEpoch)
+	}
+	w := ni.epochWeight(b.ID(), epoch)
+	if w > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(w)
+}
+
 func sumNodesInView(layerBlockCounter map[mesh.LayerID]int, layer mesh.LayerID, pLayer mesh.LayerID) vec {
 	var sum int
 	for sum = 0; layer <= pLayer; layer++ {
@@ -356,20 +777,427 @@ func sumNodesInView(layerBlockCounter map[mesh.LayerID]int, layer mesh.LayerID,
 	return Against.Multiply(sum)
 }
 
-func (ni *ninjaTortoise) processBlocks(layer *mesh.Layer) {
+// processBlocks processes the blocks of layer in order, the votes of all blocks are checked first so on error no block
+// of the layer is processed
+func (ni *ninjaTortoise) processBlocks(layer *mesh.Layer) error {
+	if err := ni.checkBlockVotes(layer); err != nil {
+		return err
+	}
 	for _, block := range layer.Blocks() {
-		ni.processBlock(block)
+		if err := ni.processBlock(block); err != nil {
+			return err
+		}
+		ni.detectEquivocation(layer.Index(), block)
 		ni.blocks[block.ID()] = block
-		ni.layerBlocks[layer.Index()] = append(ni.layerBlocks[layer.Index()], block.ID())
+		ni.addLayerBlock(layer.Index(), block.ID())
+	}
+	return nil
+}
+
+// checkBlockVotes returns an error if a block of layer votes for a block that is neither processed nor before it in layer
+func (ni *ninjaTortoise) checkBlockVotes(layer *mesh.Layer) error {
+	inLayer := make(map[mesh.BlockID]struct{}, len(layer.Blocks()))
+	for _, b := range layer.Blocks() {
+		if b.Layer() != Genesis {
+			for _, bid := range b.BlockVotes {
+				_, known := ni.blocks[bid]
+				_, before := inLayer[bid]
+				if !known && !before {
+					return fmt.Errorf("block %d votes for unknown block %d", b.ID(), bid)
+				}
+			}
+		}
+		inLayer[b.ID()] = struct{}{}
+	}
+	return nil
+}
+
+// addLayerBlock adds id to the blocks of layer in both layerBlocks and layerBlockSet and updates the latest layer
+func (ni *ninjaTortoise) addLayerBlock(layer mesh.LayerID, id mesh.BlockID) {
+	ni.layerBlocks[layer] = append(ni.layerBlocks[layer], id)
+	ni.latest = Max(ni.latest, layer)
+	ni.layerWeight[layer] += ni.voteWeight(ni.blocks[id])
+	if _, found := ni.layerBlockSet[layer]; !found {
+		ni.layerBlockSet[layer] = make(map[mesh.BlockID]struct{})
+	}
+	ni.layerBlockSet[layer][id] = struct{}{}
+}
+
+// InLayer returns true if the block was processed as part of layer
+func (ni *ninjaTortoise) InLayer(blockID mesh.BlockID, layer mesh.LayerID) bool {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	_, found := ni.layerBlockSet[layer][blockID]
+	return found
+}
+
+// SetEquivocationDetector sets the function used to detect two blocks from the same miner in the same layer
+func (ni *ninjaTortoise) SetEquivocationDetector(fn func(b1, b2 *mesh.Block) bool) {
+	ni.mutex.Lock()
+	ni.isEquivocation = fn
+	ni.mutex.Unlock()
+}
+
+// SetCorrectnessAuditHook sets a function called synchronously with the corrected block, its effective pattern and
+// a copy of every correction vector computed. fn must not modify the tortoise
+func (ni *ninjaTortoise) SetCorrectnessAuditHook(fn func(blockID mesh.BlockID, pattern votingPattern, correction *vec)) {
+	ni.mutex.Lock()
+	ni.correctnessAudit = fn
+	ni.mutex.Unlock()
+}
+
+// SetEpochWeightFn sets the function returning the weight of the votes of a block given the epoch of its layer,
+// e.g. the stake of its miner in that epoch. the epoch of a layer is layer / LayersPerEpoch.
+// the pattern support, the tallies and their thresholds are all counted in weight instead of blocks
+func (ni *ninjaTortoise) SetEpochWeightFn(fn func(blockID mesh.BlockID, epoch uint32) uint64) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	ni.epochWeight = fn
+	for l, ids := range ni.layerBlocks {
+		ni.layerWeight[l] = 0
+		for _, id := range ids {
+			ni.layerWeight[l] += ni.voteWeight(ni.blocks[id])
+		}
+	}
+}
+
+// IsEquivocating returns true if the miner was detected submitting more than one block for a layer
+func (ni *ninjaTortoise) IsEquivocating(minerID string) bool {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	_, found := ni.equivocatingMiners[minerID]
+	return found
+}
+
+func (ni *ninjaTortoise) detectEquivocation(layer mesh.LayerID, b *mesh.Block) {
+	if ni.isEquivocation == nil {
+		return
 	}
 
+	for _, id := range ni.layerBlocks[layer] {
+		if other := ni.blocks[id]; other != nil && ni.isEquivocation(other, b) {
+			ni.Warning("miner %v equivocated in layer %d with blocks %d %d", b.MinerID, layer, other.ID(), b.ID())
+			ni.equivocatingMiners[b.MinerID] = struct{}{}
+		}
+	}
 }
 
 func (ni *ninjaTortoise) handleGenesis(genesis *mesh.Layer) {
-	vp := votingPattern{id: getId(ni.layerBlocks[Genesis]), LayerID: Genesis}
+	vp := votingPattern{id: ni.getId(ni.layerBlocks[Genesis]), LayerID: Genesis}
 	ni.pBase = vp
 	ni.tGood[Genesis] = vp
-	ni.tExplicit[genesis.Blocks()[0].ID()] = make(map[mesh.LayerID]votingPattern, K*ni.avgLayerSize)
+	ni.tExplicit[genesis.Blocks()[0].ID()] = make(map[mesh.LayerID]votingPattern, uint32(ni.cfg.K)*ni.avgLayerSize)
+}
+
+// SetGenesisBlock inserts the genesis block and sets pBase to the genesis pattern, must be called before any layer is processed
+func (ni *ninjaTortoise) SetGenesisBlock(block *mesh.Block) error {
+	if block.Layer() != Genesis {
+		return fmt.Errorf("genesis block %d has layer %d", block.ID(), block.Layer())
+	}
+
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	if len(ni.layerBlocks) > 0 {
+		return fmt.Errorf("genesis block must be set before processing any layer")
+	}
+
+	ni.blocks[block.ID()] = block
+	ni.addLayerBlock(Genesis, block.ID())
+	ni.handleGenesis(mesh.NewExistingLayer(Genesis, []*mesh.Block{block}))
+	return nil
+}
+
+// SyncStatus returns the lag of pBase behind latestKnownLayer
+func (ni *ninjaTortoise) SyncStatus(latestKnownLayer mesh.LayerID) SyncStatus {
+	ni.mutex.Lock()
+	pBase := ni.pBase.Layer()
+	ni.mutex.Unlock()
+
+	var lag mesh.LayerID
+	if latestKnownLayer > pBase {
+		lag = latestKnownLayer - pBase
+	}
+	return SyncStatus{PBaseLayer: pBase, LatestKnown: latestKnownLayer, Lag: lag, IsSynced: lag <= ni.cfg.K}
+}
+
+// GlobalOpinionMap returns a copy of the global opinion of the current pBase on all blocks below it
+func (ni *ninjaTortoise) GlobalOpinionMap() (map[mesh.BlockID]*vec, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	votes, found := ni.tVote[ni.pBase]
+	if !found {
+		return nil, ErrNoBase
+	}
+
+	opinion := make(map[mesh.BlockID]*vec, len(votes))
+	for id, v := range votes {
+		vote := v
+		opinion[id] = &vote
+	}
+	return opinion, nil
+}
+
+// EpochBlocks returns the blocks supported by the pBase opinion for each layer of epoch,
+// an epoch is the range of epochSize layers [epoch*epochSize, (epoch+1)*epochSize)
+func (ni *ninjaTortoise) EpochBlocks(epoch uint32, epochSize uint32) (map[mesh.LayerID][]mesh.BlockID, error) {
+	if epochSize == 0 {
+		return nil, fmt.Errorf("epoch size must be positive")
+	}
+	first := mesh.LayerID(epoch) * mesh.LayerID(epochSize)
+	last := first + mesh.LayerID(epochSize) - 1
+
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	if ni.pBase.Layer() <= last {
+		return nil, ErrEpochNotFinalized
+	}
+
+	votes := ni.tVote[ni.pBase]
+	res := make(map[mesh.LayerID][]mesh.BlockID, epochSize)
+	for idx := first; idx <= last; idx++ {
+		bids := make([]mesh.BlockID, 0, len(ni.layerBlocks[idx]))
+		for _, bid := range ni.layerBlocks[idx] {
+			if votes[bid] == Support {
+				bids = append(bids, bid)
+			}
+		}
+		sort.Slice(bids, func(i, j int) bool { return bids[i] < bids[j] })
+		res[idx] = bids
+	}
+	return res, nil
+}
+
+// IsFinalized returns true if blockID is in a layer up to pBase and pBase's global opinion supports it
+func (ni *ninjaTortoise) IsFinalized(blockID mesh.BlockID) (bool, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	block, found := ni.blocks[blockID]
+	if !found {
+		return false, ErrBlockNotKnown
+	}
+
+	return block.Layer() <= ni.pBase.Layer() && ni.tVote[ni.pBase][blockID] == Support, nil
+}
+
+// SupportingPatterns returns the patterns whose global opinion supports blockID, ordered by layer and id
+func (ni *ninjaTortoise) SupportingPatterns(blockID mesh.BlockID) []votingPattern {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	patterns := make([]votingPattern, 0)
+	for p, votes := range ni.tVote {
+		if votes[blockID] == Support {
+			patterns = append(patterns, p)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if patterns[i].Layer() != patterns[j].Layer() {
+			return patterns[i].Layer() < patterns[j].Layer()
+		}
+		return patterns[i].id < patterns[j].id
+	})
+	return patterns
+}
+
+// BlocksBelowThreshold classifies the blocks of layer by pBase's global opinion, blocks it supports are valid,
+// blocks it votes against are invalid and the rest are undecided. each slice is sorted
+func (ni *ninjaTortoise) BlocksBelowThreshold(layer mesh.LayerID) (valid []mesh.BlockID, invalid []mesh.BlockID, undecided []mesh.BlockID) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	valid = make([]mesh.BlockID, 0, len(ni.layerBlocks[layer]))
+	invalid = make([]mesh.BlockID, 0)
+	undecided = make([]mesh.BlockID, 0)
+	votes := ni.tVote[ni.pBase]
+	for _, bid := range ni.layerBlocks[layer] {
+		switch votes[bid] {
+		case Support:
+			valid = append(valid, bid)
+		case Against:
+			invalid = append(invalid, bid)
+		default:
+			undecided = append(undecided, bid)
+		}
+	}
+
+	for _, bids := range [][]mesh.BlockID{valid, invalid, undecided} {
+		sort.Slice(bids, func(i, j int) bool { return bids[i] < bids[j] })
+	}
+	return valid, invalid, undecided
+}
+
+// ContextualValidity returns true if the pBase opinion supports blockID and false if it votes against it.
+// ErrUndecided is returned if the opinion abstains or the block isn't in the view of pBase
+func (ni *ninjaTortoise) ContextualValidity(blockID mesh.BlockID) (bool, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	block, found := ni.blocks[blockID]
+	if !found || block.Layer() > ni.pBase.Layer() {
+		return false, ErrUndecided
+	}
+
+	vote, found := ni.tVote[ni.pBase][blockID]
+	if !found {
+		return false, ErrUndecided
+	}
+	switch vote {
+	case Support:
+		return true, nil
+	case Against:
+		return false, nil
+	}
+	return false, ErrUndecided
+}
+
+// EffectivePattern returns the explicit voting pattern of the latest layer the block voted for
+func (ni *ninjaTortoise) EffectivePattern(blockID mesh.BlockID) (*PatternInfo, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	if _, found := ni.blocks[blockID]; !found {
+		return nil, ErrBlockNotKnown
+	}
+
+	eff := ni.tEffective[blockID]
+	blocks := make([]mesh.BlockID, 0, len(ni.tPattern[eff]))
+	for id := range ni.tPattern[eff] {
+		blocks = append(blocks, id)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+
+	return &PatternInfo{PatternID: uint64(eff.id), Layer: eff.Layer(), Blocks: blocks}, nil
+}
+
+// BlockVotes returns the pattern blockID explicitly voted for in layer
+func (ni *ninjaTortoise) BlockVotes(blockID mesh.BlockID, layer mesh.LayerID) (*votingPattern, error) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	if _, found := ni.blocks[blockID]; !found {
+		return nil, ErrBlockNotKnown
+	}
+
+	vp, found := ni.tExplicit[blockID][layer]
+	if !found {
+		return nil, ErrNoExplicitVote
+	}
+	return &vp, nil
+}
+
+// PatternSupport returns the support of the good pattern of layer and the maximal support it could have got from the layers processed after it
+func (ni *ninjaTortoise) PatternSupport(layer mesh.LayerID) (count int, total int, found bool) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	p, found := ni.tGood[layer]
+	if !found {
+		return 0, 0, false
+	}
+
+	total = int(ni.avgLayerSize) * int(ni.latestLayer()-layer)
+	if ni.epochWeight != nil {
+		total = int(ni.voterWeight(layer, ni.latestLayer()))
+	}
+	return ni.tSupport[p], total, true
+}
+
+// latestLayer returns the highest layer processed
+func (ni *ninjaTortoise) latestLayer() mesh.LayerID {
+	return ni.latest
+}
+
+// WindowedConsistencyCheck returns the layers between pBase and Window layers after it that have no blocks,
+// layers after the latest processed layer are not checked
+func (ni *ninjaTortoise) WindowedConsistencyCheck() []mesh.LayerID {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	return ni.windowGaps()
+}
+
+func (ni *ninjaTortoise) windowGaps() []mesh.LayerID {
+	missing := make([]mesh.LayerID, 0)
+	if len(ni.layerBlocks) == 0 {
+		return missing
+	}
+
+	end := ni.pBase.Layer() + ni.cfg.Window
+	if latest := ni.latestLayer(); latest < end {
+		end = latest
+	}
+	for idx := ni.pBase.Layer(); idx <= end; idx++ {
+		if _, found := ni.layerBlocks[idx]; !found {
+			missing = append(missing, idx)
+		}
+	}
+	return missing
+}
+
+// LayerWindow returns the first and last layers of the window of the most recently processed layer
+func (ni *ninjaTortoise) LayerWindow() (start, end mesh.LayerID) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	return ni.layerWindow()
+}
+
+func (ni *ninjaTortoise) layerWindow() (start, end mesh.LayerID) {
+	end = ni.latestLayer()
+	if end >= ni.cfg.Window {
+		start = end - ni.cfg.Window + 1
+	}
+	return start, end
+}
+
+// InWindow returns true if layer is in the window of the most recently processed layer
+func (ni *ninjaTortoise) InWindow(layer mesh.LayerID) bool {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	start, end := ni.layerWindow()
+	return layer >= start && layer <= end
+}
+
+// DumpBlockGraph writes the block DAG to w as a graphviz DOT graph, nodes are blocks labeled with their layer and edges are view edges
+func (ni *ninjaTortoise) DumpBlockGraph(w io.Writer) error {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	layers := make([]mesh.LayerID, 0, len(ni.layerBlocks))
+	for l := range ni.layerBlocks {
+		layers = append(layers, l)
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i] < layers[j] })
+
+	if _, err := fmt.Fprintln(w, "digraph blocks {"); err != nil {
+		return err
+	}
+
+	for _, l := range layers {
+		for _, id := range ni.layerBlocks[l] {
+			if _, err := fmt.Fprintf(w, "\t\"%d\" [label=\"%d layer %d\"];\n", id, id, l); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, l := range layers {
+		for _, id := range ni.layerBlocks[l] {
+			for _, view := range ni.blocks[id].ViewEdges {
+				if _, err := fmt.Fprintf(w, "\t\"%d\" -> \"%d\";\n", id, view); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
 }
 
 //todo send map instead of ni
@@ -377,7 +1205,7 @@ func updatePatSupport(ni *ninjaTortoise, p votingPattern, bids []mesh.BlockID, i
 	if val, found := ni.tPatSupport[p]; !found || val == nil {
 		ni.tPatSupport[p] = make(map[mesh.LayerID]votingPattern)
 	}
-	pid := getId(bids)
+	pid := ni.getId(bids)
 	ni.Debug("update support for %d layer %d supported pattern %d", p, idx, pid)
 	ni.tPatSupport[p][idx] = votingPattern{id: pid, LayerID: idx}
 }
@@ -415,14 +1243,93 @@ func (ni *ninjaTortoise) getVote(id mesh.BlockID) vec {
 	return ni.tVote[ni.pBase][id]
 }
 
-func (ni *ninjaTortoise) handleIncomingLayer(newlyr *mesh.Layer) { //i most recent layer
+// SetStrictMode sets whether layers are verified with VerifyLayerConsistency before they are processed,
+// in strict mode an inconsistent layer is not processed
+func (ni *ninjaTortoise) SetStrictMode(enabled bool) {
+	ni.mutex.Lock()
+	ni.strict = enabled
+	ni.mutex.Unlock()
+}
+
+// VerifyLayerConsistency returns an error for every view edge of blocks that references a block of layer or a later
+// layer. referenced blocks that are neither known nor in blocks are not checked
+func (ni *ninjaTortoise) VerifyLayerConsistency(layer mesh.LayerID, blocks []*mesh.Block) []error {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	return ni.verifyLayerConsistency(layer, blocks)
+}
+
+func (ni *ninjaTortoise) verifyLayerConsistency(layer mesh.LayerID, blocks []*mesh.Block) []error {
+	inLayer := make(map[mesh.BlockID]struct{}, len(blocks))
+	for _, b := range blocks {
+		inLayer[b.ID()] = struct{}{}
+	}
+
+	var errs []error
+	for _, b := range blocks {
+		for _, id := range b.ViewEdges {
+			if _, found := inLayer[id]; found {
+				errs = append(errs, fmt.Errorf("block %d of layer %d views block %d of the same layer", b.ID(), layer, id))
+			} else if viewed, found := ni.blocks[id]; found && viewed.Layer() >= layer {
+				errs = append(errs, fmt.Errorf("block %d of layer %d views block %d of layer %d", b.ID(), layer, id, viewed.Layer()))
+			}
+		}
+	}
+	return errs
+}
+
+func (ni *ninjaTortoise) handleIncomingLayer(newlyr *mesh.Layer) error {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	return ni.updateTables(newlyr)
+}
+
+// AddBatchBlocks processes all blocks of a layer under a single lock acquisition and returns the resulting pBase layer.
+// in strict mode an inconsistent layer is not processed and ErrInconsistentLayer is returned
+func (ni *ninjaTortoise) AddBatchBlocks(layer mesh.LayerID, blocks []*mesh.Block) (mesh.LayerID, error) {
+	for _, b := range blocks {
+		if b.Layer() != layer {
+			return 0, fmt.Errorf("block %d is in layer %d, expected layer %d", b.ID(), b.Layer(), layer)
+		}
+	}
+
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	err := ni.updateTables(mesh.NewExistingLayer(layer, blocks))
+	return ni.pBase.Layer(), err
+}
+
+func (ni *ninjaTortoise) updateTables(newlyr *mesh.Layer) error { //i most recent layer
+	return ni.updateTablesContext(context.Background(), newlyr)
+}
+
+// updateTablesContext is updateTables returning ctx's error if ctx is done before the tables are modified. once the
+// blocks are processed the update runs to completion, so the tables are never left partially updated
+func (ni *ninjaTortoise) updateTablesContext(ctx context.Context, newlyr *mesh.Layer) error {
 	ni.Info("update tables layer %d with %d blocks", newlyr.Index(), len(newlyr.Blocks()))
+	start, prevBase := time.Now(), ni.pBase
+	if ni.strict {
+		if errs := ni.verifyLayerConsistency(newlyr.Index(), newlyr.Blocks()); len(errs) > 0 {
+			for _, err := range errs {
+				ni.Error("layer %d is inconsistent: %v", newlyr.Index(), err)
+			}
+			return ErrInconsistentLayer
+		}
+	}
+	for _, idx := range ni.windowGaps() {
+		ni.Warning("layer %d in the window of pbase %d is missing", idx, ni.pBase.Layer())
+	}
 
-	ni.processBlocks(newlyr)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ni.processBlocks(newlyr); err != nil {
+		return err
+	}
 
 	if newlyr.Index() == Genesis {
 		ni.handleGenesis(newlyr)
-		return
+		return nil
 	}
 
 	l := ni.findMinimalNewlyGoodLayer(newlyr)
@@ -436,10 +1343,10 @@ func (ni *ninjaTortoise) handleIncomingLayer(newlyr *mesh.Layer) { //i most rece
 
 			//find bottom of window
 			var windowStart mesh.LayerID
-			if Window > newlyr.Index() {
+			if ni.cfg.Window > newlyr.Index() {
 				windowStart = 0
 			} else {
-				windowStart = newlyr.Index() - Window + 1
+				windowStart = newlyr.Index() - ni.cfg.Window + 1
 			}
 
 			view := make(map[mesh.BlockID]struct{})
@@ -450,8 +1357,8 @@ func (ni *ninjaTortoise) handleIncomingLayer(newlyr *mesh.Layer) { //i most rece
 				for _, id := range block.BlockVotes {
 					view[id] = struct{}{}
 				}
-				lCntr[block.Layer()]++ //amount of blocks for each layer in view
-				getCrrEffCnt(block)    //calc correction and eff count
+				lCntr[block.Layer()] += ni.voteWeight(block) //weight of the blocks for each layer in view
+				getCrrEffCnt(block)                          //calc correction and eff count
 			}
 
 			forBlockInView(ni.tPattern[p], ni.blocks, ni.pBase.Layer()+1, foo)
@@ -481,7 +1388,7 @@ func (ni *ninjaTortoise) handleIncomingLayer(newlyr *mesh.Layer) { //i most rece
 						ni.tVote[p] = make(map[mesh.BlockID]vec)
 					}
 
-					if vote := globalOpinion(ni.tTally[p][bid], ni.avgLayerSize, float64(p.LayerID-idx)); vote != Abstain {
+					if vote := globalOpinion(ni.tTally[p][bid], ni.globalThreshold(p, idx)); vote != Abstain {
 						ni.tVote[p][bid] = vote
 						if vote == Support {
 							bids = append(bids, bid)
@@ -505,6 +1412,10 @@ func (ni *ninjaTortoise) handleIncomingLayer(newlyr *mesh.Layer) { //i most rece
 			}
 		}
 	}
+	ni.checkStaleness(newlyr.Index())
+	ni.metrics.layerDuration.Observe(time.Since(start).Seconds())
+	ni.metrics.completePatterns.Set(float64(len(ni.tComplete)))
+	ni.metrics.blocksAgainst.Add(float64(ni.countAgainst(prevBase)))
 	ni.Info("finished layer %d pbase is %d", newlyr.Index(), ni.pBase.Layer())
-	return
+	return nil
 }
@@ -1,12 +1,17 @@
 package consensus
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"github.com/spacemeshos/go-spacemesh/crypto"
 	"github.com/spacemeshos/go-spacemesh/log"
 	"github.com/spacemeshos/go-spacemesh/mesh"
 	"github.com/stretchr/testify/assert"
 	"math"
 	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -39,17 +44,17 @@ func TestVec_Multiply(t *testing.T) {
 }
 
 func TestNinjaTortoise_GlobalOpinion(t *testing.T) {
-	glo := globalOpinion(vec{2, 0}, 2, 1)
+	glo := globalOpinion(vec{2, 0}, GlobalThreshold*2)
 	assert.True(t, glo == Support, "vec was wrong %d", glo)
-	glo = globalOpinion(vec{1, 0}, 2, 1)
+	glo = globalOpinion(vec{1, 0}, GlobalThreshold*2)
 	assert.True(t, glo == Abstain, "vec was wrong %d", glo)
-	glo = globalOpinion(vec{0, 2}, 2, 1)
+	glo = globalOpinion(vec{0, 2}, GlobalThreshold*2)
 	assert.True(t, glo == Against, "vec was wrong %d", glo)
 }
 
 func TestForEachInView(t *testing.T) {
 	blocks := make(map[mesh.BlockID]*mesh.Block)
-	alg := NewNinjaTortoise(2, log.New("TestForEachInView", "", ""))
+	alg := NewNinjaTortoise(2, DefaultTortoiseConfig(), log.New("TestForEachInView", "", ""))
 	l := GenesisLayer()
 	for _, b := range l.Blocks() {
 		blocks[b.ID()] = b
@@ -93,7 +98,7 @@ func TestNinjaTortoise_UpdatePatternTally(t *testing.T) {
 func TestNinjaTortoise_Sanity1(t *testing.T) {
 	layerSize := 30
 	patternSize := layerSize
-	alg := NewNinjaTortoise(uint32(layerSize), log.New("TestNinjaTortoise_Sanity1", "", ""))
+	alg := NewNinjaTortoise(uint32(layerSize), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_Sanity1", "", ""))
 	l1 := GenesisLayer()
 	genesisId := l1.Blocks()[0].ID()
 	alg.handleIncomingLayer(l1)
@@ -116,7 +121,7 @@ func TestNinjaTortoise_Sanity1(t *testing.T) {
 //vote explicitly for two previous layers
 //correction vectors compensate for double count
 func TestNinjaTortoise_Sanity2(t *testing.T) {
-	alg := NewNinjaTortoise(uint32(3), log.New("TestNinjaTortoise_Sanity2", "", ""))
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_Sanity2", "", ""))
 	l := createMulExplicitLayer(0, map[mesh.LayerID]*mesh.Layer{}, nil, 1)
 	l1 := createMulExplicitLayer(1, map[mesh.LayerID]*mesh.Layer{l.Index(): l}, map[mesh.LayerID][]int{0: {0}}, 3)
 	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l1.Index(): l1}, map[mesh.LayerID][]int{1: {0, 1, 2}}, 3)
@@ -203,3 +208,1057 @@ func chooseRandomPattern(blocksInLayer int, patternSize int) []int {
 	}
 	return indexes
 }
+
+func TestNinjaTortoise_AddBatchBlocks(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_AddBatchBlocks", "", ""))
+	l := GenesisLayer()
+	_, err := alg.AddBatchBlocks(l.Index(), l.Blocks())
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		lyr := createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+		pBase, err := alg.AddBatchBlocks(lyr.Index(), lyr.Blocks())
+		assert.NoError(t, err)
+		assert.Equal(t, alg.latestComplete(), pBase)
+		l = lyr
+	}
+	assert.Equal(t, mesh.LayerID(4), alg.latestComplete())
+
+	wrong := createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+	_, err = alg.AddBatchBlocks(l.Index()+2, wrong.Blocks())
+	assert.Error(t, err)
+}
+
+func TestNinjaTortoise_ProcessBlockUnknownVote(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_ProcessBlockUnknownVote", "", ""))
+	l0 := GenesisLayer()
+	_, err := alg.AddBatchBlocks(l0.Index(), l0.Blocks())
+	assert.NoError(t, err)
+
+	b := mesh.NewBlock(true, nil, time.Now(), 1)
+	b.AddVote(l0.Blocks()[0].ID())
+	b.AddVote(mesh.BlockID(math.MaxUint32))
+	b.AddView(l0.Blocks()[0].ID())
+	assert.Error(t, alg.processBlock(b))
+	_, found := alg.tEffective[b.ID()]
+	assert.False(t, found)
+
+	pBase, err := alg.AddBatchBlocks(1, []*mesh.Block{b})
+	assert.Error(t, err)
+	assert.Equal(t, mesh.LayerID(0), pBase)
+	assert.False(t, alg.InLayer(b.ID(), 1))
+
+	// a valid block before the failing one isn't processed either
+	valid := mesh.NewBlock(true, nil, time.Now(), 1)
+	valid.AddVote(l0.Blocks()[0].ID())
+	valid.AddView(l0.Blocks()[0].ID())
+	assert.Error(t, alg.handleIncomingLayer(mesh.NewExistingLayer(1, []*mesh.Block{valid, b})))
+	_, found = alg.blocks[valid.ID()]
+	assert.False(t, found)
+	_, found = alg.tEffective[valid.ID()]
+	assert.False(t, found)
+	assert.False(t, alg.InLayer(valid.ID(), 1))
+	assert.NoError(t, alg.handleIncomingLayer(mesh.NewExistingLayer(1, []*mesh.Block{valid})))
+	assert.True(t, alg.InLayer(valid.ID(), 1))
+}
+
+func createBenchmarkLayers(layers int, layerSize int) []*mesh.Layer {
+	l := GenesisLayer()
+	lyrs := []*mesh.Layer{l}
+	for i := 0; i < layers; i++ {
+		l = createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, layerSize, layerSize)
+		lyrs = append(lyrs, l)
+	}
+	return lyrs
+}
+
+func BenchmarkNinjaTortoise_AddBlocksOneByOne(b *testing.B) {
+	lyrs := createBenchmarkLayers(3, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		alg := NewNinjaTortoise(uint32(100), DefaultTortoiseConfig(), log.New("BenchmarkNinjaTortoise_AddBlocksOneByOne", "", ""))
+		for _, l := range lyrs {
+			for _, bl := range l.Blocks() {
+				alg.handleIncomingLayer(mesh.NewExistingLayer(l.Index(), []*mesh.Block{bl}))
+			}
+		}
+	}
+}
+
+func BenchmarkNinjaTortoise_AddBatchBlocks(b *testing.B) {
+	lyrs := createBenchmarkLayers(3, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		alg := NewNinjaTortoise(uint32(100), DefaultTortoiseConfig(), log.New("BenchmarkNinjaTortoise_AddBatchBlocks", "", ""))
+		for _, l := range lyrs {
+			alg.AddBatchBlocks(l.Index(), l.Blocks())
+		}
+	}
+}
+
+func TestNinjaTortoise_SupportAgainstRatio(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SupportAgainstRatio", "", ""))
+	b1 := mesh.NewExistingBlock(1, 1, nil)
+	b2 := mesh.NewExistingBlock(2, 3, nil)
+	alg.blocks[b1.ID()] = b1
+	alg.blocks[b2.ID()] = b2
+	p := votingPattern{id: 7, LayerID: 3}
+	alg.tTally[p] = map[mesh.BlockID]vec{b1.ID(): {9, 3}}
+
+	// threshold is 0.6 * (3-1) * 10 = 12
+	r, err := alg.SupportRatio(p, b1.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, 0.75, r)
+	r, err = alg.AgainstRatio(p, b1.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, 0.25, r)
+
+	_, err = alg.SupportRatio(votingPattern{id: 8, LayerID: 3}, b1.ID())
+	assert.Error(t, err)
+	_, err = alg.SupportRatio(p, mesh.BlockID(3))
+	assert.Error(t, err)
+	_, err = alg.AgainstRatio(p, b2.ID())
+	assert.Error(t, err)
+}
+
+func TestNinjaTortoise_SetGenesisBlock(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SetGenesisBlock", "", ""))
+	assert.Error(t, alg.SetGenesisBlock(mesh.NewExistingBlock(1, 1, nil)))
+	gen := GenesisLayer()
+	assert.NoError(t, alg.SetGenesisBlock(gen.Blocks()[0]))
+	assert.Error(t, alg.SetGenesisBlock(gen.Blocks()[0]))
+	assert.Equal(t, votingPattern{id: getId([]mesh.BlockID{gen.Blocks()[0].ID()}), LayerID: Genesis}, alg.pBase)
+
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{gen}, 3, 1)
+	alg.handleIncomingLayer(l1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	alg.handleIncomingLayer(l2)
+	assert.Equal(t, mesh.LayerID(1), alg.latestComplete())
+}
+
+func TestNinjaTortoise_AdaptiveLayerSize(t *testing.T) {
+	run := func(adaptive bool) *ninjaTortoise {
+		alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_AdaptiveLayerSize", "", ""))
+		alg.SetAdaptiveLayerSize(adaptive)
+		l := GenesisLayer()
+		alg.handleIncomingLayer(l)
+		for i := 0; i < 5; i++ {
+			lyr := createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+			alg.handleIncomingLayer(lyr)
+			l = lyr
+		}
+		return alg
+	}
+
+	// only 3 of the expected 10 blocks per layer, consensus stalls
+	alg := run(false)
+	assert.Equal(t, mesh.LayerID(0), alg.latestComplete())
+	assert.Equal(t, uint32(10), alg.estimateLayerSize(1))
+
+	alg = run(true)
+	assert.Equal(t, mesh.LayerID(4), alg.latestComplete())
+	assert.Equal(t, uint32(2), alg.estimateLayerSize(1)) // (1+3+3+3+3)/5
+}
+
+func TestNinjaTortoise_EquivocationDetector(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_EquivocationDetector", "", ""))
+	alg.SetEquivocationDetector(func(b1, b2 *mesh.Block) bool {
+		return b1.MinerID == b2.MinerID && b1.Layer() == b2.Layer()
+	})
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l}, 3, 1)
+	l1.Blocks()[0].MinerID = "honest1"
+	l1.Blocks()[1].MinerID = "honest2"
+	l1.Blocks()[2].MinerID = "honest3"
+	alg.handleIncomingLayer(l1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	l2.Blocks()[0].MinerID = "honest1"
+	l2.Blocks()[1].MinerID = "malicious"
+	l2.Blocks()[2].MinerID = "malicious"
+	alg.handleIncomingLayer(l2)
+
+	assert.True(t, alg.IsEquivocating("malicious"))
+	assert.False(t, alg.IsEquivocating("honest1"))
+	assert.False(t, alg.IsEquivocating("honest2"))
+}
+
+func TestNinjaTortoise_SetCorrectnessAuditHook(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SetCorrectnessAuditHook", "", ""))
+	var sum vec
+	calls := 0
+	alg.SetCorrectnessAuditHook(func(blockID mesh.BlockID, pattern votingPattern, correction *vec) {
+		_, found := alg.tCorrect[blockID]
+		assert.True(t, found)
+		sum = sum.Add(*correction)
+		calls++
+	})
+
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	for i := 1; i <= 10; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 10, 7)
+		alg.handleIncomingLayer(l)
+	}
+
+	var expected vec
+	for _, corrections := range alg.tCorrect {
+		for _, c := range corrections {
+			expected = expected.Add(c)
+		}
+	}
+	assert.True(t, calls > 0)
+	assert.Equal(t, expected, sum)
+}
+
+func TestNinjaTortoise_DumpBlockGraph(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_DumpBlockGraph", "", ""))
+	l0 := GenesisLayer()
+	alg.handleIncomingLayer(l0)
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	alg.handleIncomingLayer(l1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	alg.handleIncomingLayer(l2)
+
+	var buf bytes.Buffer
+	assert.NoError(t, alg.DumpBlockGraph(&buf))
+
+	nodes, edges := 0, 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "->") {
+			edges++
+		} else if strings.Contains(line, "[label=") {
+			nodes++
+		}
+	}
+	assert.Equal(t, 7, nodes)
+	assert.Equal(t, 3*1+3*3, edges)
+}
+
+func TestNinjaTortoise_PatternSupport(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_PatternSupport", "", ""))
+	_, _, found := alg.PatternSupport(1)
+	assert.False(t, found)
+
+	l0 := GenesisLayer()
+	alg.handleIncomingLayer(l0)
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	alg.handleIncomingLayer(l1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	alg.handleIncomingLayer(l2)
+
+	// all blocks of layer 2 vote for all blocks of layer 1
+	count, total, found := alg.PatternSupport(1)
+	assert.True(t, found)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 3, total)
+
+	l3 := createLayerWithRandVoting(3, []*mesh.Layer{l2}, 3, 3)
+	alg.handleIncomingLayer(l3)
+	count, total, found = alg.PatternSupport(2)
+	assert.True(t, found)
+	assert.Equal(t, 1.0, float64(count)/float64(total))
+
+	// layer 1 is below pBase so its support is no longer counted
+	count, total, found = alg.PatternSupport(1)
+	assert.True(t, found)
+	assert.Equal(t, 0.5, float64(count)/float64(total))
+
+	_, _, found = alg.PatternSupport(3)
+	assert.False(t, found)
+}
+
+func TestNinjaTortoise_EffectivePattern(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_EffectivePattern", "", ""))
+	l0 := createMulExplicitLayer(0, map[mesh.LayerID]*mesh.Layer{}, nil, 1)
+	l1 := createMulExplicitLayer(1, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0}, map[mesh.LayerID][]int{0: {0}}, 3)
+	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l1.Index(): l1}, map[mesh.LayerID][]int{1: {0, 2}}, 3)
+	alg.handleIncomingLayer(l0)
+	alg.handleIncomingLayer(l1)
+	alg.handleIncomingLayer(l2)
+
+	_, err := alg.EffectivePattern(mesh.BlockID(math.MaxUint32))
+	assert.Equal(t, ErrBlockNotKnown, err)
+
+	expected := []mesh.BlockID{l1.Blocks()[0].ID(), l1.Blocks()[2].ID()}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	for _, b := range l2.Blocks() {
+		pi, err := alg.EffectivePattern(b.ID())
+		assert.NoError(t, err)
+		assert.Equal(t, mesh.LayerID(1), pi.Layer)
+		assert.Equal(t, expected, pi.Blocks)
+		assert.Equal(t, uint64(getId(expected)), pi.PatternID)
+	}
+
+	pi, err := alg.EffectivePattern(l1.Blocks()[0].ID())
+	assert.NoError(t, err)
+	assert.Equal(t, mesh.LayerID(0), pi.Layer)
+	assert.Equal(t, []mesh.BlockID{l0.Blocks()[0].ID()}, pi.Blocks)
+}
+
+func TestNinjaTortoise_GlobalOpinionMap(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_GlobalOpinionMap", "", ""))
+	l0 := GenesisLayer()
+	alg.handleIncomingLayer(l0)
+	_, err := alg.GlobalOpinionMap()
+	assert.Equal(t, ErrNoBase, err)
+
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	alg.handleIncomingLayer(l1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	alg.handleIncomingLayer(l2)
+	l3 := createLayerWithRandVoting(3, []*mesh.Layer{l2}, 3, 3)
+	alg.handleIncomingLayer(l3)
+
+	opinion, err := alg.GlobalOpinionMap()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(opinion)) // genesis and layer 1
+	support, against := 0, 0
+	for _, v := range opinion {
+		if *v == Support {
+			support++
+		} else if *v == Against {
+			against++
+		}
+	}
+	assert.Equal(t, 4, support)
+	assert.Equal(t, 0, against)
+
+	// the map is a copy
+	*opinion[l0.Blocks()[0].ID()] = Against
+	assert.Equal(t, Support, alg.tVote[alg.pBase][l0.Blocks()[0].ID()])
+}
+
+func TestNinjaTortoise_WithPatternHashFn(t *testing.T) {
+	sum := func(bids []mesh.BlockID) uint64 {
+		var h uint64
+		for _, b := range bids {
+			h = h*31 + uint64(b)
+		}
+		return h
+	}
+	xor := func(bids []mesh.BlockID) uint64 {
+		var h uint64 = 0xcbf29ce484222325
+		for _, b := range bids {
+			h ^= uint64(b)
+			h *= 0x100000001b3
+		}
+		return h
+	}
+	alg1 := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_WithPatternHashFn1", "", ""), WithPatternHashFn(sum))
+	alg2 := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_WithPatternHashFn2", "", ""), WithPatternHashFn(xor))
+
+	bids := []mesh.BlockID{5, 3, 9}
+	assert.NotEqual(t, alg1.getId(bids), alg2.getId(bids))
+	assert.Equal(t, alg1.getId(bids), alg1.getId([]mesh.BlockID{9, 5, 3}))
+	assert.Equal(t, PatternId(sum([]mesh.BlockID{3, 5, 9})), alg1.getId(bids))
+
+	l0 := GenesisLayer()
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	for _, alg := range []*ninjaTortoise{alg1, alg2} {
+		alg.handleIncomingLayer(l0)
+		alg.handleIncomingLayer(l1)
+		alg.handleIncomingLayer(l2)
+	}
+	assert.Equal(t, alg1.pBase.Layer(), alg2.pBase.Layer())
+	assert.NotEqual(t, alg1.pBase.id, alg2.pBase.id)
+}
+
+func TestNinjaTortoise_Reset(t *testing.T) {
+	createLayers := func() []*mesh.Layer {
+		l := GenesisLayer()
+		layers := []*mesh.Layer{l}
+		for i := 1; i < 10; i++ {
+			l = createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+			layers = append(layers, l)
+		}
+		return layers
+	}
+
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_Reset", "", ""))
+	alg.SetAdaptiveLayerSize(true)
+	for _, l := range createLayers() {
+		alg.handleIncomingLayer(l)
+	}
+	assert.Equal(t, mesh.LayerID(8), alg.latestComplete())
+
+	alg.Reset()
+	assert.Equal(t, votingPattern{}, alg.pBase)
+	assert.Empty(t, alg.blocks)
+	assert.Empty(t, alg.tVote)
+	assert.Equal(t, uint32(3), alg.avgLayerSize)
+	assert.True(t, alg.adaptiveLayerSize)
+
+	layers := createLayers()
+	fresh := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_Reset_fresh", "", ""))
+	for _, l := range layers {
+		alg.handleIncomingLayer(l)
+		fresh.handleIncomingLayer(l)
+	}
+	assert.Equal(t, mesh.LayerID(8), alg.latestComplete())
+	assert.Equal(t, fresh.pBase, alg.pBase)
+	assert.Equal(t, fresh.tVote[fresh.pBase], alg.tVote[alg.pBase])
+}
+
+// createRandomLayers deterministically creates a block DAG where every block views all blocks of the previous layer
+// and explicitly votes for a random subset of them
+func createRandomLayers(rng *rand.Rand, layers int, layerSize int) []*mesh.Layer {
+	prev := GenesisLayer()
+	res := []*mesh.Layer{prev}
+	id := mesh.BlockID(prev.Blocks()[0].ID() + 1)
+	for i := 1; i < layers; i++ {
+		l := mesh.NewLayer(mesh.LayerID(i))
+		for j := 0; j < layerSize; j++ {
+			bl := mesh.NewExistingBlock(id, l.Index(), nil)
+			id++
+			prevBlocks := prev.Blocks()
+			votes := 1 + rng.Intn(len(prevBlocks))
+			for _, idx := range rng.Perm(len(prevBlocks))[:votes] {
+				bl.AddVote(prevBlocks[idx].ID())
+			}
+			for _, b := range prevBlocks {
+				bl.AddView(b.ID())
+			}
+			l.AddBlock(bl)
+		}
+		res = append(res, l)
+		prev = l
+	}
+	return res
+}
+
+// TestNinjaTortoiseProperties checks the tortoise invariants on seeded random block DAGs
+func TestNinjaTortoiseProperties(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 30; run++ {
+		layers, layerSize := 2+rng.Intn(29), 1+rng.Intn(10)
+		alg := NewNinjaTortoise(uint32(layerSize), DefaultTortoiseConfig(), log.New("TestNinjaTortoiseProperties", "", ""))
+		var lastBase mesh.LayerID
+		for _, l := range createRandomLayers(rng, layers, layerSize) {
+			alg.handleIncomingLayer(l)
+
+			// pBase only advances
+			if alg.pBase.Layer() < lastBase {
+				t.Fatalf("run %d: pBase went back from layer %d to %d", run, lastBase, alg.pBase.Layer())
+			}
+			lastBase = alg.pBase.Layer()
+
+			// a complete pattern is the good pattern of its layer
+			for p := range alg.tComplete {
+				if alg.tGood[p.Layer()] != p {
+					t.Fatalf("run %d: complete pattern %d of layer %d is not good", run, p.id, p.Layer())
+				}
+			}
+
+			// no tally passes the global threshold both for and against a block
+			for p, tally := range alg.tTally {
+				for b := range tally {
+					support, err := alg.SupportRatio(p, b)
+					if err != nil {
+						continue
+					}
+					against, _ := alg.AgainstRatio(p, b)
+					if support > 1 && against > 1 {
+						t.Fatalf("run %d: pattern %d supports and is against block %d", run, p.id, b)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNinjaTortoise_LayerWindow(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_LayerWindow", "", ""))
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	start, end := alg.LayerWindow()
+	assert.Equal(t, mesh.LayerID(0), start)
+	assert.Equal(t, mesh.LayerID(0), end)
+
+	for i := 0; i < 150; i++ {
+		l = createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+		alg.handleIncomingLayer(l)
+	}
+
+	start, end = alg.LayerWindow()
+	assert.Equal(t, mesh.LayerID(51), start)
+	assert.Equal(t, mesh.LayerID(150), end)
+	assert.False(t, alg.InWindow(50))
+	assert.True(t, alg.InWindow(51))
+	assert.True(t, alg.InWindow(150))
+	assert.False(t, alg.InWindow(151))
+}
+
+func TestNinjaTortoise_TortoiseConfig(t *testing.T) {
+	cfg := DefaultTortoiseConfig()
+	assert.Equal(t, TortoiseConfig{K: K, Window: Window, LocalThreshold: LocalThreshold, GlobalThreshold: GlobalThreshold, LayersPerEpoch: LayersPerEpoch}, cfg)
+
+	for _, window := range []mesh.LayerID{10, 30, Window} {
+		cfg := DefaultTortoiseConfig()
+		cfg.Window = window
+		cfg.K = 2
+		alg := NewNinjaTortoise(uint32(3), cfg, log.New("TestNinjaTortoise_TortoiseConfig", "", ""))
+		l := GenesisLayer()
+		alg.handleIncomingLayer(l)
+		for i := 0; i < 50; i++ {
+			l = createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+			alg.handleIncomingLayer(l)
+		}
+
+		start, end := alg.LayerWindow()
+		assert.Equal(t, mesh.LayerID(50), end)
+		if window > 50 {
+			assert.Equal(t, mesh.LayerID(0), start)
+		} else {
+			assert.Equal(t, 51-window, start)
+		}
+		assert.Equal(t, mesh.LayerID(49), alg.pBase.Layer())
+		assert.True(t, alg.SyncStatus(51).IsSynced)
+		assert.False(t, alg.SyncStatus(52).IsSynced)
+	}
+
+	// no tally can exceed a global threshold above 1 so no layer is ever decided
+	cfg.GlobalThreshold = 1.1
+	alg := NewNinjaTortoise(uint32(3), cfg, log.New("TestNinjaTortoise_TortoiseConfig", "", ""))
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	for i := 0; i < 10; i++ {
+		l = createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+		alg.handleIncomingLayer(l)
+	}
+	assert.Equal(t, mesh.LayerID(Genesis), alg.pBase.Layer())
+}
+
+func TestNinjaTortoise_InLayer(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_InLayer", "", ""))
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	layers := []*mesh.Layer{l}
+	for i := 0; i < 5; i++ {
+		l = createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 3, 3)
+		alg.handleIncomingLayer(l)
+		layers = append(layers, l)
+	}
+
+	for _, l := range layers {
+		for _, b := range l.Blocks() {
+			assert.True(t, alg.InLayer(b.ID(), l.Index()))
+			assert.False(t, alg.InLayer(b.ID(), l.Index()+1))
+		}
+	}
+	assert.False(t, alg.InLayer(mesh.BlockID(math.MaxUint32), 1))
+	assert.False(t, alg.InLayer(layers[1].Blocks()[0].ID(), 10))
+}
+
+func TestNinjaTortoise_WindowedConsistencyCheck(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_WindowedConsistencyCheck", "", ""))
+	assert.Empty(t, alg.WindowedConsistencyCheck())
+
+	l0 := GenesisLayer()
+	alg.handleIncomingLayer(l0)
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 3)
+	alg.handleIncomingLayer(l1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	alg.handleIncomingLayer(l2)
+	assert.Empty(t, alg.WindowedConsistencyCheck())
+
+	// layer 3 is skipped
+	l4 := createLayerWithRandVoting(4, []*mesh.Layer{l2}, 3, 3)
+	alg.handleIncomingLayer(l4)
+	assert.Equal(t, []mesh.LayerID{3}, alg.WindowedConsistencyCheck())
+	l5 := createLayerWithRandVoting(5, []*mesh.Layer{l4}, 3, 3)
+	alg.handleIncomingLayer(l5)
+	assert.Equal(t, []mesh.LayerID{3}, alg.WindowedConsistencyCheck())
+}
+
+func TestNinjaTortoise_VerifyLayerConsistency(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_VerifyLayerConsistency", "", ""))
+	l0 := GenesisLayer()
+	alg.handleIncomingLayer(l0)
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 3)
+	alg.handleIncomingLayer(l1)
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	alg.handleIncomingLayer(l2)
+
+	// valid
+	l3 := createLayerWithRandVoting(3, []*mesh.Layer{l2}, 3, 3)
+	assert.Empty(t, alg.VerifyLayerConsistency(3, l3.Blocks()))
+
+	// forward referencing
+	forward := mesh.NewBlock(false, []byte("forward"), time.Now(), 1)
+	forward.AddView(l0.Blocks()[0].ID())
+	forward.AddView(l2.Blocks()[0].ID())
+	forward.AddView(l2.Blocks()[1].ID())
+	assert.Equal(t, 2, len(alg.VerifyLayerConsistency(1, []*mesh.Block{forward})))
+
+	// same layer referencing
+	b1 := mesh.NewBlock(false, []byte("b1"), time.Now(), 3)
+	b1.AddView(l2.Blocks()[0].ID())
+	b2 := mesh.NewBlock(false, []byte("b2"), time.Now(), 3)
+	b2.AddView(l2.Blocks()[0].ID())
+	b2.AddView(b1.ID())
+	assert.Equal(t, 1, len(alg.VerifyLayerConsistency(3, []*mesh.Block{b1, b2})))
+	b3 := mesh.NewBlock(false, []byte("b3"), time.Now(), 3)
+	b3.AddView(l2.Blocks()[1].ID())
+	b3.AddView(l2.Blocks()[2].ID())
+	assert.Equal(t, 1, len(alg.VerifyLayerConsistency(3, []*mesh.Block{b1, b3, b2})))
+
+	// inconsistent layers are only rejected in strict mode
+	_, err := alg.AddBatchBlocks(3, []*mesh.Block{b1, b3, b2})
+	assert.NoError(t, err)
+	alg.Reset()
+	alg.SetStrictMode(true)
+	alg.handleIncomingLayer(l0)
+	alg.handleIncomingLayer(l1)
+	alg.handleIncomingLayer(l2)
+	_, err = alg.AddBatchBlocks(3, []*mesh.Block{b1, b3, b2})
+	assert.Equal(t, ErrInconsistentLayer, err)
+	assert.False(t, alg.InLayer(b1.ID(), 3))
+	_, err = alg.AddBatchBlocks(3, l3.Blocks())
+	assert.NoError(t, err)
+	assert.True(t, alg.InLayer(l3.Blocks()[0].ID(), 3))
+}
+
+func TestNinjaTortoise_SyncStatus(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SyncStatus", "", ""))
+	alg.pBase = votingPattern{id: 1, LayerID: 50}
+
+	status := alg.SyncStatus(55)
+	assert.Equal(t, SyncStatus{PBaseLayer: 50, LatestKnown: 55, Lag: 5, IsSynced: true}, status)
+
+	status = alg.SyncStatus(60)
+	assert.Equal(t, mesh.LayerID(10), status.Lag)
+	assert.False(t, status.IsSynced)
+
+	status = alg.SyncStatus(40)
+	assert.Equal(t, mesh.LayerID(0), status.Lag)
+	assert.True(t, status.IsSynced)
+}
+
+func TestNinjaTortoise_TallyForBlock(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_TallyForBlock", "", ""))
+	p := votingPattern{id: 7, LayerID: 3}
+	alg.tTally[p] = map[mesh.BlockID]vec{mesh.BlockID(1): {13, 3}}
+
+	v, err := alg.TallyForBlock(p, mesh.BlockID(1))
+	assert.NoError(t, err)
+	assert.Equal(t, vec{13, 3}, *v)
+	_, err = alg.TallyForBlock(p, mesh.BlockID(2))
+	assert.Equal(t, ErrBlockNotInPattern, err)
+	_, err = alg.TallyForBlock(votingPattern{id: 8, LayerID: 3}, mesh.BlockID(1))
+	assert.Equal(t, ErrBlockNotInPattern, err)
+
+	// threshold is 0.6 * (3-2) * 10 = 6
+	assert.Equal(t, 6, alg.TallyThreshold(p))
+	assert.Equal(t, 0, alg.TallyThreshold(votingPattern{id: 9, LayerID: Genesis}))
+	assert.True(t, v[0] > alg.TallyThreshold(p))
+	assert.Equal(t, Support, globalOpinion(*v, float64(alg.TallyThreshold(p))))
+}
+
+func TestNinjaTortoise_BlockVotes(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_BlockVotes", "", ""))
+	l0 := createMulExplicitLayer(0, map[mesh.LayerID]*mesh.Layer{}, nil, 1)
+	l1 := createMulExplicitLayer(1, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0}, map[mesh.LayerID][]int{0: {0}}, 3)
+	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0, l1.Index(): l1}, map[mesh.LayerID][]int{0: {0}, 1: {0, 2}}, 3)
+	alg.handleIncomingLayer(l0)
+	alg.handleIncomingLayer(l1)
+	alg.handleIncomingLayer(l2)
+
+	_, err := alg.BlockVotes(mesh.BlockID(math.MaxUint32), 1)
+	assert.Equal(t, ErrBlockNotKnown, err)
+
+	l1Votes := []mesh.BlockID{l1.Blocks()[0].ID(), l1.Blocks()[2].ID()}
+	for _, b := range l2.Blocks() {
+		vp, err := alg.BlockVotes(b.ID(), 1)
+		assert.NoError(t, err)
+		assert.Equal(t, votingPattern{id: getId(l1Votes), LayerID: 1}, *vp)
+
+		vp, err = alg.BlockVotes(b.ID(), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, votingPattern{id: getId([]mesh.BlockID{l0.Blocks()[0].ID()}), LayerID: 0}, *vp)
+
+		_, err = alg.BlockVotes(b.ID(), 2)
+		assert.Equal(t, ErrNoExplicitVote, err)
+	}
+}
+
+func TestNinjaTortoise_BlocksBelowThreshold(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_BlocksBelowThreshold", "", ""))
+	l0 := createMulExplicitLayer(0, map[mesh.LayerID]*mesh.Layer{}, nil, 1)
+	alg.handleIncomingLayer(l0)
+	l1 := createMulExplicitLayer(1, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0}, map[mesh.LayerID][]int{0: {0}}, 3)
+	alg.handleIncomingLayer(l1)
+	valid, invalid, undecided := alg.BlocksBelowThreshold(1)
+	assert.Empty(t, valid)
+	assert.Empty(t, invalid)
+	assert.Equal(t, 3, len(undecided))
+
+	// all blocks of layer 2 vote against the third block of layer 1
+	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l1.Index(): l1}, map[mesh.LayerID][]int{1: {0, 1}}, 3)
+	alg.handleIncomingLayer(l2)
+	l3 := createMulExplicitLayer(3, map[mesh.LayerID]*mesh.Layer{l2.Index(): l2}, map[mesh.LayerID][]int{2: {0, 1, 2}}, 3)
+	alg.handleIncomingLayer(l3)
+	assert.True(t, alg.pBase.Layer() >= 2)
+
+	ids := func(blocks ...*mesh.Block) []mesh.BlockID {
+		res := make([]mesh.BlockID, 0, len(blocks))
+		for _, b := range blocks {
+			res = append(res, b.ID())
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+		return res
+	}
+	valid, invalid, undecided = alg.BlocksBelowThreshold(1)
+	assert.Equal(t, ids(l1.Blocks()[0], l1.Blocks()[1]), valid)
+	assert.Equal(t, ids(l1.Blocks()[2]), invalid)
+	assert.Empty(t, undecided)
+
+	valid, invalid, undecided = alg.BlocksBelowThreshold(3)
+	assert.Empty(t, valid)
+	assert.Empty(t, invalid)
+	assert.Equal(t, ids(l3.Blocks()...), undecided)
+
+	valid, invalid, undecided = alg.BlocksBelowThreshold(10)
+	assert.Empty(t, valid)
+	assert.Empty(t, invalid)
+	assert.Empty(t, undecided)
+}
+
+func TestNinjaTortoise_SupportingPatterns(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SupportingPatterns", "", ""))
+	target, other := mesh.BlockID(1), mesh.BlockID(2)
+	assert.Empty(t, alg.SupportingPatterns(target))
+
+	supporting := []votingPattern{{id: 3, LayerID: 2}, {id: 1, LayerID: 3}, {id: 2, LayerID: 3}}
+	against := []votingPattern{{id: 4, LayerID: 2}, {id: 5, LayerID: 4}}
+	for _, p := range supporting {
+		alg.tVote[p] = map[mesh.BlockID]vec{target: Support, other: Against}
+	}
+	for _, p := range against {
+		alg.tVote[p] = map[mesh.BlockID]vec{target: Against, other: Support}
+	}
+
+	assert.Equal(t, supporting, alg.SupportingPatterns(target))
+	assert.Equal(t, against, alg.SupportingPatterns(other))
+	assert.Empty(t, alg.SupportingPatterns(mesh.BlockID(3)))
+}
+
+func TestNinjaTortoise_EpochBlocks(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_EpochBlocks", "", ""))
+	layers := []*mesh.Layer{GenesisLayer()}
+	alg.handleIncomingLayer(layers[0])
+	for i := 1; i <= 6; i++ {
+		l := createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{layers[i-1]}, 3, 3)
+		alg.handleIncomingLayer(l)
+		layers = append(layers, l)
+	}
+	assert.Equal(t, mesh.LayerID(5), alg.pBase.Layer())
+
+	layerIds := func(l *mesh.Layer) []mesh.BlockID {
+		ids := make([]mesh.BlockID, 0, len(l.Blocks()))
+		for _, b := range l.Blocks() {
+			ids = append(ids, b.ID())
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+
+	blocks, err := alg.EpochBlocks(0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[mesh.LayerID][]mesh.BlockID{0: layerIds(layers[0]), 1: layerIds(layers[1])}, blocks)
+
+	blocks, err = alg.EpochBlocks(1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[mesh.LayerID][]mesh.BlockID{2: layerIds(layers[2]), 3: layerIds(layers[3])}, blocks)
+
+	// pBase is at layer 5 which is the last layer of epoch 2
+	_, err = alg.EpochBlocks(2, 2)
+	assert.Equal(t, ErrEpochNotFinalized, err)
+	_, err = alg.EpochBlocks(0, 0)
+	assert.Error(t, err)
+}
+
+func TestNinjaTortoise_ConfidenceLevel(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_ConfidenceLevel", "", ""))
+	below := mesh.NewExistingBlock(1, 1, nil)
+	at := mesh.NewExistingBlock(2, 1, nil)
+	above := mesh.NewExistingBlock(3, 1, nil)
+	pending := mesh.NewExistingBlock(4, 3, nil)
+	for _, b := range []*mesh.Block{below, at, above, pending} {
+		alg.blocks[b.ID()] = b
+	}
+	alg.pBase = votingPattern{id: 7, LayerID: 3}
+	// threshold is 0.6 * (3-1) * 10 = 12
+	alg.tTally[alg.pBase] = map[mesh.BlockID]vec{below.ID(): {9, 3}, at.ID(): {12, 0}, above.ID(): {20, 0}, pending.ID(): {1, 0}}
+
+	c, err := alg.ConfidenceLevel(below.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, 0.75, c)
+	c, err = alg.ConfidenceLevel(at.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, c)
+	c, err = alg.ConfidenceLevel(above.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, c)
+
+	_, err = alg.ConfidenceLevel(pending.ID())
+	assert.Equal(t, ErrBlockNotYetVoted, err)
+	_, err = alg.ConfidenceLevel(mesh.BlockID(5))
+	assert.Equal(t, ErrBlockNotYetVoted, err)
+}
+
+func TestNinjaTortoise_IsFinalized(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_IsFinalized", "", ""))
+	l0 := GenesisLayer()
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	// blocks of layer 2 vote only for the first two blocks of layer 1
+	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l1.Index(): l1}, map[mesh.LayerID][]int{1: {0, 1}}, 3)
+	l3 := createLayerWithRandVoting(3, []*mesh.Layer{l2}, 3, 3)
+	for _, l := range []*mesh.Layer{l0, l1, l2, l3} {
+		alg.handleIncomingLayer(l)
+	}
+	assert.Equal(t, mesh.LayerID(2), alg.pBase.Layer())
+
+	confirmed, err := alg.IsFinalized(l1.Blocks()[0].ID())
+	assert.NoError(t, err)
+	assert.True(t, confirmed)
+
+	rejected, err := alg.IsFinalized(l1.Blocks()[2].ID())
+	assert.NoError(t, err)
+	assert.False(t, rejected)
+	assert.Equal(t, Against, alg.tVote[alg.pBase][l1.Blocks()[2].ID()])
+
+	pending, err := alg.IsFinalized(l3.Blocks()[0].ID())
+	assert.NoError(t, err)
+	assert.False(t, pending)
+
+	_, err = alg.IsFinalized(mesh.BlockID(math.MaxUint32))
+	assert.Equal(t, ErrBlockNotKnown, err)
+}
+
+func TestNinjaTortoise_WorkerPoolSize(t *testing.T) {
+	sequential := NewNinjaTortoise(uint32(100), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_WorkerPoolSize", "", ""))
+	concurrent := NewNinjaTortoise(uint32(100), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_WorkerPoolSize", "", ""), WithWorkerPoolSize(4))
+
+	// 1000 blocks voting for random patterns of the previous layer
+	layers := []*mesh.Layer{GenesisLayer()}
+	for i := 1; i <= 10; i++ {
+		layers = append(layers, createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{layers[i-1]}, 100, 80))
+	}
+	for _, l := range layers {
+		sequential.handleIncomingLayer(l)
+		concurrent.handleIncomingLayer(l)
+		assert.Equal(t, sequential.pBase, concurrent.pBase)
+	}
+
+	assert.True(t, sequential.pBase.Layer() > 0)
+	assert.Equal(t, sequential.tTally, concurrent.tTally)
+	assert.Equal(t, sequential.tVote, concurrent.tVote)
+	assert.Equal(t, sequential.tGood, concurrent.tGood)
+}
+
+func TestNinjaTortoise_SetStalenessThreshold(t *testing.T) {
+	type stall struct{ current, pBase mesh.LayerID }
+	var stalls []stall
+	alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SetStalenessThreshold", "", ""),
+		WithStalenessHook(func(currentLayer mesh.LayerID, pBaseLayer mesh.LayerID) {
+			stalls = append(stalls, stall{currentLayer, pBaseLayer})
+		}))
+	alg.SetStalenessThreshold(3)
+
+	// pBase stops advancing once layers have too few blocks to decide on them
+	run := func(layers int) {
+		l := GenesisLayer()
+		alg.handleIncomingLayer(l)
+		for i := 1; i <= layers; i++ {
+			blocks := 10
+			if i >= 5 {
+				blocks = 1
+			}
+			l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, blocks, 10)
+			alg.handleIncomingLayer(l)
+		}
+	}
+
+	run(4)
+	assert.Empty(t, stalls)
+	alg.Reset()
+	run(20)
+	assert.Equal(t, 1, len(stalls))
+
+	// pBase advanced back to genesis after the reset
+	alg.Reset()
+	run(20)
+	assert.Equal(t, 2, len(stalls))
+	for _, s := range stalls {
+		assert.Equal(t, mesh.LayerID(4), s.current-s.pBase)
+	}
+}
+
+func TestNinjaTortoise_TieBreaker(t *testing.T) {
+	// half of layer 2 votes for each block of layer 1, both patterns have equal support above the threshold
+	l0 := GenesisLayer()
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 2, 1)
+	l2 := mesh.NewLayer(2)
+	for i := 0; i < 4; i++ {
+		b := mesh.NewBlock(false, nil, time.Now(), 2)
+		b.AddVote(l1.Blocks()[i%2].ID())
+		l2.AddBlock(b)
+	}
+
+	good := func(opts ...Option) votingPattern {
+		alg := NewNinjaTortoise(uint32(2), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_TieBreaker", "", ""), opts...)
+		alg.handleIncomingLayer(l0)
+		alg.handleIncomingLayer(l1)
+		alg.handleIncomingLayer(l2)
+		assert.Equal(t, alg.tSupport[alg.tExplicit[l2.Blocks()[0].ID()][1]], alg.tSupport[alg.tExplicit[l2.Blocks()[1].ID()][1]])
+		return alg.tGood[1]
+	}
+
+	p1 := votingPattern{id: getId([]mesh.BlockID{l1.Blocks()[0].ID()}), LayerID: 1}
+	p2 := votingPattern{id: getId([]mesh.BlockID{l1.Blocks()[1].ID()}), LayerID: 1}
+	lower, higher := lowerPatternId(p1, p2), p1
+	if lower == p1 {
+		higher = p2
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, lower, good())
+	}
+
+	higherId := WithTieBreaker(func(p1, p2 votingPattern) votingPattern {
+		if lowerPatternId(p1, p2) == p1 {
+			return p2
+		}
+		return p1
+	})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, higher, good(higherId))
+	}
+}
+
+func TestNinjaTortoise_SetEpochWeightFn(t *testing.T) {
+	cfg := DefaultTortoiseConfig()
+	cfg.LayersPerEpoch = 2
+	alg := NewNinjaTortoise(uint32(3), cfg, log.New("TestNinjaTortoise_SetEpochWeightFn", "", ""))
+	stakes := map[uint32]uint64{0: 2, 1: 3}
+	epochs := make(map[mesh.BlockID]uint32)
+	alg.SetEpochWeightFn(func(blockID mesh.BlockID, epoch uint32) uint64 {
+		epochs[blockID] = epoch
+		return stakes[epoch]
+	})
+
+	l0 := createMulExplicitLayer(0, map[mesh.LayerID]*mesh.Layer{}, nil, 1)
+	l1 := createMulExplicitLayer(1, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0}, map[mesh.LayerID][]int{0: {0}}, 3)
+	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0, l1.Index(): l1}, map[mesh.LayerID][]int{0: {0}, 1: {0, 2}}, 3)
+	view := make(map[mesh.BlockID]struct{})
+	for _, l := range []*mesh.Layer{l0, l1, l2} {
+		alg.processBlocks(l)
+		for _, b := range l.Blocks() {
+			view[b.ID()] = struct{}{}
+		}
+	}
+
+	p := votingPattern{id: 1, LayerID: 2}
+	alg.tTally[p] = make(map[mesh.BlockID]vec)
+	addPatternVote := alg.addPatternVote(p, view)
+	for _, b := range append(l1.Blocks(), l2.Blocks()...) {
+		addPatternVote(b.ID())
+	}
+
+	for _, b := range l1.Blocks() {
+		assert.Equal(t, uint32(0), epochs[b.ID()])
+	}
+	for _, b := range l2.Blocks() {
+		assert.Equal(t, uint32(1), epochs[b.ID()])
+	}
+	// 3 blocks of epoch 0 with stake 2 and 3 blocks of epoch 1 with stake 3
+	assert.Equal(t, vec{3*2 + 3*3, 0}, alg.tTally[p][l0.Blocks()[0].ID()])
+	assert.Equal(t, vec{3 * 3, 0}, alg.tTally[p][l1.Blocks()[0].ID()])
+	assert.Equal(t, vec{0, 3 * 3}, alg.tTally[p][l1.Blocks()[1].ID()])
+	assert.Equal(t, vec{3 * 3, 0}, alg.tTally[p][l1.Blocks()[2].ID()])
+}
+
+func TestNinjaTortoise_EpochWeightUnits(t *testing.T) {
+	cfg := DefaultTortoiseConfig()
+	cfg.LayersPerEpoch = 3
+	unweighted := NewNinjaTortoise(uint32(4), cfg, log.New("TestNinjaTortoise_EpochWeightUnits", "", ""))
+	weighted := NewNinjaTortoise(uint32(4), cfg, log.New("TestNinjaTortoise_EpochWeightUnits", "", ""))
+	weighted.SetEpochWeightFn(func(blockID mesh.BlockID, epoch uint32) uint64 {
+		return 7
+	})
+
+	// a uniform weight scales the support, the tallies and their thresholds alike
+	l := GenesisLayer()
+	for i := 0; i < 10; i++ {
+		unweighted.handleIncomingLayer(l)
+		weighted.handleIncomingLayer(l)
+		assert.Equal(t, unweighted.pBase, weighted.pBase)
+		for p, s := range unweighted.tSupport {
+			assert.Equal(t, 7*s, weighted.tSupport[p])
+		}
+		for b, v := range unweighted.tTally[unweighted.pBase] {
+			assert.Equal(t, v.Multiply(7), weighted.tTally[weighted.pBase][b])
+		}
+		l = createLayerWithRandVoting(l.Index()+1, []*mesh.Layer{l}, 4, 4)
+	}
+	assert.Equal(t, mesh.LayerID(8), weighted.pBase.Layer())
+
+	weighted.SetEpochWeightFn(func(blockID mesh.BlockID, epoch uint32) uint64 {
+		return math.MaxUint64
+	})
+	assert.Equal(t, math.MaxInt32, weighted.voteWeight(l.Blocks()[0]))
+	assert.Equal(t, 4*math.MaxInt32, weighted.layerWeight[1])
+}
+
+func TestNinjaTortoise_ContextualValidity(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_ContextualValidity", "", ""))
+	l0 := createMulExplicitLayer(0, map[mesh.LayerID]*mesh.Layer{}, nil, 1)
+	l1 := createMulExplicitLayer(1, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0}, map[mesh.LayerID][]int{0: {0}}, 3)
+	l2 := createMulExplicitLayer(2, map[mesh.LayerID]*mesh.Layer{l0.Index(): l0, l1.Index(): l1}, map[mesh.LayerID][]int{0: {0}, 1: {0, 2}}, 3)
+	l3 := createMulExplicitLayer(3, map[mesh.LayerID]*mesh.Layer{l1.Index(): l1, l2.Index(): l2}, map[mesh.LayerID][]int{1: {0, 2}, 2: {0, 1, 2}}, 3)
+	for _, l := range []*mesh.Layer{l0, l1, l2, l3} {
+		alg.handleIncomingLayer(l)
+	}
+	assert.Equal(t, mesh.LayerID(2), alg.pBase.Layer())
+
+	valid, err := alg.ContextualValidity(l1.Blocks()[0].ID())
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	valid, err = alg.ContextualValidity(l1.Blocks()[1].ID())
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// not in the view of pBase
+	_, err = alg.ContextualValidity(l3.Blocks()[0].ID())
+	assert.Equal(t, ErrUndecided, err)
+	_, err = alg.ContextualValidity(mesh.BlockID(math.MaxUint32))
+	assert.Equal(t, ErrUndecided, err)
+
+	alg.tVote[alg.pBase][l1.Blocks()[1].ID()] = Abstain
+	_, err = alg.ContextualValidity(l1.Blocks()[1].ID())
+	assert.Equal(t, ErrUndecided, err)
+}
+
+func TestNinjaTortoise_PatternIdCollisions(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	patterns := make(map[string]struct{})
+	ids := make(map[PatternId][]mesh.BlockID)
+	for len(patterns) < 10000 {
+		bids := make([]mesh.BlockID, 1+rng.Intn(10))
+		for i := range bids {
+			bids[i] = mesh.BlockID(rng.Uint32())
+		}
+		id := getId(bids)
+		key := fmt.Sprint(bids)
+		if _, found := patterns[key]; found {
+			continue
+		}
+		patterns[key] = struct{}{}
+		if other, found := ids[id]; found {
+			t.Fatalf("patterns %v and %v have the same id %d", other, bids, id)
+		}
+		ids[id] = bids
+	}
+}
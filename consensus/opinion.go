@@ -0,0 +1,75 @@
+package consensus
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/davecgh/go-xdr/xdr2"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"sort"
+)
+
+// BlockOpinionDiff holds the local and remote votes for a block the two opinions disagree on.
+// a nil vote means the side has no opinion on the block
+type BlockOpinionDiff struct {
+	BlockID    mesh.BlockID
+	LocalVote  *vec
+	RemoteVote *vec
+}
+
+// OpinionDiff compares the opinion of the current pBase with other and returns the blocks voted differently
+func (ni *ninjaTortoise) OpinionDiff(other map[mesh.BlockID]*vec) []BlockOpinionDiff {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	local := ni.tVote[ni.pBase]
+	diffs := make([]BlockOpinionDiff, 0)
+	for id, v := range local {
+		lv := v
+		rv, found := other[id]
+		if !found || rv == nil || *rv != lv {
+			diffs = append(diffs, BlockOpinionDiff{BlockID: id, LocalVote: &lv, RemoteVote: rv})
+		}
+	}
+
+	for id, rv := range other {
+		if _, found := local[id]; !found && rv != nil {
+			diffs = append(diffs, BlockOpinionDiff{BlockID: id, LocalVote: nil, RemoteVote: rv})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].BlockID < diffs[j].BlockID })
+	return diffs
+}
+
+// SerializeOpinion encodes the opinion of the current pBase for wire exchange
+func (ni *ninjaTortoise) SerializeOpinion() ([]byte, error) {
+	ni.mutex.Lock()
+	opinion := make(map[mesh.BlockID]vec, len(ni.tVote[ni.pBase]))
+	for id, v := range ni.tVote[ni.pBase] {
+		opinion[id] = v
+	}
+	ni.mutex.Unlock()
+
+	var w bytes.Buffer
+	if _, err := xdr.Marshal(&w, &opinion); err != nil {
+		return nil, fmt.Errorf("error marshalling opinion %v", err)
+	}
+	return w.Bytes(), nil
+}
+
+// DeserializeOpinion decodes an opinion encoded by SerializeOpinion, returns nil if buf is malformed
+func DeserializeOpinion(buf []byte) map[mesh.BlockID]*vec {
+	var opinion map[mesh.BlockID]vec
+	if _, err := xdr.Unmarshal(bytes.NewReader(buf), &opinion); err != nil {
+		log.Error("error unmarshalling opinion %v", err)
+		return nil
+	}
+
+	res := make(map[mesh.BlockID]*vec, len(opinion))
+	for id, v := range opinion {
+		vote := v
+		res[id] = &vote
+	}
+	return res
+}
@@ -0,0 +1,37 @@
+package consensus
+
+import (
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNinjaTortoise_OpinionDiff(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(10), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_OpinionDiff", "", ""))
+	alg.tVote[alg.pBase] = make(map[mesh.BlockID]vec)
+	remote := make(map[mesh.BlockID]*vec)
+	for i := 0; i < 10; i++ {
+		alg.tVote[alg.pBase][mesh.BlockID(i)] = Support
+		v := Support
+		if i%3 == 0 && i > 0 { // 3, 6, 9 differ
+			v = Against
+		}
+		remote[mesh.BlockID(i)] = &v
+	}
+
+	diffs := alg.OpinionDiff(remote)
+	assert.Equal(t, 3, len(diffs))
+	for i, d := range diffs {
+		assert.Equal(t, mesh.BlockID(3*(i+1)), d.BlockID)
+		assert.Equal(t, Support, *d.LocalVote)
+		assert.Equal(t, Against, *d.RemoteVote)
+	}
+
+	buf, err := alg.SerializeOpinion()
+	assert.NoError(t, err)
+	opinion := DeserializeOpinion(buf)
+	assert.Equal(t, 10, len(opinion))
+	assert.Equal(t, 0, len(alg.OpinionDiff(opinion)))
+	assert.Nil(t, DeserializeOpinion([]byte{1, 2}))
+}
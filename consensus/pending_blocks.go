@@ -0,0 +1,84 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"sort"
+	"time"
+)
+
+// DefaultFlushTimeout is the time SubmitBlock waits for the rest of the blocks of a layer before processing it
+const DefaultFlushTimeout = 5 * time.Second
+
+// ErrLayerProcessed is returned when submitting a block to a layer up to the latest layer the tortoise processed
+var ErrLayerProcessed = errors.New("layer already processed")
+
+// SetFlushTimeout sets the time to wait for the blocks of a layer after its first block was submitted,
+// applies to layers whose first block is submitted after the call
+func (ni *ninjaTortoise) SetFlushTimeout(d time.Duration) {
+	ni.mutex.Lock()
+	ni.flushTimeout = d
+	ni.mutex.Unlock()
+}
+
+// SubmitBlock buffers b until all the expected blocks of its layer were submitted or the flush timeout passed since
+// the first of them, then processes the layer. pending layers below it are processed first. if the layer is processed
+// by this call the error of processing it is returned
+func (ni *ninjaTortoise) SubmitBlock(b *mesh.Block) error {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	layer := b.Layer()
+	if len(ni.layerBlocks) > 0 && layer <= ni.latest {
+		return ErrLayerProcessed
+	}
+
+	if _, found := ni.flushTimers[layer]; !found {
+		var t *time.Timer
+		t = time.AfterFunc(ni.flushTimeout, func() {
+			ni.mutex.Lock()
+			defer ni.mutex.Unlock()
+			if ni.flushTimers[layer] == t { // not flushed yet
+				ni.Info("flush timeout for layer %d with %d blocks", layer, len(ni.pendingBlocks[layer]))
+				if err := ni.flushPending(layer); err != nil {
+					ni.Error("%v", err)
+				}
+			}
+		})
+		ni.flushTimers[layer] = t
+	}
+	ni.pendingBlocks[layer] = append(ni.pendingBlocks[layer], b)
+
+	expected := int(ni.avgLayerSize)
+	if layer == Genesis {
+		expected = 1
+	}
+	if len(ni.pendingBlocks[layer]) >= expected {
+		return ni.flushPending(layer)
+	}
+	return nil
+}
+
+// flushPending processes the pending blocks of all layers up to layer in order, must be called under mutex.
+// it stops at the first layer that fails to process, the layers after it stay pending
+func (ni *ninjaTortoise) flushPending(layer mesh.LayerID) error {
+	layers := make([]mesh.LayerID, 0, len(ni.pendingBlocks))
+	for l := range ni.pendingBlocks {
+		if l <= layer {
+			layers = append(layers, l)
+		}
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i] < layers[j] })
+
+	for _, l := range layers {
+		ni.flushTimers[l].Stop()
+		delete(ni.flushTimers, l)
+		blocks := ni.pendingBlocks[l]
+		delete(ni.pendingBlocks, l)
+		if err := ni.updateTables(mesh.NewExistingLayer(l, blocks)); err != nil {
+			return fmt.Errorf("failed to process pending layer %d: %v", l, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package consensus
+
+import (
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func processedBlocks(ni *ninjaTortoise, layer mesh.LayerID) int {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	return len(ni.layerBlocks[layer])
+}
+
+func TestNinjaTortoise_SubmitBlock(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SubmitBlock", "", ""))
+	l0 := GenesisLayer()
+	assert.NoError(t, alg.SubmitBlock(l0.Blocks()[0]))
+	assert.Equal(t, 1, processedBlocks(alg, 0))
+
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	assert.NoError(t, alg.SubmitBlock(l1.Blocks()[0]))
+	assert.NoError(t, alg.SubmitBlock(l1.Blocks()[1]))
+	assert.Equal(t, 0, processedBlocks(alg, 1))
+	assert.NoError(t, alg.SubmitBlock(l1.Blocks()[2]))
+	assert.Equal(t, 3, processedBlocks(alg, 1))
+	assert.Equal(t, ErrLayerProcessed, alg.SubmitBlock(l1.Blocks()[0]))
+
+	// a full layer flushes the pending layers before it
+	l2 := createLayerWithRandVoting(2, []*mesh.Layer{l1}, 3, 3)
+	l2 = mesh.NewExistingLayer(2, l2.Blocks()[:2])
+	l3 := createLayerWithRandVoting(3, []*mesh.Layer{l2}, 3, 2)
+	for _, b := range l2.Blocks() {
+		assert.NoError(t, alg.SubmitBlock(b))
+	}
+	for _, b := range l3.Blocks() {
+		assert.NoError(t, alg.SubmitBlock(b))
+	}
+	assert.Equal(t, 2, processedBlocks(alg, 2))
+	assert.Equal(t, 3, processedBlocks(alg, 3))
+
+	// a layer skipped by a flush is closed too
+	l5 := createLayerWithRandVoting(5, []*mesh.Layer{l3}, 3, 3)
+	for _, b := range l5.Blocks() {
+		assert.NoError(t, alg.SubmitBlock(b))
+	}
+	assert.Equal(t, 3, processedBlocks(alg, 5))
+	l4 := createLayerWithRandVoting(4, []*mesh.Layer{l3}, 3, 3)
+	assert.Equal(t, ErrLayerProcessed, alg.SubmitBlock(l4.Blocks()[0]))
+}
+
+func TestNinjaTortoise_SubmitBlockFlushError(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SubmitBlockFlushError", "", ""))
+	l0 := GenesisLayer()
+	assert.NoError(t, alg.SubmitBlock(l0.Blocks()[0]))
+
+	// a block voting for an unknown block fails the layer when it is flushed
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	l1.Blocks()[2].BlockVotes = append(l1.Blocks()[2].BlockVotes, mesh.BlockID(123456))
+	assert.NoError(t, alg.SubmitBlock(l1.Blocks()[0]))
+	assert.NoError(t, alg.SubmitBlock(l1.Blocks()[1]))
+	assert.Error(t, alg.SubmitBlock(l1.Blocks()[2]))
+	assert.Equal(t, 0, processedBlocks(alg, 1))
+}
+
+func TestNinjaTortoise_SetFlushTimeout(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(3), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SetFlushTimeout", "", ""))
+	alg.SetFlushTimeout(20 * time.Millisecond)
+	l0 := GenesisLayer()
+	assert.NoError(t, alg.SubmitBlock(l0.Blocks()[0]))
+
+	l1 := createLayerWithRandVoting(1, []*mesh.Layer{l0}, 3, 1)
+	assert.NoError(t, alg.SubmitBlock(l1.Blocks()[0]))
+	assert.NoError(t, alg.SubmitBlock(l1.Blocks()[1]))
+	assert.Equal(t, 0, processedBlocks(alg, 1))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, processedBlocks(alg, 1))
+	assert.Equal(t, ErrLayerProcessed, alg.SubmitBlock(l1.Blocks()[2]))
+}
@@ -0,0 +1,276 @@
+package consensus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/davecgh/go-xdr/xdr2"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+)
+
+// KVStore is the key-value store the state of the tortoise is saved to
+type KVStore interface {
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+}
+
+// ErrPatternHashMismatch is returned when loading a state saved by a tortoise with a different pattern hash
+var ErrPatternHashMismatch = errors.New("saved tortoise state uses a different pattern hash")
+
+// patternHashProbe returns the block ids hashed to check the pattern hash of a saved state
+func patternHashProbe() []mesh.BlockID {
+	return []mesh.BlockID{1, 2, 3}
+}
+
+// stateKey is the key the state of the tortoise is saved under, the state is written with a single Put
+// so a failed save never leaves tables of different saves in the store
+var stateKey = []byte("ninja_tortoise/state")
+
+// patternRecord is the encodable form of a votingPattern
+type patternRecord struct {
+	ID    PatternId
+	Layer mesh.LayerID
+}
+
+func newPatternRecord(p votingPattern) patternRecord {
+	return patternRecord{ID: p.id, Layer: p.Layer()}
+}
+
+func (r patternRecord) pattern() votingPattern {
+	return votingPattern{id: r.ID, LayerID: r.Layer}
+}
+
+type blockPattern struct {
+	Block   mesh.BlockID
+	Pattern patternRecord
+}
+
+type patternCount struct {
+	Pattern patternRecord
+	Count   int
+}
+
+type patternBlocks struct {
+	Pattern patternRecord
+	Blocks  []mesh.BlockID
+}
+
+type patternVotes struct {
+	Pattern patternRecord
+	Votes   map[mesh.BlockID]vec
+}
+
+// patternLayers holds the supported pattern id of each layer, the layer of a supported pattern is the one it's keyed by
+type patternLayers struct {
+	Pattern patternRecord
+	Layers  map[mesh.LayerID]PatternId
+}
+
+// tortoiseState is the encodable form of the configuration and tables of the tortoise.
+// maps keyed by patterns are stored as slices, patterns keyed by their own layer are stored as ids
+type tortoiseState struct {
+	LayerSize          uint32
+	Config             TortoiseConfig
+	PatternHash        PatternId // the pattern id of patternHashProbe
+	PBase              patternRecord
+	Blocks             []mesh.Block
+	Effective          []blockPattern
+	Correct            map[mesh.BlockID]map[mesh.BlockID]vec
+	Explicit           map[mesh.BlockID]map[mesh.LayerID]PatternId
+	LayerBlocks        map[mesh.LayerID][]mesh.BlockID
+	Good               map[mesh.LayerID]PatternId
+	Support            []patternCount
+	Complete           []patternRecord
+	EffectiveToBlocks  []patternBlocks
+	Votes              []patternVotes
+	Tallies            []patternVotes
+	Patterns           []patternBlocks
+	PatSupport         []patternLayers
+	EquivocatingMiners []string
+}
+
+func patternVotesOf(table map[votingPattern]map[mesh.BlockID]vec) []patternVotes {
+	res := make([]patternVotes, 0, len(table))
+	for p, votes := range table {
+		res = append(res, patternVotes{newPatternRecord(p), votes})
+	}
+	return res
+}
+
+// state returns the encodable state of the tortoise, the tables are shared and not copied
+func (ni *ninjaTortoise) state() *tortoiseState {
+	st := &tortoiseState{
+		LayerSize:          ni.avgLayerSize,
+		Config:             ni.cfg,
+		PatternHash:        ni.getId(patternHashProbe()),
+		PBase:              newPatternRecord(ni.pBase),
+		Blocks:             make([]mesh.Block, 0, len(ni.blocks)),
+		Effective:          make([]blockPattern, 0, len(ni.tEffective)),
+		Correct:            ni.tCorrect,
+		Explicit:           make(map[mesh.BlockID]map[mesh.LayerID]PatternId, len(ni.tExplicit)),
+		LayerBlocks:        ni.layerBlocks,
+		Good:               make(map[mesh.LayerID]PatternId, len(ni.tGood)),
+		Support:            make([]patternCount, 0, len(ni.tSupport)),
+		Complete:           make([]patternRecord, 0, len(ni.tComplete)),
+		EffectiveToBlocks:  make([]patternBlocks, 0, len(ni.tEffectiveToBlocks)),
+		Votes:              patternVotesOf(ni.tVote),
+		Tallies:            patternVotesOf(ni.tTally),
+		Patterns:           make([]patternBlocks, 0, len(ni.tPattern)),
+		PatSupport:         make([]patternLayers, 0, len(ni.tPatSupport)),
+		EquivocatingMiners: make([]string, 0, len(ni.equivocatingMiners)),
+	}
+	for _, b := range ni.blocks {
+		st.Blocks = append(st.Blocks, *b)
+	}
+	for id, p := range ni.tEffective {
+		st.Effective = append(st.Effective, blockPattern{id, newPatternRecord(p)})
+	}
+	for id, explicit := range ni.tExplicit {
+		ids := make(map[mesh.LayerID]PatternId, len(explicit))
+		for l, p := range explicit {
+			ids[l] = p.id
+		}
+		st.Explicit[id] = ids
+	}
+	for l, p := range ni.tGood {
+		st.Good[l] = p.id
+	}
+	for p, count := range ni.tSupport {
+		st.Support = append(st.Support, patternCount{newPatternRecord(p), count})
+	}
+	for p := range ni.tComplete {
+		st.Complete = append(st.Complete, newPatternRecord(p))
+	}
+	for p, bids := range ni.tEffectiveToBlocks {
+		st.EffectiveToBlocks = append(st.EffectiveToBlocks, patternBlocks{newPatternRecord(p), bids})
+	}
+	for p, set := range ni.tPattern {
+		bids := make([]mesh.BlockID, 0, len(set))
+		for id := range set {
+			bids = append(bids, id)
+		}
+		st.Patterns = append(st.Patterns, patternBlocks{newPatternRecord(p), bids})
+	}
+	for p, support := range ni.tPatSupport {
+		ids := make(map[mesh.LayerID]PatternId, len(support))
+		for l, sp := range support {
+			ids[l] = sp.id
+		}
+		st.PatSupport = append(st.PatSupport, patternLayers{newPatternRecord(p), ids})
+	}
+	for miner := range ni.equivocatingMiners {
+		st.EquivocatingMiners = append(st.EquivocatingMiners, miner)
+	}
+	return st
+}
+
+// restoreState replaces the tables of the tortoise with st
+func (ni *ninjaTortoise) restoreState(st *tortoiseState) {
+	ni.initTables()
+	ni.pBase = st.PBase.pattern()
+	for i := range st.Blocks {
+		b := st.Blocks[i]
+		ni.blocks[b.ID()] = &b
+	}
+	for _, e := range st.Effective {
+		ni.tEffective[e.Block] = e.Pattern.pattern()
+	}
+	for id, correct := range st.Correct {
+		ni.tCorrect[id] = correct
+	}
+	for id, ids := range st.Explicit {
+		explicit := make(map[mesh.LayerID]votingPattern, len(ids))
+		for l, pid := range ids {
+			explicit[l] = votingPattern{id: pid, LayerID: l}
+		}
+		ni.tExplicit[id] = explicit
+	}
+	for l, bids := range st.LayerBlocks {
+		for _, id := range bids {
+			ni.addLayerBlock(l, id)
+		}
+	}
+	for l, pid := range st.Good {
+		ni.tGood[l] = votingPattern{id: pid, LayerID: l}
+	}
+	for _, s := range st.Support {
+		ni.tSupport[s.Pattern.pattern()] = s.Count
+	}
+	for _, p := range st.Complete {
+		ni.tComplete[p.pattern()] = struct{}{}
+	}
+	for _, e := range st.EffectiveToBlocks {
+		ni.tEffectiveToBlocks[e.Pattern.pattern()] = e.Blocks
+	}
+	for _, v := range st.Votes {
+		ni.tVote[v.Pattern.pattern()] = v.Votes
+	}
+	for _, v := range st.Tallies {
+		ni.tTally[v.Pattern.pattern()] = v.Votes
+	}
+	for _, p := range st.Patterns {
+		set := make(map[mesh.BlockID]struct{}, len(p.Blocks))
+		for _, id := range p.Blocks {
+			set[id] = struct{}{}
+		}
+		ni.tPattern[p.Pattern.pattern()] = set
+	}
+	for _, s := range st.PatSupport {
+		support := make(map[mesh.LayerID]votingPattern, len(s.Layers))
+		for l, pid := range s.Layers {
+			support[l] = votingPattern{id: pid, LayerID: l}
+		}
+		ni.tPatSupport[s.Pattern.pattern()] = support
+	}
+	for _, miner := range st.EquivocatingMiners {
+		ni.equivocatingMiners[miner] = struct{}{}
+	}
+}
+
+// Save writes the configuration and tables of the tortoise to db under a single key.
+// blocks pending a flush are not saved
+func (ni *ninjaTortoise) Save(db KVStore) error {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	var w bytes.Buffer
+	if _, err := xdr.Marshal(&w, ni.state()); err != nil {
+		return fmt.Errorf("error marshalling tortoise state %v", err)
+	}
+	if err := db.Put(stateKey, w.Bytes()); err != nil {
+		return fmt.Errorf("error saving tortoise state %v", err)
+	}
+	ni.Info("saved tortoise state, pbase is %d", ni.pBase.Layer())
+	return nil
+}
+
+// Load creates a tortoise with opts from the state saved to db by Save. options aren't saved so they should be the
+// ones the saved tortoise was created with, ErrPatternHashMismatch is returned if the pattern hash differs
+func Load(db KVStore, opts ...Option) (*ninjaTortoise, error) {
+	buf, err := db.Get(stateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tortoise state %v", err)
+	}
+	st := &tortoiseState{}
+	if _, err := xdr.Unmarshal(bytes.NewReader(buf), st); err != nil {
+		return nil, fmt.Errorf("error unmarshalling tortoise state %v", err)
+	}
+
+	ni := NewNinjaTortoise(st.LayerSize, st.Config, log.NewDefault("ninja tortoise"), opts...)
+	if ni.getId(patternHashProbe()) != st.PatternHash {
+		return nil, ErrPatternHashMismatch
+	}
+	ni.restoreState(st)
+	ni.Info("loaded tortoise state, pbase is %d", ni.pBase.Layer())
+	return ni, nil
+}
+
+// DeleteSaved removes the state saved by Save from db
+func DeleteSaved(db KVStore) error {
+	if err := db.Delete(stateKey); err != nil {
+		return fmt.Errorf("error deleting tortoise state %v", err)
+	}
+	return nil
+}
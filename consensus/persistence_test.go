@@ -0,0 +1,147 @@
+package consensus
+
+import (
+	"errors"
+	"github.com/spacemeshos/go-spacemesh/database"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNinjaTortoise_SaveLoad(t *testing.T) {
+	cfg := DefaultTortoiseConfig()
+	cfg.Window = 10
+	alg := NewNinjaTortoise(uint32(5), cfg, log.New("TestNinjaTortoise_SaveLoad", "", ""))
+	expected := NewNinjaTortoise(uint32(5), cfg, log.New("TestNinjaTortoise_SaveLoad", "", ""))
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	expected.handleIncomingLayer(l)
+	for i := 1; i <= 10; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 5, 3)
+		alg.handleIncomingLayer(l)
+		expected.handleIncomingLayer(l)
+	}
+	alg.equivocatingMiners["miner"] = struct{}{}
+	expected.equivocatingMiners["miner"] = struct{}{}
+
+	db := database.NewMemDatabase()
+	_, err := Load(db)
+	assert.Error(t, err)
+
+	require.NoError(t, alg.Save(db))
+	loaded, err := Load(db)
+	require.NoError(t, err)
+	assert.Equal(t, alg.avgLayerSize, loaded.avgLayerSize)
+	assert.Equal(t, alg.cfg, loaded.cfg)
+	assert.Equal(t, alg.pBase, loaded.pBase)
+	assert.Equal(t, len(alg.blocks), len(loaded.blocks))
+	for id, b := range alg.blocks {
+		assert.Equal(t, b.Layer(), loaded.blocks[id].Layer())
+		assert.Equal(t, b.BlockVotes, loaded.blocks[id].BlockVotes)
+		assert.Equal(t, b.ViewEdges, loaded.blocks[id].ViewEdges)
+	}
+	assert.Equal(t, alg.tEffective, loaded.tEffective)
+	assert.Equal(t, alg.tCorrect, loaded.tCorrect)
+	assert.Equal(t, alg.tExplicit, loaded.tExplicit)
+	assert.Equal(t, alg.layerBlocks, loaded.layerBlocks)
+	assert.Equal(t, alg.layerBlockSet, loaded.layerBlockSet)
+	assert.Equal(t, alg.tGood, loaded.tGood)
+	assert.Equal(t, alg.tSupport, loaded.tSupport)
+	assert.Equal(t, alg.tComplete, loaded.tComplete)
+	assert.Equal(t, alg.tEffectiveToBlocks, loaded.tEffectiveToBlocks)
+	assert.Equal(t, alg.tVote, loaded.tVote)
+	assert.Equal(t, alg.tTally, loaded.tTally)
+	assert.Equal(t, alg.tPattern, loaded.tPattern)
+	assert.Equal(t, alg.tPatSupport, loaded.tPatSupport)
+	assert.Equal(t, alg.equivocatingMiners, loaded.equivocatingMiners)
+
+	// the loaded tortoise continues like the one it was saved from
+	l = createLayerWithRandVoting(11, []*mesh.Layer{l}, 5, 3)
+	loaded.handleIncomingLayer(l)
+	expected.handleIncomingLayer(l)
+	assert.Equal(t, expected.pBase, loaded.pBase)
+	assert.Equal(t, expected.tVote[expected.pBase], loaded.tVote[loaded.pBase])
+
+	require.NoError(t, DeleteSaved(db))
+	assert.Equal(t, 0, db.Len())
+	_, err = Load(db)
+	assert.Error(t, err)
+}
+
+func TestNinjaTortoise_LoadOptions(t *testing.T) {
+	sum := WithPatternHashFn(func(bids []mesh.BlockID) uint64 {
+		var h uint64
+		for _, b := range bids {
+			h = h*31 + uint64(b)
+		}
+		return h
+	})
+	weight := WithEpochWeightFn(func(mesh.BlockID, uint32) uint64 { return 2 })
+	alg := NewNinjaTortoise(uint32(5), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_LoadOptions", "", ""), sum, weight)
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	for i := 1; i <= 5; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 5, 3)
+		alg.handleIncomingLayer(l)
+	}
+
+	db := database.NewMemDatabase()
+	require.NoError(t, alg.Save(db))
+
+	// a different pattern hash would give the new patterns different ids
+	_, err := Load(db)
+	assert.Equal(t, ErrPatternHashMismatch, err)
+
+	loaded, err := Load(db, sum, weight)
+	require.NoError(t, err)
+	assert.Equal(t, alg.layerWeight, loaded.layerWeight)
+
+	l = createLayerWithRandVoting(6, []*mesh.Layer{l}, 5, 3)
+	alg.handleIncomingLayer(l)
+	loaded.handleIncomingLayer(l)
+	assert.Equal(t, alg.pBase, loaded.pBase)
+	assert.Equal(t, alg.tSupport, loaded.tSupport)
+}
+
+// failingStore fails every Put after the first allowed ones
+type failingStore struct {
+	*database.MemDatabase
+	puts int
+}
+
+func (s *failingStore) Put(key []byte, value []byte) error {
+	if s.puts == 0 {
+		return errors.New("put failed")
+	}
+	s.puts--
+	return s.MemDatabase.Put(key, value)
+}
+
+func TestNinjaTortoise_SaveFailureKeepsPreviousState(t *testing.T) {
+	alg := NewNinjaTortoise(uint32(5), DefaultTortoiseConfig(), log.New("TestNinjaTortoise_SaveFailureKeepsPreviousState", "", ""))
+	l := GenesisLayer()
+	alg.handleIncomingLayer(l)
+	for i := 1; i <= 3; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 5, 3)
+		alg.handleIncomingLayer(l)
+	}
+
+	db := &failingStore{MemDatabase: database.NewMemDatabase(), puts: 1}
+	require.NoError(t, alg.Save(db))
+	saved := alg.pBase
+	savedBlocks := len(alg.blocks)
+
+	for i := 4; i <= 6; i++ {
+		l = createLayerWithRandVoting(mesh.LayerID(i), []*mesh.Layer{l}, 5, 3)
+		alg.handleIncomingLayer(l)
+	}
+	assert.Error(t, alg.Save(db))
+
+	loaded, err := Load(db)
+	require.NoError(t, err)
+	assert.Equal(t, saved, loaded.pBase)
+	assert.Equal(t, savedBlocks, len(loaded.blocks))
+	assert.Equal(t, mesh.LayerID(3), loaded.latestLayer())
+}
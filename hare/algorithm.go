@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/gogo/protobuf/proto"
 	"github.com/spacemeshos/go-spacemesh/hare/config"
+	"github.com/spacemeshos/go-spacemesh/hare/db"
 	"github.com/spacemeshos/go-spacemesh/hare/metrics"
 	"github.com/spacemeshos/go-spacemesh/hare/pb"
 	"github.com/spacemeshos/go-spacemesh/log"
@@ -15,6 +16,9 @@ import (
 
 const ProtoName = "HARE_PROTOCOL"
 
+// HareTerminatedWithoutConsensus is the event emitted when a process reaches its max rounds without consensus
+const HareTerminatedWithoutConsensus = "HareTerminatedWithoutConsensus"
+
 type Byteable interface {
 	Bytes() []byte
 }
@@ -24,6 +28,11 @@ type NetworkService interface {
 	Broadcast(protocol string, payload []byte) error
 }
 
+// EquivocationStore persists the proofs of participants equivocating
+type EquivocationStore interface {
+	Store(proof *db.EquivocationProof) error
+}
+
 type procOutput struct {
 	id  InstanceId
 	set *Set
@@ -40,10 +49,11 @@ func (cpo procOutput) Set() *Set {
 var _ TerminationOutput = (*procOutput)(nil)
 
 type State struct {
-	k           int32           // the round counter (r%4 is the round number)
-	ki          int32           // indicates when S was first committed upon
-	s           *Set            // the set of values
-	certificate *pb.Certificate // the certificate
+	k                int32             // the round counter (r%4 is the round number)
+	ki               int32             // indicates when S was first committed upon
+	s                *Set              // the set of values
+	certificate      *pb.Certificate   // the certificate
+	roundCertificate *RoundCertificate // compact proof of the commits on s
 }
 
 type ConsensusProcess struct {
@@ -63,23 +73,32 @@ type ConsensusProcess struct {
 	proposalTracker   proposalTracker
 	commitTracker     commitTracker
 	notifyTracker     *NotifyTracker
+	participants      *ParticipantSet
+	lateTracker       *LateMessageTracker
 	terminating       bool
 	cfg               config.Config
 	notifySent        bool
 	pending           map[string]*pb.HareMessage
+	maxRounds         int32 // 0 means no limit
+	equivocations     EquivocationStore
 }
 
 func NewConsensusProcess(cfg config.Config, instanceId InstanceId, s *Set, oracle Rolacle, signing Signing, p2p NetworkService, terminationReport chan TerminationOutput, logger log.Log) *ConsensusProcess {
 	proc := &ConsensusProcess{}
-	proc.State = State{-1, -1, s.Clone(), nil}
+	proc.State = State{-1, -1, s.Clone(), nil, nil}
 	proc.Closer = NewCloser()
 	proc.instanceId = instanceId
 	proc.oracle = newHareOracle(oracle, cfg.N)
 	proc.signing = signing
 	proc.network = p2p
-	proc.validator = newSyntaxContextValidator(signing, cfg.F+1, proc.statusValidator(), logger)
+	proc.validator = newSyntaxContextValidator(signing, cfg.F+1, proc.statusValidator(), newEligibilityValidator(proc.oracle, logger).Validate, logger)
 	proc.preRoundTracker = NewPreRoundTracker(cfg.F+1, cfg.N)
+	pt := NewProposalTracker(logger)
+	pt.SetEquivocationHandler(proc.storeEquivocation)
+	proc.proposalTracker = pt
 	proc.notifyTracker = NewNotifyTracker(cfg.N)
+	proc.participants = NewParticipantSet()
+	proc.lateTracker = NewLateMessageTracker()
 	proc.terminating = false
 	proc.cfg = cfg
 	proc.notifySent = false
@@ -90,6 +109,41 @@ func NewConsensusProcess(cfg config.Config, instanceId InstanceId, s *Set, oracl
 	return proc
 }
 
+// SetEquivocationStore sets the store persisting the equivocations detected by the process, should be called before Start
+func (proc *ConsensusProcess) SetEquivocationStore(store EquivocationStore) {
+	proc.equivocations = store
+}
+
+// SetMetricsReporter sets the reporter the proposal stats of each iteration are passed to, should be called before Start
+func (proc *ConsensusProcess) SetMetricsReporter(r MetricsReporter) {
+	if pt, ok := proc.proposalTracker.(*ProposalTracker); ok {
+		pt.SetMetricsReporter(r)
+	}
+}
+
+// storeEquivocation persists the proof that the sender of first and second equivocated, if an equivocation store is set
+func (proc *ConsensusProcess) storeEquivocation(first, second *pb.HareMessage) {
+	if proc.equivocations == nil {
+		return
+	}
+
+	f, err := proto.Marshal(first)
+	if err != nil {
+		proc.Error("could not marshal equivocating message: %v", err)
+		return
+	}
+	s, err := proto.Marshal(second)
+	if err != nil {
+		proc.Error("could not marshal equivocating message: %v", err)
+		return
+	}
+
+	proof := &db.EquivocationProof{PubKey: second.PubKey, InstanceId: uint32(proc.instanceId), Round: second.Message.K, First: f, Second: s}
+	if err := proc.equivocations.Store(proof); err != nil {
+		proc.Error("could not store equivocation proof: %v", err)
+	}
+}
+
 // Returns the iteration number from a given round counter
 func iterationFromCounter(roundCounter int32) int32 {
 	return roundCounter / 4
@@ -112,12 +166,28 @@ func (proc *ConsensusProcess) Start() error {
 	}
 
 	proc.isStarted = true
+	proc.participants.Reset()
 
 	go proc.eventLoop()
 
 	return nil
 }
 
+// SetMaxRounds sets the number of rounds after which the process terminates without consensus, 0 means no limit
+func (proc *ConsensusProcess) SetMaxRounds(n int) {
+	proc.maxRounds = int32(n)
+}
+
+// Participants returns the public keys of the senders of the messages processed by the instance
+func (proc *ConsensusProcess) Participants() [][]byte {
+	return proc.participants.Participants()
+}
+
+// ParticipantCount returns the number of unique senders of the messages processed by the instance
+func (proc *ConsensusProcess) ParticipantCount() int {
+	return proc.participants.ParticipantCount()
+}
+
 func (proc *ConsensusProcess) Id() InstanceId {
 	return proc.instanceId
 }
@@ -136,6 +206,9 @@ func (proc *ConsensusProcess) eventLoop() {
 		log.Int("N", proc.cfg.N), log.Int("f", proc.cfg.F), log.String("duration", proc.cfg.RoundDuration.String()),
 		log.Uint32("instance_id", uint32(proc.instanceId)), log.String("set_values", proc.s.String()))
 
+	// report the last iteration and release pending proposal waiters
+	defer proc.proposalTracker.ResetRound()
+
 	// set pre-round message and send
 	m := proc.initDefaultBuilder(proc.s).SetType(PreRound).Sign(proc.signing).Build()
 	proc.sendMessage(m)
@@ -172,6 +245,10 @@ PreRound:
 			}
 		case <-ticker.C: // next round event
 			proc.onRoundEnd()
+			if proc.maxRounds > 0 && proc.k+1 >= proc.maxRounds {
+				proc.terminateWithoutConsensus()
+				return
+			}
 			proc.advanceToNextRound()
 			proc.onRoundBegin()
 		case <-proc.CloseChannel(): // close event
@@ -232,6 +309,7 @@ func (proc *ConsensusProcess) processMsg(m *pb.HareMessage) {
 	proc.Debug("Processing message of type %v", MessageType(m.Message.Type).String())
 
 	metrics.MessageTypeCounter.With("type_id", MessageType(m.Message.Type).String()).Add(1)
+	proc.participants.OnMessage(m)
 
 	switch MessageType(m.Message.Type) {
 	case PreRound:
@@ -262,6 +340,10 @@ func (proc *ConsensusProcess) sendMessage(msg *pb.HareMessage) {
 		return
 	}
 
+	if proc.cfg.Compress {
+		msg = compressMessage(msg)
+	}
+
 	data, err := proto.Marshal(msg)
 	if err != nil {
 		proc.Error("failed marshaling message")
@@ -309,7 +391,10 @@ func (proc *ConsensusProcess) beginRound1() {
 }
 
 func (proc *ConsensusProcess) beginRound2() {
-	proc.proposalTracker = NewProposalTracker(proc.Log)
+	// the tracker is kept across iterations, the best proposal is retained and the previous iteration is reported
+	if proc.k > Round2 {
+		proc.proposalTracker.ResetRound()
+	}
 
 	if proc.isEligible() && proc.statusesTracker.IsSVPReady() {
 		builder := proc.initDefaultBuilder(proc.statusesTracker.ProposalSet(defaultSetSize))
@@ -341,7 +426,6 @@ func (proc *ConsensusProcess) beginRound3() {
 
 func (proc *ConsensusProcess) beginRound4() {
 	proc.commitTracker = nil
-	proc.proposalTracker = nil
 }
 
 func (proc *ConsensusProcess) handlePending(pending map[string]*pb.HareMessage) {
@@ -405,6 +489,8 @@ func (proc *ConsensusProcess) processProposalMsg(msg *pb.HareMessage) {
 	if proc.currentRound() == Round2 { // regular proposal
 		proc.proposalTracker.OnProposal(msg)
 	} else { // late proposal
+		proc.Debug("Late proposal detected, pubkey %v", msg.PubKey)
+		proc.lateTracker.OnLate(msg, uint32(proc.k))
 		proc.proposalTracker.OnLateProposal(msg)
 	}
 }
@@ -423,9 +509,15 @@ func (proc *ConsensusProcess) processNotifyMsg(msg *pb.HareMessage) {
 
 	if proc.currentRound() == Round4 { // not necessary to update otherwise
 		// we assume that this expression was checked before
-		if int32(msg.Cert.AggMsgs.Messages[0].Message.K) >= proc.ki { // update state iff K >= ki
+		if msg.Cert.AggMsgs.Messages[0].Message.K >= proc.ki { // update state iff K >= ki
+			roundCert, err := BuildCertificate(msg.Cert.AggMsgs.Messages, s)
+			if err != nil {
+				proc.Warning("Could not build round certificate of notification: %v", err)
+				return
+			}
 			proc.s = s
 			proc.certificate = msg.Cert
+			proc.roundCertificate = roundCert
 			proc.ki = msg.Message.Ki
 		}
 	}
@@ -444,6 +536,15 @@ func (proc *ConsensusProcess) processNotifyMsg(msg *pb.HareMessage) {
 	proc.terminating = true // ensures immediate termination
 }
 
+func (proc *ConsensusProcess) terminateWithoutConsensus() {
+	proc.With().Warningw(HareTerminatedWithoutConsensus, log.Int32("rounds", proc.k+1),
+		log.Uint32("instance_id", uint32(proc.instanceId)))
+	metrics.TerminatedWithoutConsensusCounter.Add(1)
+	proc.terminationReport <- procOutput{proc.instanceId, nil}
+	proc.Close()
+	proc.terminating = true
+}
+
 func (proc *ConsensusProcess) currentRound() int {
 	return int(proc.k % 4)
 }
@@ -500,10 +601,21 @@ func (proc *ConsensusProcess) endOfRound3() {
 		return
 	}
 
+	roundCert, err := BuildCertificate(cert.GetAggMsgs().GetMessages(), s)
+	if err != nil {
+		proc.Error("End of round 3: could not build round certificate: %v", err)
+		return
+	}
+	if !VerifyCertificate(roundCert, s, proc.cfg.F+1) {
+		proc.Warning("End of round 3: round certificate verification failed")
+		return
+	}
+
 	// commit & send notification message
 	proc.Debug("end of round 3: committing on %v and sending notification message", s)
 	proc.s = s
 	proc.certificate = cert
+	proc.roundCertificate = roundCert
 	builder := proc.initDefaultBuilder(proc.s).SetType(Notify).SetCertificate(proc.certificate).Sign(proc.signing)
 	notifyMsg := builder.Build()
 	proc.sendMessage(notifyMsg)
@@ -2,12 +2,15 @@ package hare
 
 import (
 	"bytes"
+	"github.com/gogo/protobuf/proto"
 	"github.com/spacemeshos/go-spacemesh/hare/config"
+	"github.com/spacemeshos/go-spacemesh/hare/db"
 	"github.com/spacemeshos/go-spacemesh/hare/pb"
 	"github.com/spacemeshos/go-spacemesh/log"
 	"github.com/spacemeshos/go-spacemesh/p2p/node"
 	"github.com/spacemeshos/go-spacemesh/p2p/service"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 	"time"
 )
@@ -71,6 +74,7 @@ type mockProposalTracker struct {
 	countOnLateProposal int
 	countIsConflicting  int
 	countProposedSet    int
+	countResetRound     int
 }
 
 func (mpt *mockProposalTracker) OnProposal(msg *pb.HareMessage) {
@@ -91,6 +95,10 @@ func (mpt *mockProposalTracker) ProposedSet() *Set {
 	return mpt.proposedSet
 }
 
+func (mpt *mockProposalTracker) ResetRound() {
+	mpt.countResetRound++
+}
+
 type mockCommitTracker struct {
 	countOnCommit         int
 	countHasEnoughCommits int
@@ -346,6 +354,8 @@ func TestConsensusProcess_procProposal(t *testing.T) {
 	proc.advanceToNextRound()
 	proc.processProposalMsg(m)
 	assert.Equal(t, 1, mpt.countOnLateProposal)
+	assert.Equal(t, 1, proc.lateTracker.LateCount(uint32(proc.k)))
+	assert.Equal(t, 1, proc.lateTracker.LateCountByPeer(m.PubKey))
 }
 
 func TestConsensusProcess_procCommit(t *testing.T) {
@@ -397,6 +407,46 @@ func TestConsensusProcess_Termination(t *testing.T) {
 	}
 }
 
+func TestConsensusProcess_MaxRounds(t *testing.T) {
+	net := &mockP2p{}
+	broker := buildBroker(net)
+	broker.Start()
+	proc := generateConsensusProcess(t)
+	proc.network = net
+	proc.cfg.RoundDuration = 50 * time.Millisecond
+	proc.SetInbox(broker.Register(proc.Id()))
+	proc.SetMaxRounds(3)
+	assert.Nil(t, proc.Start())
+
+	// no other peers, the process can't reach consensus
+	timer := time.NewTimer(10 * time.Second)
+	select {
+	case <-timer.C:
+		t.Fatal("Timeout")
+	case out := <-proc.terminationReport:
+		assert.Equal(t, proc.Id(), out.Id())
+		assert.Nil(t, out.Set())
+	}
+	<-proc.CloseChannel()
+	assert.Equal(t, int32(2), proc.k) // rounds 0, 1 and 2
+}
+
+func TestConsensusProcess_Participants(t *testing.T) {
+	proc := generateConsensusProcess(t)
+	s := NewSetFromValues(value1)
+	signings := make([]Signing, 5)
+	for i := range signings {
+		signings[i] = generateSigning(t)
+		proc.processMsg(BuildPreRoundMsg(signings[i], s))
+	}
+	for i := 0; i < 3; i++ {
+		proc.processMsg(BuildPreRoundMsg(signings[i], s))
+	}
+
+	assert.Equal(t, 5, proc.ParticipantCount())
+	assert.Equal(t, signings[0].Verifier().Bytes(), proc.Participants()[0])
+}
+
 func TestConsensusProcess_currentRound(t *testing.T) {
 	proc := generateConsensusProcess(t)
 	proc.advanceToNextRound()
@@ -512,7 +562,36 @@ func TestConsensusProcess_beginRound4(t *testing.T) {
 	assert.NotNil(t, proc.proposalTracker)
 	proc.beginRound4()
 	assert.Nil(t, proc.commitTracker)
-	assert.Nil(t, proc.proposalTracker)
+	assert.NotNil(t, proc.proposalTracker)
+}
+
+func TestConsensusProcess_ProposalTrackerPerInstance(t *testing.T) {
+	proc := generateConsensusProcess(t)
+	reporter := &mockMetricsReporter{}
+	proc.SetMetricsReporter(reporter)
+	pt := proc.proposalTracker
+
+	// the first iteration starts with a fresh tracker
+	proc.k = Round2
+	proc.beginRound1()
+	proc.beginRound2()
+	assert.Empty(t, reporter.rounds)
+
+	m := BuildProposalMsg(generateSigning(t), NewSetFromValues(value1))
+	proc.processProposalMsg(m)
+	assert.Equal(t, m, proc.proposalTracker.(*ProposalTracker).BestProposal())
+
+	// the next iterations reset the same tracker and report the previous one
+	for i := 1; i <= 2; i++ {
+		proc.k = int32(4*i + Round2)
+		proc.beginRound1()
+		proc.beginRound2()
+		assert.Equal(t, pt, proc.proposalTracker)
+		assert.Nil(t, proc.proposalTracker.ProposedSet())
+		assert.Equal(t, m, proc.proposalTracker.(*ProposalTracker).BestProposal())
+	}
+	assert.Equal(t, []uint32{0, 1}, reporter.rounds)
+	assert.Equal(t, 1, reporter.stats[0].Proposals)
 }
 
 func TestConsensusProcess_handlePending(t *testing.T) {
@@ -561,9 +640,55 @@ func TestConsensusProcess_endOfRound3(t *testing.T) {
 	proc.s = NewSmallEmptySet()
 	proc.endOfRound3()
 	assert.NotNil(t, proc.s)
+	// a certificate without commits doesn't make a round certificate
 	mpt.proposedSet = NewSetFromValues(value1)
 	proc.endOfRound3()
+	assert.False(t, proc.notifySent)
+	assert.Nil(t, proc.roundCertificate)
+
+	commits := make([]*pb.HareMessage, 0, cfg.F+1)
+	for i := 0; i < cfg.F+1; i++ {
+		commits = append(commits, BuildCommitMsg(generateSigning(t), mpt.proposedSet))
+	}
+	mct.certificate = &pb.Certificate{AggMsgs: &pb.AggregatedMessages{Messages: commits}}
+	proc.endOfRound3()
 	assert.True(t, proc.s.Equals(mpt.proposedSet))
 	assert.Equal(t, mct.certificate, proc.certificate)
+	assert.True(t, VerifyCertificate(proc.roundCertificate, mpt.proposedSet, cfg.F+1))
 	assert.True(t, proc.notifySent)
 }
+
+type equivocationStoreMock struct {
+	proofs []*db.EquivocationProof
+}
+
+func (m *equivocationStoreMock) Store(proof *db.EquivocationProof) error {
+	m.proofs = append(m.proofs, proof)
+	return nil
+}
+
+func TestConsensusProcess_SetEquivocationStore(t *testing.T) {
+	proc := generateConsensusProcess(t)
+	store := &equivocationStoreMock{}
+	proc.SetEquivocationStore(store)
+	proc.beginRound1()
+	proc.beginRound2()
+
+	signing := generateSigning(t)
+	m1 := BuildProposalMsg(signing, NewSetFromValues(value1))
+	m2 := BuildProposalMsg(signing, NewSetFromValues(value2))
+	proc.proposalTracker.OnProposal(m1)
+	proc.proposalTracker.OnProposal(m2)
+
+	require.Equal(t, 1, len(store.proofs))
+	proof := store.proofs[0]
+	assert.Equal(t, m2.PubKey, proof.PubKey)
+	assert.Equal(t, uint32(instanceId1), proof.InstanceId)
+	assert.Equal(t, m2.Message.K, proof.Round)
+	first := &pb.HareMessage{}
+	require.NoError(t, proto.Unmarshal(proof.First, first))
+	assert.True(t, NewSet(first.Message.Values).Equals(NewSetFromValues(value1)))
+	second := &pb.HareMessage{}
+	require.NoError(t, proto.Unmarshal(proof.Second, second))
+	assert.True(t, NewSet(second.Message.Values).Equals(NewSetFromValues(value2)))
+}
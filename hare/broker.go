@@ -103,6 +103,12 @@ func (broker *Broker) eventLoop() {
 				continue
 			}
 
+			if err := decompressMessage(hareMsg); err != nil {
+				log.Warning("Message validation failed: could not decompress values: %v", err)
+				msg.ReportValidation(ProtoName, false)
+				continue
+			}
+
 			expInstId := broker.maxReg
 			msgInstId := InstanceId(hareMsg.Message.InstanceId)
 			// far future unregistered instance
@@ -15,8 +15,7 @@ var instanceId2 = InstanceId(2)
 var instanceId3 = InstanceId(3)
 
 func createMessage(t *testing.T, instanceId InstanceId) []byte {
-	hareMsg := &pb.HareMessage{}
-	hareMsg.Message = &pb.InnerMessage{InstanceId: uint32(instanceId)}
+	hareMsg := NewMessageFactory(generateSigning(t)).SetInstanceId(instanceId).NewPreRoundMsg(NewSetFromValues(value1))
 	serMsg, err := proto.Marshal(hareMsg)
 
 	if err != nil {
@@ -0,0 +1,75 @@
+package hare
+
+import (
+	"errors"
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+)
+
+// CertSigner is a single (pubKey, signature) pair taken from a commit message
+type CertSigner struct {
+	PubKey []byte
+	Sig    Signature
+}
+
+// RoundCertificate is a compact proof that a set was committed upon in a round.
+// It holds the id of the agreed set and the signers of the matching commit messages.
+type RoundCertificate struct {
+	SetId   objectId
+	K       int32 // the round counter of the commits
+	Signers []CertSigner
+}
+
+// BuildCertificate aggregates the provided commit messages into a RoundCertificate for set
+func BuildCertificate(commits []*pb.HareMessage, set *Set) (*RoundCertificate, error) {
+	if set == nil {
+		return nil, errors.New("cannot build certificate for a nil set")
+	}
+
+	if len(commits) == 0 {
+		return nil, errors.New("cannot build certificate without commits")
+	}
+
+	cert := &RoundCertificate{SetId: set.Id(), Signers: make([]CertSigner, 0, len(commits))}
+	for i, commit := range commits {
+		if commit == nil || commit.Message == nil {
+			return nil, errors.New("cannot build certificate from a nil commit message")
+		}
+
+		if MessageType(commit.Message.Type) != Commit {
+			return nil, errors.New("cannot build certificate from a non-commit message")
+		}
+
+		if i == 0 {
+			cert.K = commit.Message.K
+		} else if commit.Message.K != cert.K {
+			return nil, errors.New("cannot build certificate from commits of different rounds")
+		}
+
+		cert.Signers = append(cert.Signers, CertSigner{commit.PubKey, commit.InnerSig})
+	}
+
+	return cert, nil
+}
+
+// VerifyCertificate checks that cert commits on expectedSet and is signed by at least minSigners distinct signers.
+// the signatures aren't verified, cert should be built from commits whose signatures and roles were validated
+func VerifyCertificate(cert *RoundCertificate, expectedSet *Set, minSigners int) bool {
+	if cert == nil || expectedSet == nil {
+		return false
+	}
+
+	if cert.SetId != expectedSet.Id() {
+		return false
+	}
+
+	signers := make(map[string]struct{}, len(cert.Signers))
+	for _, signer := range cert.Signers {
+		if len(signer.PubKey) == 0 || len(signer.Sig) == 0 {
+			return false
+		}
+
+		signers[string(signer.PubKey)] = struct{}{}
+	}
+
+	return len(signers) >= minSigners
+}
@@ -0,0 +1,104 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBuildCertificate(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	_, err := BuildCertificate(nil, s)
+	assert.NotNil(t, err)
+	_, err = BuildCertificate([]*pb.HareMessage{BuildCommitMsg(generateSigning(t), s)}, nil)
+	assert.NotNil(t, err)
+	_, err = BuildCertificate([]*pb.HareMessage{BuildPreRoundMsg(generateSigning(t), s)}, s)
+	assert.NotNil(t, err)
+
+	commits := []*pb.HareMessage{BuildCommitMsg(generateSigning(t), s), BuildCommitMsg(generateSigning(t), s)}
+	cert, err := BuildCertificate(commits, s)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Id(), cert.SetId)
+	assert.Equal(t, 2, len(cert.Signers))
+	assert.Equal(t, commits[0].PubKey, cert.Signers[0].PubKey)
+	assert.Equal(t, Signature(commits[0].InnerSig), cert.Signers[0].Sig)
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	signing := generateSigning(t)
+	commits := []*pb.HareMessage{BuildCommitMsg(signing, s), BuildCommitMsg(generateSigning(t), s)}
+	cert, err := BuildCertificate(commits, s)
+	assert.Nil(t, err)
+
+	assert.False(t, VerifyCertificate(nil, s, 1))
+	assert.False(t, VerifyCertificate(cert, nil, 1))
+	assert.True(t, VerifyCertificate(cert, s, 2))
+	assert.False(t, VerifyCertificate(cert, s, 3))
+	assert.False(t, VerifyCertificate(cert, NewSetFromValues(value1), 2))
+
+	// same signer twice counts once
+	dup, err := BuildCertificate([]*pb.HareMessage{BuildCommitMsg(signing, s), BuildCommitMsg(signing, s)}, s)
+	assert.Nil(t, err)
+	assert.False(t, VerifyCertificate(dup, s, 2))
+}
+
+func TestBuildCertificate_Rounds(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	commits := []*pb.HareMessage{BuildCommitMsg(generateSigning(t), s), BuildCommitMsg(generateSigning(t), s)}
+	cert, err := BuildCertificate(commits, s)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(Round3), cert.K)
+
+	// commits of different rounds don't make a certificate
+	commits[1].Message.K++
+	_, err = BuildCertificate(commits, s)
+	assert.NotNil(t, err)
+}
+
+func TestMessageValidator_ValidateNotify(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	eligible := newEligibilityValidator(&mockRolacle{isEligible: true}, log.NewDefault("Validator"))
+	validator := newSyntaxContextValidator(NewMockSigning(), 2, validate, eligible.Validate, log.NewDefault("Validator"))
+	commits := []*pb.HareMessage{BuildCommitMsg(generateSigning(t), s), BuildCommitMsg(generateSigning(t), s)}
+	notify := NewMessageFactory(generateSigning(t)).NewNotifyMsg(s, commits...)
+	assert.True(t, validator.SyntacticallyValidateMessage(notify))
+
+	// not enough commits
+	notify = NewMessageFactory(generateSigning(t)).NewNotifyMsg(s, commits[0])
+	assert.False(t, validator.SyntacticallyValidateMessage(notify))
+
+	// the commits are on another set
+	other := NewSetFromValues(value1)
+	notify = NewMessageFactory(generateSigning(t)).NewNotifyMsg(s, BuildCommitMsg(generateSigning(t), other), BuildCommitMsg(generateSigning(t), other))
+	assert.False(t, validator.SyntacticallyValidateMessage(notify))
+	notify.Cert.Values = other.To2DSlice()
+	assert.False(t, validator.SyntacticallyValidateMessage(notify))
+
+	notify.Cert = nil
+	assert.False(t, validator.SyntacticallyValidateMessage(notify))
+}
+
+func TestMessageValidator_ValidateCertificateForgedSigners(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	eligible := newEligibilityValidator(&mockRolacle{isEligible: true}, log.NewDefault("Validator"))
+	validator := newSyntaxContextValidator(NewMockSigning(), 2, validate, eligible.Validate, log.NewDefault("Validator"))
+
+	// made up signers with signatures that aren't theirs
+	forged := make([]*pb.HareMessage, 0, 2)
+	for i := 0; i < 2; i++ {
+		commit := BuildCommitMsg(generateSigning(t), s)
+		commit.PubKey = generateSigning(t).Verifier().Bytes()
+		forged = append(forged, commit)
+	}
+	notify := NewMessageFactory(generateSigning(t)).NewNotifyMsg(s, forged...)
+	assert.False(t, validator.SyntacticallyValidateMessage(notify))
+
+	// the signatures are valid but the signers aren't eligible
+	ineligible := newEligibilityValidator(&mockRolacle{isEligible: false}, log.NewDefault("Validator"))
+	validator = newSyntaxContextValidator(NewMockSigning(), 2, validate, ineligible.Validate, log.NewDefault("Validator"))
+	commits := []*pb.HareMessage{BuildCommitMsg(generateSigning(t), s), BuildCommitMsg(generateSigning(t), s)}
+	notify = NewMessageFactory(generateSigning(t)).NewNotifyMsg(s, commits...)
+	assert.False(t, validator.SyntacticallyValidateMessage(notify))
+}
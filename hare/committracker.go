@@ -77,12 +77,8 @@ func (ct *CommitTracker) BuildCertificate() *pb.Certificate {
 	c := &pb.Certificate{}
 	c.Values = ct.proposedSet.To2DSlice()
 	c.AggMsgs = &pb.AggregatedMessages{}
-	c.AggMsgs.Messages = ct.commits
-
-	// optimize msg size by setting values to nil
-	for _, commit := range c.AggMsgs.Messages {
-		commit.Message.Values = nil
-	}
+	// exactly threshold commits are needed, the values are kept since the commits are signed with them
+	c.AggMsgs.Messages = ct.commits[:ct.threshold]
 
 	// TODO: set c.AggMsgs.AggSig
 
@@ -0,0 +1,133 @@
+package hare
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"github.com/spacemeshos/go-spacemesh/common"
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"io"
+	"io/ioutil"
+)
+
+// MaxCompressedSetSize is the maximal number of values accepted in a compressed message
+const MaxCompressedSetSize = 1 << 16
+
+// compressedValueSize is the size of a single compressed value
+const compressedValueSize = 4
+
+// ErrDecompressedTooLarge is returned when compressed values expand beyond MaxCompressedSetSize values
+var ErrDecompressedTooLarge = errors.New("decompressed values exceed the max set size")
+
+// CompressValues gzips the little endian encoding of vals
+func CompressValues(vals []uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	raw := make([]byte, compressedValueSize)
+	for _, v := range vals {
+		binary.LittleEndian.PutUint32(raw, v)
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecompressValues decodes values compressed by CompressValues, it reads at most MaxCompressedSetSize values
+func DecompressValues(data []byte) ([]uint32, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	// read one more byte than allowed to tell a too large input from one of exactly the max size
+	raw, err := ioutil.ReadAll(io.LimitReader(r, MaxCompressedSetSize*compressedValueSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > MaxCompressedSetSize*compressedValueSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	if len(raw)%compressedValueSize != 0 {
+		return nil, fmt.Errorf("decompressed %v bytes, not a multiple of the value size %v", len(raw), compressedValueSize)
+	}
+
+	vals := make([]uint32, 0, len(raw)/compressedValueSize)
+	for i := 0; i < len(raw); i += compressedValueSize {
+		vals = append(vals, binary.LittleEndian.Uint32(raw[i:i+compressedValueSize]))
+	}
+	return vals, nil
+}
+
+// blockIds returns the block ids of values, false if a value isn't a block id
+func blockIds(values [][]byte) ([]uint32, bool) {
+	ids := make([]uint32, 0, len(values))
+	for _, v := range values {
+		if len(v) != len(Bytes32{}) {
+			return nil, false
+		}
+		for _, b := range v[compressedValueSize:] {
+			if b != 0 {
+				return nil, false
+			}
+		}
+		ids = append(ids, common.BytesToUint32(v))
+	}
+	return ids, true
+}
+
+// compressMessage returns a copy of msg with its values moved to CompressedValues.
+// msg is returned as is if its values aren't block ids or if compression doesn't help
+func compressMessage(msg *pb.HareMessage) *pb.HareMessage {
+	if msg.Message == nil || len(msg.Message.Values) < 2 || len(msg.Message.Values) > MaxCompressedSetSize {
+		return msg
+	}
+	ids, ok := blockIds(msg.Message.Values)
+	if !ok {
+		return msg
+	}
+
+	compressed, err := CompressValues(ids)
+	if err != nil {
+		log.Warning("could not compress message values: %v", err)
+		return msg
+	}
+	if len(compressed) >= len(msg.Message.Values)*len(Bytes32{}) {
+		return msg
+	}
+
+	res := proto.Clone(msg).(*pb.HareMessage)
+	res.Message.Values = nil
+	res.CompressedValues = compressed
+	return res
+}
+
+// decompressMessage restores the values of a message compressed by compressMessage, uncompressed messages are left untouched
+func decompressMessage(msg *pb.HareMessage) error {
+	if len(msg.CompressedValues) == 0 {
+		return nil
+	}
+	if msg.Message == nil || len(msg.Message.Values) != 0 {
+		return errors.New("compressed values with no message or with uncompressed values")
+	}
+
+	ids, err := DecompressValues(msg.CompressedValues)
+	if err != nil {
+		return err
+	}
+	vals := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		v := NewBytes32(common.Uint32ToBytes(id))
+		vals = append(vals, v[:])
+	}
+	msg.Message.Values = vals
+	msg.CompressedValues = nil
+	return nil
+}
@@ -0,0 +1,109 @@
+package hare
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func buildValues(n int) *Set {
+	s := NewEmptySet(n)
+	for i := 0; i < n; i++ {
+		s.Add(Value{NewBytes32([]byte{byte(i), byte(i >> 8)})})
+	}
+	return s
+}
+
+func TestCompressValues(t *testing.T) {
+	vals := make([]uint32, 100)
+	for i := range vals {
+		vals[i] = uint32(i * 1000)
+	}
+	data, err := CompressValues(vals)
+	require.NoError(t, err)
+	res, err := DecompressValues(data)
+	require.NoError(t, err)
+	assert.Equal(t, vals, res)
+
+	_, err = DecompressValues([]byte{1, 2, 3})
+	assert.Error(t, err)
+	data, err = CompressValues(nil)
+	require.NoError(t, err)
+	res, err = DecompressValues(data)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func TestDecompressValues_TooLarge(t *testing.T) {
+	data, err := CompressValues(make([]uint32, MaxCompressedSetSize))
+	require.NoError(t, err)
+	res, err := DecompressValues(data)
+	require.NoError(t, err)
+	assert.Equal(t, MaxCompressedSetSize, len(res))
+
+	// a few kilobytes of compressed zeros expand beyond the limit
+	data, err = CompressValues(make([]uint32, 10*MaxCompressedSetSize))
+	require.NoError(t, err)
+	assert.True(t, len(data) < 8192)
+	_, err = DecompressValues(data)
+	assert.Equal(t, ErrDecompressedTooLarge, err)
+}
+
+func TestCompressMessage(t *testing.T) {
+	s := buildValues(1000)
+	m := BuildPreRoundMsg(generateSigning(t), s)
+	compressed := compressMessage(m)
+	require.Empty(t, compressed.Message.Values)
+	require.NotEmpty(t, compressed.CompressedValues)
+	assert.Equal(t, 1000, len(m.Message.Values))
+
+	data, err := proto.Marshal(compressed)
+	require.NoError(t, err)
+	received := &pb.HareMessage{}
+	require.NoError(t, proto.Unmarshal(data, received))
+	require.NoError(t, decompressMessage(received))
+	assert.True(t, s.Equals(NewSet(received.Message.Values)))
+
+	// the signature covers the uncompressed values
+	inner, err := proto.Marshal(received.Message)
+	require.NoError(t, err)
+	verifier, err := NewVerifier(received.PubKey)
+	require.NoError(t, err)
+	valid, err := verifier.Verify(inner, received.InnerSig)
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	// a single value isn't compressed
+	single := BuildPreRoundMsg(generateSigning(t), NewSetFromValues(value1))
+	assert.Equal(t, single, compressMessage(single))
+	require.NoError(t, decompressMessage(single))
+	assert.True(t, NewSetFromValues(value1).Equals(NewSet(single.Message.Values)))
+
+	// values which aren't block ids aren't compressed
+	s = NewSetFromValues(Value{NewBytes32([]byte{1, 2, 3, 4, 5})}, Value{NewBytes32([]byte{1})})
+	other := BuildPreRoundMsg(generateSigning(t), s)
+	assert.Equal(t, other, compressMessage(other))
+
+	// a message with both compressed and uncompressed values is rejected
+	both := proto.Clone(compressed).(*pb.HareMessage)
+	both.Message.Values = m.Message.Values
+	assert.Error(t, decompressMessage(both))
+}
+
+func BenchmarkCompressValues(b *testing.B) {
+	vals := make([]uint32, 1000)
+	for i := range vals {
+		vals[i] = uint32(i)
+	}
+	b.ResetTimer()
+	var data []byte
+	for i := 0; i < b.N; i++ {
+		var err error
+		if data, err = CompressValues(vals); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Logf("compressed %v values of %v bytes to %v bytes", len(vals), len(vals)*len(Bytes32{}), len(data))
+}
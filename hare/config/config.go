@@ -6,8 +6,9 @@ type Config struct {
 	N             int           `mapstructure:"hare-committee-size"`  // total number of active parties
 	F             int           `mapstructure:"hare-max-adversaries"` // number of dishonest parties
 	RoundDuration time.Duration `mapstructure:"round-duration-ms"`    // the duration of a single round
+	Compress      bool          `mapstructure:"hare-compress-values"` // gzip the values of sent messages
 }
 
 func DefaultConfig() Config {
-	return Config{2, 1, 1500 * time.Millisecond}
+	return Config{2, 1, 1500 * time.Millisecond, false}
 }
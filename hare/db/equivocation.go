@@ -0,0 +1,80 @@
+// Package db persists hare data for auditing
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/davecgh/go-xdr/xdr2"
+	"github.com/spacemeshos/go-spacemesh/database"
+)
+
+// equivocationPrefix prefixes the keys of all equivocation proofs in the database
+var equivocationPrefix = []byte("hare-equivocation/")
+
+// EquivocationProof holds two conflicting messages signed by the same participant in the same round
+type EquivocationProof struct {
+	PubKey     []byte
+	InstanceId uint32
+	Round      int32
+	First      []byte // the marshaled message received first
+	Second     []byte // the marshaled message conflicting with First
+}
+
+// EquivocationDatabase stores equivocation proofs in a leveldb instance
+type EquivocationDatabase struct {
+	db *database.LDBDatabase
+}
+
+// NewEquivocationDatabase creates an equivocation database stored in db, the proofs are kept under their own prefix
+// so db can be shared with other data
+func NewEquivocationDatabase(db *database.LDBDatabase) *EquivocationDatabase {
+	return &EquivocationDatabase{db: db}
+}
+
+// pubKeyPrefix returns the key prefix of all proofs of pub
+func pubKeyPrefix(pub []byte) []byte {
+	prefix := make([]byte, 0, len(equivocationPrefix)+2+len(pub))
+	prefix = append(prefix, equivocationPrefix...)
+	prefix = append(prefix, 0, 0)
+	binary.BigEndian.PutUint16(prefix[len(equivocationPrefix):], uint16(len(pub)))
+	return append(prefix, pub...)
+}
+
+// Store persists proof, storing the same proof again has no effect
+func (edb *EquivocationDatabase) Store(proof *EquivocationProof) error {
+	var w bytes.Buffer
+	if _, err := xdr.Marshal(&w, proof); err != nil {
+		return fmt.Errorf("error marshalling equivocation proof %v", err)
+	}
+
+	hash := sha256.Sum256(w.Bytes())
+	return edb.db.Put(append(pubKeyPrefix(proof.PubKey), hash[:]...), w.Bytes())
+}
+
+// GetByPubKey returns all the proofs of equivocations by pub
+func (edb *EquivocationDatabase) GetByPubKey(pub []byte) ([]*EquivocationProof, error) {
+	return edb.load(pubKeyPrefix(pub))
+}
+
+// All returns all the stored proofs ordered by public key
+func (edb *EquivocationDatabase) All() ([]*EquivocationProof, error) {
+	return edb.load(equivocationPrefix)
+}
+
+func (edb *EquivocationDatabase) load(prefix []byte) ([]*EquivocationProof, error) {
+	it := edb.db.NewIteratorWithPrefix(prefix)
+	defer it.Release()
+
+	proofs := make([]*EquivocationProof, 0)
+	for it.Next() {
+		proof := &EquivocationProof{}
+		if _, err := xdr.Unmarshal(bytes.NewReader(it.Value()), proof); err != nil {
+			return nil, fmt.Errorf("error unmarshalling equivocation proof %v", err)
+		}
+		proofs = append(proofs, proof)
+	}
+
+	return proofs, it.Error()
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"github.com/spacemeshos/go-spacemesh/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func openDatabase(t *testing.T, dir string) (*database.LDBDatabase, *EquivocationDatabase) {
+	ldb, err := database.NewLDBDatabase(dir, 0, 0)
+	require.NoError(t, err)
+	return ldb, NewEquivocationDatabase(ldb)
+}
+
+func TestEquivocationDatabase_Store(t *testing.T) {
+	dir, err := ioutil.TempDir("", "equivocations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ldb, edb := openDatabase(t, dir)
+	p1 := &EquivocationProof{PubKey: []byte{1, 2}, InstanceId: 5, Round: 2, First: []byte("a"), Second: []byte("b")}
+	p2 := &EquivocationProof{PubKey: []byte{1, 2}, InstanceId: 6, Round: 6, First: []byte("c"), Second: []byte("d")}
+	p3 := &EquivocationProof{PubKey: []byte{1, 2, 3}, InstanceId: 5, Round: 2, First: []byte("e"), Second: []byte("f")}
+	for _, p := range []*EquivocationProof{p1, p2, p3, p1} {
+		require.NoError(t, edb.Store(p))
+	}
+	require.NoError(t, ldb.Put([]byte("other"), []byte("data")))
+
+	proofs, err := edb.GetByPubKey([]byte{1, 2})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*EquivocationProof{p1, p2}, proofs)
+
+	proofs, err = edb.GetByPubKey([]byte{1})
+	require.NoError(t, err)
+	assert.Empty(t, proofs)
+
+	proofs, err = edb.All()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*EquivocationProof{p1, p2, p3}, proofs)
+
+	// the proofs survive reopening the database
+	ldb.Close()
+	ldb, edb = openDatabase(t, dir)
+	defer ldb.Close()
+	proofs, err = edb.All()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*EquivocationProof{p1, p2, p3}, proofs)
+	proofs, err = edb.GetByPubKey([]byte{1, 2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, []*EquivocationProof{p3}, proofs)
+}
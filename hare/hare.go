@@ -68,6 +68,9 @@ type Hare struct {
 	outputs    map[mesh.LayerID][]mesh.BlockID
 
 	factory consensusFactory
+
+	maxRounds     int
+	equivocations EquivocationStore
 }
 
 // New returns a new Hare struct.
@@ -97,12 +100,27 @@ func New(conf config.Config, p2p NetworkService, sign Signing, obp orphanBlockPr
 	h.outputs = make(map[mesh.LayerID][]mesh.BlockID, h.bufferSize) //  we keep results about LayerBuffer past layers
 
 	h.factory = func(conf config.Config, instanceId InstanceId, s *Set, oracle Rolacle, signing Signing, p2p NetworkService, terminationReport chan TerminationOutput) Consensus {
-		return NewConsensusProcess(conf, instanceId, s, oracle, signing, p2p, terminationReport, logger)
+		cp := NewConsensusProcess(conf, instanceId, s, oracle, signing, p2p, terminationReport, logger)
+		cp.SetMaxRounds(h.maxRounds)
+		cp.SetEquivocationStore(h.equivocations)
+		return cp
 	}
 
 	return h
 }
 
+// SetMaxRounds sets the number of rounds after which consensus processes terminate with a nil output, 0 means no limit.
+// should be called before Start
+func (h *Hare) SetMaxRounds(n int) {
+	h.maxRounds = n
+}
+
+// SetEquivocationStore sets the store persisting every equivocation detected by the consensus processes.
+// should be called before Start
+func (h *Hare) SetEquivocationStore(store EquivocationStore) {
+	h.equivocations = store
+}
+
 func (h *Hare) isTooLate(id InstanceId) bool {
 	h.layerLock.RLock()
 	if int64(id) < int64(h.lastLayer)-int64(h.bufferSize) { // bufferSize>=0
@@ -123,12 +141,14 @@ func (h *Hare) collectOutput(output TerminationOutput) error {
 		return ErrTooLate
 	}
 
-	set := output.Set()
-	blocks := make([]mesh.BlockID, len(set.values))
-	i := 0
-	for _, v := range set.values {
-		blocks[i] = mesh.BlockID(common.BytesToUint32(v.Bytes()))
-		i++
+	var blocks []mesh.BlockID // stays nil if the process terminated without consensus
+	if set := output.Set(); set != nil {
+		blocks = make([]mesh.BlockID, len(set.values))
+		i := 0
+		for _, v := range set.values {
+			blocks[i] = mesh.BlockID(common.BytesToUint32(v.Bytes()))
+			i++
+		}
 	}
 	h.mu.Lock()
 	if len(h.outputs) == h.bufferSize {
@@ -190,6 +210,8 @@ var (
 	ErrTooOld = errors.New("results for that layer already deleted")
 	// ErrTooEarly is what we return when the requested layer consensus is still in process
 	ErrTooEarly = errors.New("results for that layer haven't arrived yet")
+	// ErrNoConsensus is what we return when the consensus process of the layer terminated without consensus
+	ErrNoConsensus = errors.New("consensus process of that layer terminated without consensus")
 )
 
 // GetResults returns the hare output for a given LayerID. returns error if we don't have results yet.
@@ -205,6 +227,9 @@ func (h *Hare) BlockingGetResult(id mesh.LayerID) ([]mesh.BlockID, error) {
 		return nil, ErrTooEarly
 	}
 	h.mu.RUnlock()
+	if blks == nil {
+		return nil, ErrNoConsensus
+	}
 	return blks, nil
 }
 
@@ -221,6 +246,9 @@ func (h *Hare) GetResult(id mesh.LayerID) ([]mesh.BlockID, error) {
 		return nil, ErrTooEarly
 	}
 	h.mu.RUnlock()
+	if blks == nil {
+		return nil, ErrNoConsensus
+	}
 	return blks, nil
 }
 
@@ -130,6 +130,35 @@ func TestHare_GetResult(t *testing.T) {
 	require.True(t, uint32(res[0]) == uint32(set.values[value1.Id()].Bytes()[0]))
 }
 
+func TestHare_MaxRounds(t *testing.T) {
+	sim := service.NewSimulator()
+	n1 := sim.NewNode()
+
+	layerTicker := make(chan mesh.LayerID)
+
+	oracle := NewMockHashOracle(numOfClients)
+	signing := NewMockSigning()
+
+	om := new(orphanMock)
+
+	h := New(cfg, n1, signing, om, oracle, layerTicker, log.NewDefault("Hare"))
+	h.SetMaxRounds(3)
+	cp := h.factory(h.config, instanceId1, NewSetFromValues(value1), oracle, signing, n1, h.outputChan)
+	require.Equal(t, int32(3), cp.(*ConsensusProcess).maxRounds)
+
+	// terminated without consensus
+	require.NoError(t, h.collectOutput(mockOutput{InstanceId(0), nil}))
+	res, err := h.GetResult(mesh.LayerID(0))
+	require.Equal(t, ErrNoConsensus, err)
+	require.Nil(t, res)
+
+	// consensus on the empty set is a result
+	require.NoError(t, h.collectOutput(mockOutput{InstanceId(1), NewEmptySet(0)}))
+	res, err = h.GetResult(mesh.LayerID(1))
+	require.NoError(t, err)
+	require.Empty(t, res)
+}
+
 func TestHare_GetResult2(t *testing.T) {
 	sim := service.NewSimulator()
 	n1 := sim.NewNode()
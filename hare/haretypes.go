@@ -3,7 +3,10 @@ package hare
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/spacemeshos/go-spacemesh/common"
+	"github.com/spacemeshos/go-spacemesh/mesh"
 	"hash/fnv"
 	"sort"
 )
@@ -83,9 +86,12 @@ func (b32 Bytes32) String() string {
 
 // Represents a unique set of values
 type Set struct {
-	values    map[objectId]Value
-	id        objectId
-	isIdValid bool
+	values       map[objectId]Value
+	id           objectId
+	isIdValid    bool
+	minBlockId   mesh.BlockID
+	maxBlockId   mesh.BlockID
+	isRangeValid bool
 }
 
 // Constructs an empty set
@@ -131,12 +137,17 @@ func NewSet(data [][]byte) *Set {
 	return s
 }
 
-// Clones the set
+// Returns a deep copy of the set, mutating the clone doesn't affect s and vice versa
 func (s *Set) Clone() *Set {
 	clone := NewEmptySet(len(s.values))
 	for _, v := range s.values {
 		clone.Add(v)
 	}
+	clone.id = s.id
+	clone.isIdValid = s.isIdValid
+	clone.minBlockId = s.minBlockId
+	clone.maxBlockId = s.maxBlockId
+	clone.isRangeValid = s.isRangeValid
 
 	return clone
 }
@@ -154,6 +165,7 @@ func (s *Set) Add(id Value) {
 	}
 
 	s.isIdValid = false
+	s.isRangeValid = false
 	s.values[id.Id()] = id
 }
 
@@ -164,6 +176,7 @@ func (s *Set) Remove(id Value) {
 	}
 
 	s.isIdValid = false
+	s.isRangeValid = false
 	delete(s.values, id.Id())
 }
 
@@ -226,6 +239,45 @@ func (s *Set) Id() objectId {
 	return s.id
 }
 
+func (s *Set) updateRange() {
+	first := true
+	for _, v := range s.values {
+		id := mesh.BlockID(common.BytesToUint32(v.Bytes()))
+		if first || id < s.minBlockId {
+			s.minBlockId = id
+		}
+		if first || id > s.maxBlockId {
+			s.maxBlockId = id
+		}
+		first = false
+	}
+	s.isRangeValid = true
+}
+
+// Returns the minimal block id in the set, false if the set is empty
+func (s *Set) MinBlockID() (mesh.BlockID, bool) {
+	if len(s.values) == 0 {
+		return 0, false
+	}
+	if !s.isRangeValid {
+		s.updateRange()
+	}
+
+	return s.minBlockId, true
+}
+
+// Returns the maximal block id in the set, false if the set is empty
+func (s *Set) MaxBlockID() (mesh.BlockID, bool) {
+	if len(s.values) == 0 {
+		return 0, false
+	}
+	if !s.isRangeValid {
+		s.updateRange()
+	}
+
+	return s.maxBlockId, true
+}
+
 func (s *Set) String() string {
 	// TODO: should improve
 	b := new(bytes.Buffer)
@@ -246,6 +298,30 @@ func (s *Set) IsSubSetOf(g *Set) bool {
 	return true
 }
 
+// Returns true if a and b represent the same set, a nil set equals only nil or an empty set
+func SetsEqual(a, b *Set) bool {
+	if a == nil {
+		return b == nil || b.Size() == 0
+	}
+	if b == nil {
+		return a.Size() == 0
+	}
+
+	return a.Equals(b)
+}
+
+// Returns true if sub is a subset of super, a nil set is treated as an empty set
+func SetIsSubsetOf(sub, super *Set) bool {
+	if sub == nil || sub.Size() == 0 {
+		return true
+	}
+	if super == nil {
+		return false
+	}
+
+	return sub.IsSubSetOf(super)
+}
+
 // Returns the intersection set of s and g
 func (s *Set) Intersection(g *Set) *Set {
 	both := NewEmptySet(len(s.values))
@@ -285,7 +361,86 @@ func (s *Set) Complement(u *Set) *Set {
 	return comp
 }
 
+// Returns a new set of the block ids in s for which blockToLayer returns layer
+func (s *Set) FilterByLayer(layer mesh.LayerID, blockToLayer func(mesh.BlockID) mesh.LayerID) *Set {
+	filtered := NewEmptySet(len(s.values))
+	for _, v := range s.values {
+		if blockToLayer(mesh.BlockID(common.BytesToUint32(v.Bytes()))) == layer {
+			filtered.Add(v)
+		}
+	}
+
+	return filtered
+}
+
 // Returns the size of the set
 func (s *Set) Size() int {
 	return len(s.values)
 }
+
+// Returns the block ids added and removed when going from s to g, both sorted
+func (s *Set) Diff(g *Set) (added, removed []mesh.BlockID) {
+	added = make([]mesh.BlockID, 0)
+	for _, v := range g.values {
+		if !s.Contains(v) {
+			added = append(added, mesh.BlockID(common.BytesToUint32(v.Bytes())))
+		}
+	}
+
+	removed = make([]mesh.BlockID, 0)
+	for _, v := range s.values {
+		if !g.Contains(v) {
+			removed = append(removed, mesh.BlockID(common.BytesToUint32(v.Bytes())))
+		}
+	}
+
+	sortBlockIDs(added)
+	sortBlockIDs(removed)
+	return added, removed
+}
+
+func sortBlockIDs(ids []mesh.BlockID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// blockIDSize is the size of an encoded block id
+const blockIDSize = 4
+
+// MarshalBinary encodes the set as a 4 byte big-endian count followed by the sorted 4 byte big-endian block ids
+func (s *Set) MarshalBinary() ([]byte, error) {
+	ids := make([]mesh.BlockID, 0, len(s.values))
+	for _, v := range s.values {
+		ids = append(ids, mesh.BlockID(common.BytesToUint32(v.Bytes())))
+	}
+	sortBlockIDs(ids)
+
+	buf := make([]byte, 4+len(ids)*blockIDSize)
+	binary.BigEndian.PutUint32(buf, uint32(len(ids)))
+	for i, id := range ids {
+		binary.BigEndian.PutUint32(buf[4+i*blockIDSize:], uint32(id))
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary replaces the values of the set with the values decoded from data encoded by MarshalBinary
+func (s *Set) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("set encoding is too short")
+	}
+
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) != uint64(count)*blockIDSize {
+		return fmt.Errorf("set encoding has %v bytes of block ids, expected %v block ids", len(data), count)
+	}
+
+	s.values = make(map[objectId]Value, count)
+	s.isIdValid = false
+	s.isRangeValid = false
+	for i := 0; i < len(data); i += blockIDSize {
+		s.Add(Value{NewBytes32(common.Uint32ToBytes(binary.BigEndian.Uint32(data[i : i+blockIDSize])))})
+	}
+
+	return nil
+}
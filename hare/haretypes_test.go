@@ -1,7 +1,13 @@
 package hare
 
 import (
+	"bytes"
+	"github.com/spacemeshos/go-spacemesh/common"
+	"github.com/spacemeshos/go-spacemesh/mesh"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"math/rand"
 	"testing"
 )
 
@@ -40,6 +46,27 @@ func TestSet_Equals(t *testing.T) {
 	assert.True(t, s2.Equals(s1))
 }
 
+func TestSetsEqual(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	assert.True(t, SetsEqual(nil, nil))
+	assert.False(t, SetsEqual(nil, s))
+	assert.False(t, SetsEqual(s, nil))
+	assert.True(t, SetsEqual(s, NewSetFromValues(value2, value1)))
+	assert.False(t, SetsEqual(s, NewSetFromValues(value1)))
+	assert.True(t, SetsEqual(nil, NewEmptySet(lowDefaultSize)))
+	assert.True(t, SetsEqual(NewEmptySet(lowDefaultSize), nil))
+}
+
+func TestSetIsSubsetOf(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	assert.True(t, SetIsSubsetOf(nil, nil))
+	assert.True(t, SetIsSubsetOf(nil, s))
+	assert.False(t, SetIsSubsetOf(s, nil))
+	assert.True(t, SetIsSubsetOf(NewSetFromValues(value1), s))
+	assert.False(t, SetIsSubsetOf(s, NewSetFromValues(value1)))
+	assert.True(t, SetIsSubsetOf(NewEmptySet(lowDefaultSize), nil))
+}
+
 func TestSet_Id(t *testing.T) {
 	s1 := NewEmptySet(lowDefaultSize)
 	s1.Add(value1)
@@ -97,3 +124,166 @@ func TestSet_Union(t *testing.T) {
 	exp := NewSetFromValues(value1, value2, value3, value4, value5)
 	assert.True(t, exp.Equals(s.Union(g)))
 }
+
+func TestSet_FilterByLayer(t *testing.T) {
+	s := NewSmallEmptySet()
+	for i := 0; i < 10; i++ {
+		s.Add(Value{NewBytes32(mesh.BlockID(i).ToBytes())})
+	}
+	blockToLayer := func(id mesh.BlockID) mesh.LayerID { return mesh.LayerID(id % 3) }
+
+	assert.Equal(t, 4, s.FilterByLayer(0, blockToLayer).Size())
+	assert.Equal(t, 3, s.FilterByLayer(1, blockToLayer).Size())
+	filtered := s.FilterByLayer(2, blockToLayer)
+	assert.True(t, filtered.Equals(NewSetFromValues(Value{NewBytes32(mesh.BlockID(2).ToBytes())},
+		Value{NewBytes32(mesh.BlockID(5).ToBytes())}, Value{NewBytes32(mesh.BlockID(8).ToBytes())})))
+	assert.Equal(t, 0, s.FilterByLayer(3, blockToLayer).Size())
+	assert.Equal(t, 10, s.Size())
+}
+
+func TestSet_MinMaxBlockID(t *testing.T) {
+	blockValue := func(id mesh.BlockID) Value { return Value{NewBytes32(id.ToBytes())} }
+
+	s := NewSmallEmptySet()
+	_, ok := s.MinBlockID()
+	assert.False(t, ok)
+	_, ok = s.MaxBlockID()
+	assert.False(t, ok)
+
+	s.Add(blockValue(7))
+	min, ok := s.MinBlockID()
+	assert.True(t, ok)
+	assert.Equal(t, mesh.BlockID(7), min)
+	max, ok := s.MaxBlockID()
+	assert.True(t, ok)
+	assert.Equal(t, mesh.BlockID(7), max)
+
+	s.Add(blockValue(3))
+	s.Add(blockValue(1000))
+	s.Add(blockValue(12))
+	min, _ = s.MinBlockID()
+	assert.Equal(t, mesh.BlockID(3), min)
+	max, _ = s.MaxBlockID()
+	assert.Equal(t, mesh.BlockID(1000), max)
+
+	// the cached range is updated by changes to the set
+	s.Remove(blockValue(3))
+	s.Remove(blockValue(1000))
+	min, _ = s.MinBlockID()
+	assert.Equal(t, mesh.BlockID(7), min)
+	max, _ = s.MaxBlockID()
+	assert.Equal(t, mesh.BlockID(12), max)
+
+	clone := s.Clone()
+	clone.Add(blockValue(1))
+	min, _ = clone.MinBlockID()
+	assert.Equal(t, mesh.BlockID(1), min)
+	min, _ = s.MinBlockID()
+	assert.Equal(t, mesh.BlockID(7), min)
+
+	s.Remove(blockValue(7))
+	s.Remove(blockValue(12))
+	_, ok = s.MinBlockID()
+	assert.False(t, ok)
+	_, ok = s.MaxBlockID()
+	assert.False(t, ok)
+}
+
+func TestSet_Clone(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	clone := s.Clone()
+	assert.True(t, s.Equals(clone))
+	assert.Equal(t, s.Id(), clone.Id())
+
+	clone.Add(value3)
+	clone.Remove(value1)
+	assert.Equal(t, 2, s.Size())
+	assert.True(t, s.Contains(value1))
+	assert.False(t, s.Contains(value3))
+	assert.NotEqual(t, s.Id(), clone.Id())
+
+	s.Remove(value2)
+	assert.True(t, clone.Contains(value2))
+	assert.True(t, NewEmptySet(lowDefaultSize).Clone().Equals(NewEmptySet(lowDefaultSize)))
+}
+
+func TestSet_Diff(t *testing.T) {
+	s := NewSetFromValues(value1, value2, value3)
+	g := NewSetFromValues(value5, value2, value4, value3)
+	added, removed := s.Diff(g)
+	assert.Equal(t, []mesh.BlockID{4, 5}, added)
+	assert.Equal(t, []mesh.BlockID{1}, removed)
+
+	// identical sets
+	added, removed = s.Diff(s.Clone())
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+
+	// full replacement
+	added, removed = s.Diff(NewSetFromValues(value5, value4))
+	assert.Equal(t, []mesh.BlockID{4, 5}, added)
+	assert.Equal(t, []mesh.BlockID{1, 2, 3}, removed)
+
+	// block ids are sorted numerically and not by their little-endian bytes
+	big := Value{NewBytes32(common.Uint32ToBytes(256))}
+	added, _ = NewSmallEmptySet().Diff(NewSetFromValues(big, value2, value1))
+	assert.Equal(t, []mesh.BlockID{1, 2, 256}, added)
+}
+
+func TestSet_MarshalBinary(t *testing.T) {
+	big := Value{NewBytes32(common.Uint32ToBytes(256))}
+	buf, err := NewSetFromValues(big, value3, value1).MarshalBinary()
+	require.NoError(t, err)
+	// count, then the block ids 1, 3 and 256, all big-endian
+	assert.Equal(t, []byte{0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 1, 0}, buf)
+
+	s := NewSetFromValues(value5)
+	require.NoError(t, s.UnmarshalBinary(buf))
+	assert.True(t, NewSetFromValues(value1, value3, big).Equals(s))
+
+	buf, err = NewSmallEmptySet().MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0}, buf)
+	require.NoError(t, s.UnmarshalBinary(buf))
+	assert.Equal(t, 0, s.Size())
+
+	assert.Error(t, s.UnmarshalBinary([]byte{0, 0}))
+	assert.Error(t, s.UnmarshalBinary([]byte{0, 0, 0, 1}))
+	assert.Error(t, s.UnmarshalBinary([]byte{0, 0, 0, 2, 0, 0, 0, 1}))
+}
+
+func TestSet_MarshalBinaryRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	inputs := [][]uint32{{}, {1, 256}, {0, math.MaxUint32}}
+	for i := 0; i < 100; i++ {
+		ids := make([]uint32, rng.Intn(20))
+		for j := range ids {
+			ids[j] = rng.Uint32()
+		}
+		inputs = append(inputs, ids)
+	}
+
+	for _, ids := range inputs {
+		s := NewSmallEmptySet()
+		for _, id := range ids {
+			s.Add(Value{NewBytes32(common.Uint32ToBytes(id))})
+		}
+
+		buf, err := s.MarshalBinary()
+		require.NoError(t, err)
+		require.Equal(t, 4+4*s.Size(), len(buf))
+		decoded := NewSmallEmptySet()
+		require.NoError(t, decoded.UnmarshalBinary(buf))
+		require.True(t, s.Equals(decoded))
+		require.Equal(t, s.Id(), decoded.Id())
+
+		reencoded, err := decoded.MarshalBinary()
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(buf, reencoded))
+
+		// decoding arbitrary data must not panic
+		data := make([]byte, rng.Intn(40))
+		rng.Read(data)
+		NewSmallEmptySet().UnmarshalBinary(data)
+	}
+}
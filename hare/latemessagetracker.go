@@ -0,0 +1,45 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+	"sync"
+)
+
+// LateMessageTracker counts the messages that arrived after their round has ended
+type LateMessageTracker struct {
+	mutex   sync.RWMutex
+	byRound map[uint32]int
+	byPeer  map[string]int
+}
+
+func NewLateMessageTracker() *LateMessageTracker {
+	lmt := &LateMessageTracker{}
+	lmt.byRound = make(map[uint32]int)
+	lmt.byPeer = make(map[string]int)
+
+	return lmt
+}
+
+// OnLate records msg as a late message that arrived in currentRound
+func (lmt *LateMessageTracker) OnLate(msg *pb.HareMessage, currentRound uint32) {
+	lmt.mutex.Lock()
+	lmt.byRound[currentRound]++
+	lmt.byPeer[string(msg.PubKey)]++
+	lmt.mutex.Unlock()
+}
+
+// LateCount returns the number of late messages that arrived in round
+func (lmt *LateMessageTracker) LateCount(round uint32) int {
+	lmt.mutex.RLock()
+	defer lmt.mutex.RUnlock()
+
+	return lmt.byRound[round]
+}
+
+// LateCountByPeer returns the number of late messages sent by pub
+func (lmt *LateMessageTracker) LateCountByPeer(pub []byte) int {
+	lmt.mutex.RLock()
+	defer lmt.mutex.RUnlock()
+
+	return lmt.byPeer[string(pub)]
+}
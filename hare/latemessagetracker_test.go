@@ -0,0 +1,26 @@
+package hare
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLateMessageTracker_OnLate(t *testing.T) {
+	lmt := NewLateMessageTracker()
+	s := NewSetFromValues(value1)
+	peers := []Signing{generateSigning(t), generateSigning(t), generateSigning(t)}
+
+	lmt.OnLate(BuildProposalMsg(peers[0], s), 3)
+	lmt.OnLate(BuildProposalMsg(peers[0], s), 3)
+	lmt.OnLate(BuildProposalMsg(peers[1], s), 3)
+	lmt.OnLate(BuildProposalMsg(peers[2], s), 7)
+	lmt.OnLate(BuildProposalMsg(peers[0], s), 7)
+
+	assert.Equal(t, 3, lmt.LateCount(3))
+	assert.Equal(t, 2, lmt.LateCount(7))
+	assert.Equal(t, 0, lmt.LateCount(2))
+	assert.Equal(t, 3, lmt.LateCountByPeer(peers[0].Verifier().Bytes()))
+	assert.Equal(t, 1, lmt.LateCountByPeer(peers[1].Verifier().Bytes()))
+	assert.Equal(t, 1, lmt.LateCountByPeer(peers[2].Verifier().Bytes()))
+	assert.Equal(t, 0, lmt.LateCountByPeer(generateSigning(t).Verifier().Bytes()))
+}
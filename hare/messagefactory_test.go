@@ -0,0 +1,95 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+// MessageFactory builds signed, well-formed hare messages of a single sender for tests
+type MessageFactory struct {
+	signing    Signing
+	instanceId InstanceId
+	ki         int32
+}
+
+// NewMessageFactory creates a factory of messages signed by signing for instanceId1
+func NewMessageFactory(signing Signing) *MessageFactory {
+	return &MessageFactory{signing: signing, instanceId: instanceId1, ki: ki}
+}
+
+// SetInstanceId sets the instance of the messages built by the factory
+func (mf *MessageFactory) SetInstanceId(id InstanceId) *MessageFactory {
+	mf.instanceId = id
+	return mf
+}
+
+func (mf *MessageFactory) build(builder *MessageBuilder) *pb.HareMessage {
+	builder.SetInstanceId(mf.instanceId)
+	return builder.SetPubKey(mf.signing.Verifier().Bytes()).Sign(mf.signing).Build()
+}
+
+func (mf *MessageFactory) NewPreRoundMsg(s *Set) *pb.HareMessage {
+	return mf.build(NewMessageBuilder().SetType(PreRound).SetRoundCounter(k).SetKi(mf.ki).SetValues(s))
+}
+
+func (mf *MessageFactory) NewStatusMsg(s *Set, ki int32) *pb.HareMessage {
+	return mf.build(NewMessageBuilder().SetType(Status).SetRoundCounter(Round1).SetKi(ki).SetValues(s))
+}
+
+// NewProposalMsg builds a proposal with the given role proof, svp is optional
+func (mf *MessageFactory) NewProposalMsg(s *Set, roleProof Signature, svp *pb.AggregatedMessages) *pb.HareMessage {
+	builder := NewMessageBuilder().SetRoleProof(roleProof).SetSVP(svp)
+	return mf.build(builder.SetType(Proposal).SetRoundCounter(Round2).SetKi(mf.ki).SetValues(s))
+}
+
+func (mf *MessageFactory) NewCommitMsg(s *Set) *pb.HareMessage {
+	return mf.build(NewMessageBuilder().SetType(Commit).SetRoundCounter(Round3).SetKi(mf.ki).SetValues(s))
+}
+
+// NewNotifyMsg builds a notification of s certified by commits
+func (mf *MessageFactory) NewNotifyMsg(s *Set, commits ...*pb.HareMessage) *pb.HareMessage {
+	cert := &pb.Certificate{Values: s.To2DSlice(), AggMsgs: &pb.AggregatedMessages{Messages: commits}}
+	builder := NewMessageBuilder().SetType(Notify).SetRoundCounter(Round4).SetKi(mf.ki).SetValues(s)
+	return mf.build(builder.SetCertificate(cert))
+}
+
+func TestMessageFactory(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 50; run++ {
+		s := NewSmallEmptySet()
+		for i := 1 + rng.Intn(10); i > 0; i-- {
+			var v Bytes32
+			rng.Read(v[:])
+			s.Add(Value{v})
+		}
+		instance := rng.Uint32()
+		commits := 1 + rng.Intn(10)
+
+		mf := NewMessageFactory(NewMockSigning()).SetInstanceId(InstanceId(instance))
+		statuses := make([]*pb.HareMessage, 0, commits)
+		certified := make([]*pb.HareMessage, 0, commits)
+		for i := 0; i < commits; i++ {
+			signer := NewMessageFactory(NewMockSigning()).SetInstanceId(InstanceId(instance))
+			statuses = append(statuses, signer.NewStatusMsg(s, -1))
+			certified = append(certified, signer.NewCommitMsg(s))
+		}
+
+		validator := newSyntaxContextValidator(NewMockSigning(), commits, validate, validate, log.NewDefault("Validator"))
+		msgs := []*pb.HareMessage{
+			mf.NewPreRoundMsg(s),
+			mf.NewStatusMsg(s, -1),
+			mf.NewProposalMsg(s, Signature{byte(rng.Intn(256))}, &pb.AggregatedMessages{Messages: statuses}),
+			mf.NewCommitMsg(s),
+			mf.NewNotifyMsg(s, certified...),
+		}
+		for _, m := range msgs {
+			typ := MessageType(m.Message.Type).String()
+			require.Equal(t, instance, m.Message.InstanceId, "run %d: %v", run, typ)
+			require.True(t, s.Equals(NewSet(m.Message.Values)), "run %d: %v", run, typ)
+			require.True(t, validator.SyntacticallyValidateMessage(m), "run %d: %v", run, typ)
+		}
+	}
+}
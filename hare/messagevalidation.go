@@ -80,11 +80,12 @@ type syntaxContextValidator struct {
 	signing         Signing
 	threshold       int
 	statusValidator func(m *pb.HareMessage) bool // used to validate status messages in SVP
+	commitValidator func(m *pb.HareMessage) bool // used to validate the signature and role of commits in certificates
 	log.Log
 }
 
-func newSyntaxContextValidator(signing Signing, threshold int, validator func(m *pb.HareMessage) bool, logger log.Log) *syntaxContextValidator {
-	return &syntaxContextValidator{signing, threshold, validator, logger}
+func newSyntaxContextValidator(signing Signing, threshold int, validator func(m *pb.HareMessage) bool, commitValidator func(m *pb.HareMessage) bool, logger log.Log) *syntaxContextValidator {
+	return &syntaxContextValidator{signing, threshold, validator, commitValidator, logger}
 }
 
 // verifies the message is contextually valid
@@ -149,7 +150,7 @@ func (validator *syntaxContextValidator) SyntacticallyValidateMessage(m *pb.Hare
 	case Commit:
 		return claimedRound == Round3
 	case Notify:
-		return validator.validateCertificate(m.Cert)
+		return validator.validateNotify(m)
 	default:
 		validator.Error("Unknown message type encountered during syntactic validator: ", m.Message.Type)
 		return false
@@ -255,6 +256,7 @@ func (validator *syntaxContextValidator) validateSVP(msg *pb.HareMessage) bool {
 	return true
 }
 
+// validateCertificate checks that cert holds threshold signed commits of eligible senders on the values of cert
 func (validator *syntaxContextValidator) validateCertificate(cert *pb.Certificate) bool {
 	if cert == nil {
 		validator.Warning("Certificate validation failed: certificate is nil")
@@ -267,19 +269,18 @@ func (validator *syntaxContextValidator) validateCertificate(cert *pb.Certificat
 		return false
 	}
 
-	// refill values
 	for _, commit := range cert.AggMsgs.Messages {
-		if commit.Message == nil {
+		if commit == nil || commit.Message == nil {
 			validator.Warning("Certificate validation failed: inner commit message is nil")
 			return false
 		}
-
-		commit.Message.Values = cert.Values
 	}
 
-	// Note: no need to validate notify.values=commits.values because we refill the message with notify.values
+	// the values of the commits are kept since they are signed with them
+	s := NewSet(cert.Values)
 	validateSameK := func(m *pb.HareMessage) bool { return m.Message.K == cert.AggMsgs.Messages[0].Message.K }
-	validators := []func(m *pb.HareMessage) bool{validateCommitType, validateSameK}
+	validateSameSet := func(m *pb.HareMessage) bool { return NewSet(m.Message.Values).Equals(s) }
+	validators := []func(m *pb.HareMessage) bool{validateCommitType, validateSameK, validateSameSet, validator.commitValidator}
 	if !validator.validateAggregatedMessage(cert.AggMsgs, validators) {
 		validator.Warning("Certificate validation failed: aggregated messages validation failed")
 		return false
@@ -288,6 +289,22 @@ func (validator *syntaxContextValidator) validateCertificate(cert *pb.Certificat
 	return true
 }
 
+// validateNotify checks that the certificate of a notify message certifies the values of the message
+func (validator *syntaxContextValidator) validateNotify(m *pb.HareMessage) bool {
+	if !validator.validateCertificate(m.Cert) {
+		return false
+	}
+
+	s := NewSet(m.Message.Values)
+	roundCert, err := BuildCertificate(m.Cert.AggMsgs.Messages, s)
+	if err != nil || !VerifyCertificate(roundCert, s, validator.threshold) || !NewSet(m.Cert.Values).Equals(s) {
+		validator.Warning("Notify validation failed: the certificate doesn't certify the notified set")
+		return false
+	}
+
+	return true
+}
+
 func validateCommitType(m *pb.HareMessage) bool {
 	return MessageType(m.Message.Type) == Commit
 }
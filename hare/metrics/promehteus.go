@@ -53,4 +53,12 @@ var (
 		Name:      "total_consensus_processes",
 		Help:      "The total number of current consensus processes running",
 	}, []string{})
+
+	// the number of consensus processes that reached their max rounds without consensus
+	TerminatedWithoutConsensusCounter = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "terminated_without_consensus_counter",
+		Help:      "Number of consensus processes that terminated without consensus",
+	}, []string{})
 )
@@ -7,16 +7,8 @@ import (
 )
 
 func BuildNotifyMsg(signing Signing, s *Set) *pb.HareMessage {
-	builder := NewMessageBuilder()
-	builder.SetType(PreRound).SetInstanceId(instanceId1).SetRoundCounter(Round4).SetKi(ki).SetValues(s)
-	builder = builder.SetPubKey(signing.Verifier().Bytes()).Sign(signing)
-	cert := &pb.Certificate{}
-	cert.Values = NewSetFromValues(value1).To2DSlice()
-	cert.AggMsgs = &pb.AggregatedMessages{}
-	cert.AggMsgs.Messages = []*pb.HareMessage{BuildCommitMsg(signing, s)}
-	builder.SetCertificate(cert)
-
-	return builder.Build()
+	mf := NewMessageFactory(signing)
+	return mf.NewNotifyMsg(s, mf.NewCommitMsg(s))
 }
 
 func TestNotifyTracker_OnNotify(t *testing.T) {
@@ -0,0 +1,65 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+	"sync"
+)
+
+// ParticipantSet accumulates the unique public keys of the senders of the messages processed in an instance
+type ParticipantSet struct {
+	mutex   sync.RWMutex
+	pubKeys map[string][]byte
+	order   []string // keeps the order the participants were first observed
+}
+
+func NewParticipantSet() *ParticipantSet {
+	ps := &ParticipantSet{}
+	ps.Reset()
+
+	return ps
+}
+
+// OnMessage records the sender of msg
+func (ps *ParticipantSet) OnMessage(msg *pb.HareMessage) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	key := string(msg.PubKey)
+	if _, exist := ps.pubKeys[key]; exist {
+		return
+	}
+
+	pub := make([]byte, len(msg.PubKey))
+	copy(pub, msg.PubKey)
+	ps.pubKeys[key] = pub
+	ps.order = append(ps.order, key)
+}
+
+// Participants returns the public keys observed so far in the order they were first observed
+func (ps *ParticipantSet) Participants() [][]byte {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	participants := make([][]byte, 0, len(ps.order))
+	for _, key := range ps.order {
+		participants = append(participants, ps.pubKeys[key])
+	}
+
+	return participants
+}
+
+// ParticipantCount returns the number of unique public keys observed
+func (ps *ParticipantSet) ParticipantCount() int {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	return len(ps.order)
+}
+
+// Reset clears all observed participants
+func (ps *ParticipantSet) Reset() {
+	ps.mutex.Lock()
+	ps.pubKeys = make(map[string][]byte)
+	ps.order = make([]string, 0)
+	ps.mutex.Unlock()
+}
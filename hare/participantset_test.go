@@ -0,0 +1,32 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/hare/pb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParticipantSet_OnMessage(t *testing.T) {
+	ps := NewParticipantSet()
+	s := NewSetFromValues(value1)
+	msgs := make([]*pb.HareMessage, 0, 8)
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, BuildPreRoundMsg(generateSigning(t), s))
+	}
+	msgs = append(msgs, msgs[0], msgs[2], msgs[4]) // duplicates
+
+	for _, m := range msgs {
+		ps.OnMessage(m)
+	}
+
+	assert.Equal(t, 5, ps.ParticipantCount())
+	participants := ps.Participants()
+	assert.Equal(t, 5, len(participants))
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, msgs[i].PubKey, participants[i])
+	}
+
+	ps.Reset()
+	assert.Equal(t, 0, ps.ParticipantCount())
+	assert.Empty(t, ps.Participants())
+}
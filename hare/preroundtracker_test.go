@@ -25,11 +25,7 @@ var value9 = Value{Bytes32{9}}
 var value10 = Value{Bytes32{10}}
 
 func BuildPreRoundMsg(signing Signing, s *Set) *pb.HareMessage {
-	builder := NewMessageBuilder()
-	builder.SetType(PreRound).SetInstanceId(instanceId1).SetRoundCounter(k).SetKi(ki).SetValues(s)
-	builder = builder.SetPubKey(signing.Verifier().Bytes()).Sign(signing)
-
-	return builder.Build()
+	return NewMessageFactory(signing).NewPreRoundMsg(s)
 }
 
 func TestPreRoundTracker_OnPreRound(t *testing.T) {
@@ -2,35 +2,180 @@ package hare
 
 import (
 	"bytes"
+	"context"
 	"github.com/spacemeshos/go-spacemesh/hare/pb"
 	"github.com/spacemeshos/go-spacemesh/log"
+	"math/big"
+	"sync"
 )
 
+// ConflictResolver decides which of two proposals from different leaders is the leading one
+type ConflictResolver interface {
+	// Resolve returns the winner, either current or incoming
+	Resolve(current, incoming *pb.HareMessage) *pb.HareMessage
+}
+
+// roleProofResolver is the default resolver, the proposal with the lower role proof wins and incoming wins a tie
+type roleProofResolver struct{}
+
+func (roleProofResolver) Resolve(current, incoming *pb.HareMessage) *pb.HareMessage {
+	if bytes.Compare(incoming.Message.RoleProof, current.Message.RoleProof) <= 0 {
+		return incoming
+	}
+
+	return current
+}
+
+// StakeWeightedResolver resolves conflicts by the role proof divided by the stake of the sender,
+// the proposal with the lower weighted role proof wins. senders with no stake never win
+type StakeWeightedResolver struct {
+	Stake func(pubKey []byte) uint64
+}
+
+func (r StakeWeightedResolver) Resolve(current, incoming *pb.HareMessage) *pb.HareMessage {
+	inStake := r.Stake(incoming.PubKey)
+	if inStake == 0 {
+		return current
+	}
+	curStake := r.Stake(current.PubKey)
+	if curStake == 0 {
+		return incoming
+	}
+
+	// compare rpIn/stakeIn to rpCur/stakeCur without dividing
+	in := new(big.Int).SetBytes(incoming.Message.RoleProof)
+	in.Mul(in, new(big.Int).SetUint64(curStake))
+	cur := new(big.Int).SetBytes(current.Message.RoleProof)
+	cur.Mul(cur, new(big.Int).SetUint64(inStake))
+	if in.Cmp(cur) < 0 {
+		return incoming
+	}
+
+	return current
+}
+
+// ProposalStats counts the proposals a ProposalTracker received in a round
+type ProposalStats struct {
+	Proposals     int  // proposals received on time with a valid role proof
+	LateProposals int  // late proposals received with a valid role proof
+	Rejected      int  // proposals ignored for a role proof out of range
+	Equivocations int  // equivocations detected
+	Conflicting   bool // true if the round ended with a conflicting proposal
+}
+
+// MetricsReporter exports the proposal statistics of each round
+type MetricsReporter interface {
+	ReportProposalStats(round uint32, stats ProposalStats)
+}
+
 type proposalTracker interface {
 	OnProposal(msg *pb.HareMessage)
 	OnLateProposal(msg *pb.HareMessage)
 	IsConflicting() bool
 	ProposedSet() *Set
+	ResetRound()
 }
 
 type ProposalTracker struct {
 	log.Log
 	proposal      *pb.HareMessage // maps PubKey->Proposal
 	isConflicting bool            // maps PubKey->ConflictStatus
+	bestProposal  *pb.HareMessage // the proposal with the lowest role proof across all rounds
+	minRoleProof  []byte          // nil means no lower bound
+	maxRoleProof  []byte          // nil means no upper bound
+	resolver      ConflictResolver
+	waitMtx       sync.Mutex
+	firstProposal *pb.HareMessage // the first non-conflicting proposal of the round
+	waiters       []proposalWaiter
+	equivocation  func(first, second *pb.HareMessage) // called with the conflicting messages of an equivocation
+	round         uint32                              // number of rounds reset so far
+	stats         ProposalStats                       // stats of the current round
+	reporter      MetricsReporter
+}
+
+// proposalWaiter is a pending WaitForProposal call, done is closed once the proposal was sent
+type proposalWaiter struct {
+	ch   chan *pb.HareMessage
+	done chan struct{}
 }
 
 func NewProposalTracker(log log.Log) *ProposalTracker {
 	pt := &ProposalTracker{}
 	pt.proposal = nil
 	pt.isConflicting = false
+	pt.resolver = roleProofResolver{}
 	pt.Log = log
 
 	return pt
 }
 
+// SetRoleProofRange restricts valid proposals to role proofs in [min, max], a nil bound is unrestricted
+func (pt *ProposalTracker) SetRoleProofRange(min, max []byte) {
+	pt.minRoleProof = min
+	pt.maxRoleProof = max
+}
+
+// SetConflictResolver sets the policy choosing between proposals of different leaders, nil restores the default
+// policy preferring the lower role proof
+func (pt *ProposalTracker) SetConflictResolver(r ConflictResolver) {
+	if r == nil {
+		r = roleProofResolver{}
+	}
+	pt.resolver = r
+}
+
+// SetEquivocationHandler sets the function called with the current proposal and the conflicting message
+// whenever an equivocation is detected
+func (pt *ProposalTracker) SetEquivocationHandler(fn func(first, second *pb.HareMessage)) {
+	pt.equivocation = fn
+}
+
+// SetMetricsReporter sets the reporter the stats of each round are passed to when the round is reset
+func (pt *ProposalTracker) SetMetricsReporter(r MetricsReporter) {
+	pt.reporter = r
+}
+
+// Stats returns the stats of the current round
+func (pt *ProposalTracker) Stats() ProposalStats {
+	stats := pt.stats
+	stats.Conflicting = pt.isConflicting
+	return stats
+}
+
+// reportEquivocation passes an equivocation to the equivocation handler if set
+func (pt *ProposalTracker) reportEquivocation(first, second *pb.HareMessage) {
+	pt.stats.Equivocations++
+	if pt.equivocation != nil {
+		pt.equivocation(first, second)
+	}
+}
+
+// RoleProofValid returns true if rp is in the role proof range of the tracker
+func (pt *ProposalTracker) RoleProofValid(rp []byte) bool {
+	if pt.minRoleProof != nil && bytes.Compare(rp, pt.minRoleProof) < 0 {
+		return false
+	}
+
+	if pt.maxRoleProof != nil && bytes.Compare(rp, pt.maxRoleProof) > 0 {
+		return false
+	}
+
+	return true
+}
+
 func (pt *ProposalTracker) OnProposal(msg *pb.HareMessage) {
+	if !pt.RoleProofValid(msg.Message.RoleProof) {
+		pt.With().Warningw("Role proof out of range, ignoring proposal", log.String("id_sender", string(msg.PubKey)))
+		pt.stats.Rejected++
+		return
+	}
+
+	pt.stats.Proposals++
+	pt.updateBestProposal(msg)
+
 	if pt.proposal == nil { // first leader
 		pt.proposal = msg // just update
+		pt.notifyProposal()
 		return
 	}
 
@@ -42,18 +187,78 @@ func (pt *ProposalTracker) OnProposal(msg *pb.HareMessage) {
 			pt.With().Info("Equivocation detected", log.String("id_malicious", string(msg.PubKey)),
 				log.String("current_set", g.String()), log.String("conflicting_set", s.String()))
 			pt.isConflicting = true
+			pt.reportEquivocation(pt.proposal, msg)
 		}
 
 		return // process done
 	}
 
-	// ignore msgs with higher ranked role proof
-	if bytes.Compare(msg.Message.RoleProof, pt.proposal.Message.RoleProof) > 0 {
+	// ignore msgs losing to the current leader
+	if pt.resolver.Resolve(pt.proposal, msg) != msg {
 		return
 	}
 
 	pt.proposal = msg        // update lower leader msg
 	pt.isConflicting = false // assume no conflict
+	pt.notifyProposal()
+}
+
+// WaitForProposal returns a channel receiving the first non-conflicting proposal of the round.
+// the channel is closed after the proposal is sent, when ctx is done or when the round is reset.
+// the proposal is not sent again if a lower leader or an equivocation later replaces it, callers must check
+// ProposedSet at the end of the round for the final proposal
+func (pt *ProposalTracker) WaitForProposal(ctx context.Context) <-chan *pb.HareMessage {
+	w := proposalWaiter{make(chan *pb.HareMessage, 1), make(chan struct{})}
+
+	pt.waitMtx.Lock()
+	defer pt.waitMtx.Unlock()
+	if pt.firstProposal != nil {
+		w.ch <- pt.firstProposal
+		close(w.ch)
+		return w.ch
+	}
+	pt.waiters = append(pt.waiters, w)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+			return
+		}
+
+		pt.waitMtx.Lock()
+		defer pt.waitMtx.Unlock()
+		for i, other := range pt.waiters {
+			if other.ch == w.ch {
+				pt.waiters = append(pt.waiters[:i], pt.waiters[i+1:]...)
+				close(w.ch)
+				return
+			}
+		}
+	}()
+
+	return w.ch
+}
+
+// notifyProposal sends the current proposal to all waiters if it is the first non-conflicting proposal of the round
+func (pt *ProposalTracker) notifyProposal() {
+	if pt.proposal == nil || pt.isConflicting {
+		return
+	}
+
+	pt.waitMtx.Lock()
+	defer pt.waitMtx.Unlock()
+	if pt.firstProposal != nil {
+		return
+	}
+
+	pt.firstProposal = pt.proposal
+	for _, w := range pt.waiters {
+		w.ch <- pt.firstProposal
+		close(w.ch)
+		close(w.done)
+	}
+	pt.waiters = nil
 }
 
 func (pt *ProposalTracker) OnLateProposal(msg *pb.HareMessage) {
@@ -61,6 +266,12 @@ func (pt *ProposalTracker) OnLateProposal(msg *pb.HareMessage) {
 		return
 	}
 
+	if !pt.RoleProofValid(msg.Message.RoleProof) {
+		pt.stats.Rejected++
+		return
+	}
+
+	pt.stats.LateProposals++
 	// if same sender then we should check for equivocation
 	if bytes.Equal(pt.proposal.PubKey, msg.PubKey) {
 		s := NewSet(msg.Message.Values)
@@ -69,12 +280,13 @@ func (pt *ProposalTracker) OnLateProposal(msg *pb.HareMessage) {
 			pt.With().Info("Equivocation detected", log.String("id_malicious", string(msg.PubKey)),
 				log.String("current_set", g.String()), log.String("conflicting_set", s.String()))
 			pt.isConflicting = true
+			pt.reportEquivocation(pt.proposal, msg)
 		}
 	}
 
 	// not equal check rank
-	// lower ranked proposal on late proposal is a conflict
-	if bytes.Compare(msg.Message.RoleProof, pt.proposal.Message.RoleProof) < 0 {
+	// late proposal winning over the current leader is a conflict
+	if pt.resolver.Resolve(pt.proposal, msg) == msg {
 		pt.With().Info("late lower rank detected", log.String("id_malicious", string(msg.PubKey)))
 		pt.isConflicting = true
 	}
@@ -95,3 +307,34 @@ func (pt *ProposalTracker) ProposedSet() *Set {
 
 	return NewSet(pt.proposal.Message.Values)
 }
+
+func (pt *ProposalTracker) updateBestProposal(msg *pb.HareMessage) {
+	if pt.bestProposal == nil || bytes.Compare(msg.Message.RoleProof, pt.bestProposal.Message.RoleProof) < 0 {
+		pt.bestProposal = msg
+	}
+}
+
+// BestProposal returns the proposal with the lowest role proof seen across all rounds
+func (pt *ProposalTracker) BestProposal() *pb.HareMessage {
+	return pt.bestProposal
+}
+
+// ResetRound clears the proposal of the current round but retains the best proposal.
+// the stats of the round are passed to the metrics reporter if set and the channels of pending waiters are closed
+func (pt *ProposalTracker) ResetRound() {
+	if pt.reporter != nil {
+		pt.reporter.ReportProposalStats(pt.round, pt.Stats())
+	}
+	pt.round++
+	pt.stats = ProposalStats{}
+	pt.proposal = nil
+	pt.isConflicting = false
+	pt.waitMtx.Lock()
+	pt.firstProposal = nil
+	for _, w := range pt.waiters {
+		close(w.ch)
+		close(w.done)
+	}
+	pt.waiters = nil
+	pt.waitMtx.Unlock()
+}
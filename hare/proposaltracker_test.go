@@ -1,18 +1,17 @@
 package hare
 
 import (
+	"bytes"
+	"context"
 	"github.com/spacemeshos/go-spacemesh/hare/pb"
 	"github.com/spacemeshos/go-spacemesh/log"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func buildProposalMsg(signing Signing, s *Set, signature Signature) *pb.HareMessage {
-	builder := NewMessageBuilder().SetRoleProof(signature)
-	builder.SetType(Proposal).SetInstanceId(instanceId1).SetRoundCounter(Round2).SetKi(ki).SetValues(s)
-	builder = builder.SetPubKey(signing.Verifier().Bytes()).Sign(signing)
-
-	return builder.Build()
+	return NewMessageFactory(signing).NewProposalMsg(s, signature, nil)
 }
 
 func BuildProposalMsg(signing Signing, s *Set) *pb.HareMessage {
@@ -75,3 +74,256 @@ func TestProposalTracker_ProposedSet(t *testing.T) {
 	proposedSet = tracker.ProposedSet()
 	assert.Nil(t, proposedSet)
 }
+
+func TestProposalTracker_BestProposal(t *testing.T) {
+	s := NewSetFromValues(value1, value2)
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	assert.Nil(t, tracker.BestProposal())
+
+	// round 1
+	m1 := buildProposalMsg(generateSigning(t), s, []byte{3})
+	tracker.OnProposal(m1)
+	assert.Equal(t, m1, tracker.BestProposal())
+
+	// round 2, lower role proof
+	tracker.ResetRound()
+	assert.Nil(t, tracker.ProposedSet())
+	m2 := buildProposalMsg(generateSigning(t), s, []byte{1})
+	tracker.OnProposal(m2)
+	assert.Equal(t, m2, tracker.BestProposal())
+
+	// round 3, higher role proof
+	tracker.ResetRound()
+	m3 := buildProposalMsg(generateSigning(t), NewSetFromValues(value3), []byte{2})
+	tracker.OnProposal(m3)
+	assert.True(t, tracker.ProposedSet().Equals(NewSetFromValues(value3)))
+	assert.Equal(t, m2, tracker.BestProposal())
+}
+
+func TestProposalTracker_RoleProofRange(t *testing.T) {
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	assert.True(t, tracker.RoleProofValid([]byte{0}))
+	assert.True(t, tracker.RoleProofValid([]byte{255}))
+
+	tracker.SetRoleProofRange([]byte{10}, []byte{20})
+	assert.False(t, tracker.RoleProofValid([]byte{9}))
+	assert.True(t, tracker.RoleProofValid([]byte{10}))
+	assert.True(t, tracker.RoleProofValid([]byte{15}))
+	assert.True(t, tracker.RoleProofValid([]byte{20}))
+	assert.False(t, tracker.RoleProofValid([]byte{20, 0}))
+	assert.False(t, tracker.RoleProofValid([]byte{21}))
+
+	s := NewSetFromValues(value1)
+	tracker.OnProposal(buildProposalMsg(generateSigning(t), s, []byte{9}))
+	assert.Nil(t, tracker.ProposedSet())
+	tracker.OnProposal(buildProposalMsg(generateSigning(t), s, []byte{20}))
+	assert.True(t, tracker.ProposedSet().Equals(s))
+	tracker.OnProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value2), []byte{5}))
+	assert.True(t, tracker.ProposedSet().Equals(s))
+	tracker.OnLateProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value2), []byte{5}))
+	assert.False(t, tracker.IsConflicting())
+	tracker.OnProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value2), []byte{10}))
+	assert.True(t, tracker.ProposedSet().Equals(NewSetFromValues(value2)))
+
+	tracker.SetRoleProofRange(nil, []byte{20})
+	assert.True(t, tracker.RoleProofValid([]byte{0}))
+	assert.False(t, tracker.RoleProofValid([]byte{21}))
+}
+
+// pubKeyResolver prefers the alphabetically first sender
+type pubKeyResolver struct{}
+
+func (pubKeyResolver) Resolve(current, incoming *pb.HareMessage) *pb.HareMessage {
+	if bytes.Compare(incoming.PubKey, current.PubKey) < 0 {
+		return incoming
+	}
+	return current
+}
+
+func TestProposalTracker_SetConflictResolver(t *testing.T) {
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	tracker.SetConflictResolver(pubKeyResolver{})
+
+	msgs := make([]*pb.HareMessage, 5)
+	first := 0
+	for i := range msgs {
+		msgs[i] = buildProposalMsg(generateSigning(t), NewSetFromValues(Value{NewBytes32([]byte{byte(i)})}), []byte{byte(10 - i)})
+		if bytes.Compare(msgs[i].PubKey, msgs[first].PubKey) < 0 {
+			first = i
+		}
+		tracker.OnProposal(msgs[i])
+	}
+	assert.False(t, tracker.IsConflicting())
+	assert.True(t, tracker.ProposedSet().Equals(NewSet(msgs[first].Message.Values)))
+
+	// the lowest role proof doesn't win
+	tracker.ResetRound()
+	tracker.OnProposal(msgs[first])
+	for i := range msgs {
+		if i != first {
+			tracker.OnLateProposal(msgs[i])
+		}
+	}
+	assert.False(t, tracker.IsConflicting())
+
+	tracker.SetConflictResolver(nil)
+	tracker.OnLateProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value1), []byte{0}))
+	assert.True(t, tracker.IsConflicting())
+}
+
+func TestRoleProofResolver_Resolve(t *testing.T) {
+	msg := func(pub string, rp byte) *pb.HareMessage {
+		return &pb.HareMessage{PubKey: []byte(pub), Message: &pb.InnerMessage{RoleProof: []byte{rp}}}
+	}
+
+	a, b := msg("a", 10), msg("b", 30)
+	assert.Equal(t, a, roleProofResolver{}.Resolve(a, b))
+	assert.Equal(t, a, roleProofResolver{}.Resolve(b, a))
+	tie := msg("c", 10)
+	assert.Equal(t, tie, roleProofResolver{}.Resolve(a, tie)) // a tie replaces the leader
+}
+
+func TestStakeWeightedResolver_Resolve(t *testing.T) {
+	stakes := map[string]uint64{"a": 1, "b": 4, "c": 0}
+	r := StakeWeightedResolver{Stake: func(pubKey []byte) uint64 { return stakes[string(pubKey)] }}
+	msg := func(pub string, rp byte) *pb.HareMessage {
+		return &pb.HareMessage{PubKey: []byte(pub), Message: &pb.InnerMessage{RoleProof: []byte{rp}}}
+	}
+
+	a, b := msg("a", 10), msg("b", 30)
+	assert.Equal(t, b, r.Resolve(a, b))
+	assert.Equal(t, b, r.Resolve(b, a))
+	assert.Equal(t, a, r.Resolve(a, msg("b", 40)))
+	assert.Equal(t, a, r.Resolve(a, msg("c", 0)))
+	assert.Equal(t, a, r.Resolve(msg("c", 0), a))
+}
+
+func TestProposalTracker_WaitForProposal(t *testing.T) {
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	ch := tracker.WaitForProposal(context.Background())
+	msg := BuildProposalMsg(generateSigning(t), NewSetFromValues(value1))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tracker.OnProposal(msg)
+	}()
+
+	select {
+	case m := <-ch:
+		assert.Equal(t, msg, m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	// the proposal was already received
+	assert.Equal(t, msg, <-tracker.WaitForProposal(context.Background()))
+
+	// canceled before a proposal arrives
+	tracker.ResetRound()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch = tracker.WaitForProposal(ctx)
+	cancel()
+	_, ok = <-ch
+	assert.False(t, ok)
+}
+
+func TestProposalTracker_WaitForProposalReplaced(t *testing.T) {
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	signing := generateSigning(t)
+	first := buildProposalMsg(signing, NewSetFromValues(value1), Signature{1})
+	tracker.OnProposal(first)
+	assert.Equal(t, first, <-tracker.WaitForProposal(context.Background()))
+
+	// a lower leader replaces the proposal but the first one is still delivered
+	leader := generateSigning(t)
+	lower := buildProposalMsg(leader, NewSetFromValues(value2), Signature{0})
+	tracker.OnProposal(lower)
+	assert.True(t, NewSetFromValues(value2).Equals(tracker.ProposedSet()))
+	assert.Equal(t, first, <-tracker.WaitForProposal(context.Background()))
+
+	// an equivocation makes the round conflicting but the first one is still delivered
+	tracker.OnProposal(buildProposalMsg(leader, NewSetFromValues(value3), Signature{0}))
+	assert.True(t, tracker.IsConflicting())
+	assert.Nil(t, tracker.ProposedSet())
+	assert.Equal(t, first, <-tracker.WaitForProposal(context.Background()))
+}
+
+func TestProposalTracker_ResetRoundClosesWaiters(t *testing.T) {
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	ch := tracker.WaitForProposal(context.Background())
+	tracker.ResetRound()
+	select {
+	case m, ok := <-ch:
+		assert.False(t, ok)
+		assert.Nil(t, m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// a proposal of the next round goes to new waiters only
+	ch = tracker.WaitForProposal(context.Background())
+	msg := BuildProposalMsg(generateSigning(t), NewSetFromValues(value1))
+	tracker.OnProposal(msg)
+	assert.Equal(t, msg, <-ch)
+}
+
+func TestProposalTracker_SetEquivocationHandler(t *testing.T) {
+	var equivocations [][2]*pb.HareMessage
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	tracker.SetEquivocationHandler(func(first, second *pb.HareMessage) {
+		equivocations = append(equivocations, [2]*pb.HareMessage{first, second})
+	})
+
+	signing := generateSigning(t)
+	m1 := BuildProposalMsg(signing, NewSetFromValues(value1))
+	m2 := BuildProposalMsg(signing, NewSetFromValues(value2))
+	m3 := BuildProposalMsg(signing, NewSetFromValues(value3))
+	tracker.OnProposal(m1)
+	tracker.OnProposal(m1)
+	assert.Empty(t, equivocations)
+	tracker.OnProposal(m2)
+	tracker.OnLateProposal(m3)
+	assert.Equal(t, [][2]*pb.HareMessage{{m1, m2}, {m1, m3}}, equivocations)
+}
+
+type mockMetricsReporter struct {
+	rounds []uint32
+	stats  []ProposalStats
+}
+
+func (mr *mockMetricsReporter) ReportProposalStats(round uint32, stats ProposalStats) {
+	mr.rounds = append(mr.rounds, round)
+	mr.stats = append(mr.stats, stats)
+}
+
+func TestProposalTracker_SetMetricsReporter(t *testing.T) {
+	reporter := &mockMetricsReporter{}
+	tracker := NewProposalTracker(log.NewDefault("ProposalTracker"))
+	tracker.SetMetricsReporter(reporter)
+	tracker.SetRoleProofRange([]byte{1}, []byte{5})
+
+	// round 0, an equivocating leader
+	signing := generateSigning(t)
+	tracker.OnProposal(buildProposalMsg(signing, NewSetFromValues(value1), []byte{2}))
+	tracker.OnProposal(buildProposalMsg(signing, NewSetFromValues(value2), []byte{2}))
+	tracker.OnProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value1), []byte{7}))
+	tracker.ResetRound()
+
+	// round 1, a late proposal
+	tracker.OnProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value1), []byte{3}))
+	tracker.OnLateProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value1), []byte{4}))
+	tracker.OnLateProposal(buildProposalMsg(generateSigning(t), NewSetFromValues(value1), []byte{0}))
+	tracker.ResetRound()
+
+	// round 2, no proposals
+	tracker.ResetRound()
+
+	assert.Equal(t, []uint32{0, 1, 2}, reporter.rounds)
+	assert.Equal(t, []ProposalStats{
+		{Proposals: 2, Rejected: 1, Equivocations: 1, Conflicting: true},
+		{Proposals: 1, LateProposals: 1, Rejected: 1},
+		{},
+	}, reporter.stats)
+	assert.Equal(t, ProposalStats{}, tracker.Stats())
+}
@@ -0,0 +1,52 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/log"
+	"sort"
+	"sync"
+)
+
+// ProposalTrackerRegistry holds one ProposalTracker per hare instance
+type ProposalTrackerRegistry struct {
+	log.Log
+	mutex    sync.Mutex
+	trackers map[uint32]*ProposalTracker
+}
+
+func NewProposalTrackerRegistry(log log.Log) *ProposalTrackerRegistry {
+	return &ProposalTrackerRegistry{Log: log, trackers: make(map[uint32]*ProposalTracker)}
+}
+
+// GetOrCreate returns the tracker of the instance, creating one if the instance has none
+func (ptr *ProposalTrackerRegistry) GetOrCreate(instanceID uint32) *ProposalTracker {
+	ptr.mutex.Lock()
+	defer ptr.mutex.Unlock()
+
+	if pt, exist := ptr.trackers[instanceID]; exist {
+		return pt
+	}
+
+	pt := NewProposalTracker(ptr.Log)
+	ptr.trackers[instanceID] = pt
+	return pt
+}
+
+// Remove drops the tracker of the instance
+func (ptr *ProposalTrackerRegistry) Remove(instanceID uint32) {
+	ptr.mutex.Lock()
+	delete(ptr.trackers, instanceID)
+	ptr.mutex.Unlock()
+}
+
+// ActiveInstances returns the sorted ids of the instances that have a tracker
+func (ptr *ProposalTrackerRegistry) ActiveInstances() []uint32 {
+	ptr.mutex.Lock()
+	ids := make([]uint32, 0, len(ptr.trackers))
+	for id := range ptr.trackers {
+		ids = append(ids, id)
+	}
+	ptr.mutex.Unlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,43 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestProposalTrackerRegistry_Parallel(t *testing.T) {
+	registry := NewProposalTrackerRegistry(log.NewDefault("ProposalTrackerRegistry"))
+	instances := 10
+	trackers := make([]*ProposalTracker, instances)
+	signings := make([]Signing, instances)
+	for i := range signings {
+		signings[i] = generateSigning(t)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			tracker := registry.GetOrCreate(uint32(id))
+			tracker.OnProposal(BuildProposalMsg(signings[id], NewSetFromValues(Value{NewBytes32([]byte{byte(id)})})))
+			trackers[id] = tracker
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, registry.ActiveInstances())
+	for i := 0; i < instances; i++ {
+		tracker := registry.GetOrCreate(uint32(i))
+		assert.True(t, tracker == trackers[i])
+		assert.False(t, tracker.IsConflicting())
+		assert.True(t, tracker.ProposedSet().Equals(NewSetFromValues(Value{NewBytes32([]byte{byte(i)})})))
+	}
+
+	registry.Remove(3)
+	registry.Remove(42)
+	assert.Equal(t, []uint32{0, 1, 2, 4, 5, 6, 7, 8, 9}, registry.ActiveInstances())
+	assert.Nil(t, registry.GetOrCreate(3).ProposedSet())
+}
@@ -0,0 +1,48 @@
+package hare
+
+import "sync"
+
+// SetReconciler agrees on the safe values of the local node with the set of a remote node
+type SetReconciler struct {
+	mutex      sync.Mutex
+	local      *Set
+	reconciled *Set
+	union      *Set
+}
+
+func NewSetReconciler(local *Set) *SetReconciler {
+	return &SetReconciler{local: local.Clone()}
+}
+
+// LocalSet returns the set of the local node
+func (sr *SetReconciler) LocalSet() *Set {
+	return sr.local.Clone()
+}
+
+// ReconcileWith returns the values both the local node and the remote node hold
+func (sr *SetReconciler) ReconcileWith(remote *Set) *Set {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	sr.reconciled = sr.local.Intersection(remote)
+	sr.union = sr.local.Union(remote)
+
+	return sr.reconciled.Clone()
+}
+
+// AgreementRatio returns the size of the intersection relative to the size of the union of the last reconciliation.
+// returns 0 if no reconciliation was made
+func (sr *SetReconciler) AgreementRatio() float64 {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if sr.reconciled == nil {
+		return 0
+	}
+
+	if sr.union.Size() == 0 { // both sets are empty
+		return 1
+	}
+
+	return float64(sr.reconciled.Size()) / float64(sr.union.Size())
+}
@@ -0,0 +1,36 @@
+package hare
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSetReconciler_ReconcileWith(t *testing.T) {
+	values := make([]Value, 6)
+	for i := range values {
+		values[i] = Value{NewBytes32([]byte{byte(i + 1)})}
+	}
+
+	// 4 of 5 values are shared
+	local := NewSetFromValues(values[:5]...)
+	remote := NewSetFromValues(values[1:]...)
+
+	node1 := NewSetReconciler(local)
+	node2 := NewSetReconciler(remote)
+	assert.Equal(t, 0.0, node1.AgreementRatio())
+	assert.True(t, node1.LocalSet().Equals(local))
+
+	agreed1 := node1.ReconcileWith(node2.LocalSet())
+	agreed2 := node2.ReconcileWith(node1.LocalSet())
+	assert.True(t, agreed1.Equals(NewSetFromValues(values[1:5]...)))
+	assert.True(t, agreed1.Equals(agreed2))
+	assert.InDelta(t, 0.67, node1.AgreementRatio(), 0.01)
+	assert.Equal(t, node1.AgreementRatio(), node2.AgreementRatio())
+
+	// local set isn't affected by reconciliation
+	assert.True(t, node1.LocalSet().Equals(local))
+
+	node3 := NewSetReconciler(NewSmallEmptySet())
+	assert.Equal(t, 0, node3.ReconcileWith(NewSmallEmptySet()).Size())
+	assert.Equal(t, 1.0, node3.AgreementRatio())
+}
@@ -0,0 +1,54 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/mesh"
+)
+
+// WeightedSet represents a set of block ids where each id carries a vote weight
+type WeightedSet struct {
+	weights             map[mesh.BlockID]uint64
+	totalWeight         uint64
+	expectedTotalWeight uint64
+}
+
+// Constructs an empty weighted set expecting a total weight of expectedTotalWeight
+func NewWeightedSet(expectedTotalWeight uint64) *WeightedSet {
+	ws := &WeightedSet{}
+	ws.weights = make(map[mesh.BlockID]uint64)
+	ws.totalWeight = 0
+	ws.expectedTotalWeight = expectedTotalWeight
+
+	return ws
+}
+
+// Adds id with the provided weight, replaces the weight if id already exist
+func (ws *WeightedSet) AddWithWeight(id mesh.BlockID, weight uint64) {
+	ws.totalWeight -= ws.weights[id]
+	ws.weights[id] = weight
+	ws.totalWeight += weight
+}
+
+// Returns the weight of id, zero if id doesn't exist
+func (ws *WeightedSet) WeightOf(id mesh.BlockID) uint64 {
+	return ws.weights[id]
+}
+
+// Returns the sum of the weights of all ids in the set
+func (ws *WeightedSet) TotalWeight() uint64 {
+	return ws.totalWeight
+}
+
+// Returns true if the total weight is at least threshold of the expected total weight
+func (ws *WeightedSet) WeightedThresholdMet(threshold float64) bool {
+	return float64(ws.totalWeight) >= threshold*float64(ws.expectedTotalWeight)
+}
+
+// Returns a set of the ids, ignoring the weights
+func (ws *WeightedSet) ToSet() *Set {
+	s := NewEmptySet(len(ws.weights))
+	for id := range ws.weights {
+		s.Add(Value{NewBytes32(id.ToBytes())})
+	}
+
+	return s
+}
@@ -0,0 +1,41 @@
+package hare
+
+import (
+	"github.com/spacemeshos/go-spacemesh/mesh"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWeightedSet_AddWithWeight(t *testing.T) {
+	ws := NewWeightedSet(100)
+	ws.AddWithWeight(1, 10)
+	ws.AddWithWeight(2, 20)
+	assert.Equal(t, uint64(10), ws.WeightOf(1))
+	assert.Equal(t, uint64(20), ws.WeightOf(2))
+	assert.Equal(t, uint64(0), ws.WeightOf(3))
+	assert.Equal(t, uint64(30), ws.TotalWeight())
+	ws.AddWithWeight(1, 5)
+	assert.Equal(t, uint64(5), ws.WeightOf(1))
+	assert.Equal(t, uint64(25), ws.TotalWeight())
+}
+
+func TestWeightedSet_WeightedThresholdMet(t *testing.T) {
+	ws := NewWeightedSet(100)
+	ws.AddWithWeight(1, 30)
+	ws.AddWithWeight(2, 29)
+	assert.False(t, ws.WeightedThresholdMet(0.6))
+	ws.AddWithWeight(3, 1)
+	assert.True(t, ws.WeightedThresholdMet(0.6))
+	assert.False(t, ws.WeightedThresholdMet(0.61))
+	assert.True(t, NewWeightedSet(0).WeightedThresholdMet(0.5))
+}
+
+func TestWeightedSet_ToSet(t *testing.T) {
+	ws := NewWeightedSet(10)
+	ws.AddWithWeight(1, 3)
+	ws.AddWithWeight(2, 3)
+	s := ws.ToSet()
+	assert.Equal(t, 2, s.Size())
+	assert.True(t, s.Contains(Value{NewBytes32(mesh.BlockID(1).ToBytes())}))
+	assert.True(t, s.Contains(Value{NewBytes32(mesh.BlockID(2).ToBytes())}))
+}
@@ -0,0 +1,65 @@
+package oracle
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MockCall is a single request made to a MockRequester
+type MockCall struct {
+	Api  string
+	Data string
+}
+
+// MockRequester is a Requester that answers with pre-loaded responses and records all calls
+type MockRequester struct {
+	mtx       sync.Mutex
+	responses map[MockCall][]byte
+	errors    map[MockCall]error
+	calls     []MockCall
+}
+
+// NewMockRequester creates a MockRequester with no responses
+func NewMockRequester() *MockRequester {
+	return &MockRequester{responses: make(map[MockCall][]byte), errors: make(map[MockCall]error)}
+}
+
+// AddResponse sets the response returned for requests of api with data
+func (mr *MockRequester) AddResponse(api, data string, response []byte) {
+	mr.mtx.Lock()
+	mr.responses[MockCall{api, data}] = response
+	mr.mtx.Unlock()
+}
+
+// AddError sets the error returned for requests of api with data
+func (mr *MockRequester) AddError(api, data string, err error) {
+	mr.mtx.Lock()
+	mr.errors[MockCall{api, data}] = err
+	mr.mtx.Unlock()
+}
+
+// Get records the call and returns its pre-loaded error or response, it panics if neither was added for api and data
+func (mr *MockRequester) Get(api, data string) ([]byte, error) {
+	mr.mtx.Lock()
+	defer mr.mtx.Unlock()
+
+	call := MockCall{api, data}
+	mr.calls = append(mr.calls, call)
+	if err, ok := mr.errors[call]; ok {
+		return nil, err
+	}
+	res, ok := mr.responses[call]
+	if !ok {
+		panic(fmt.Sprintf("no response for api %v with data %v", api, data))
+	}
+	return res, nil
+}
+
+// Calls returns all calls made to the requester in order
+func (mr *MockRequester) Calls() []MockCall {
+	mr.mtx.Lock()
+	calls := make([]MockCall, len(mr.calls))
+	copy(calls, mr.calls)
+	mr.mtx.Unlock()
+	return calls
+}
@@ -2,77 +2,170 @@ package oracle
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/spacemeshos/go-spacemesh/crypto"
 	"github.com/spacemeshos/go-spacemesh/log"
 	"io"
 	"math/big"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const Register = "register"
 const Unregister = "unregister"
 const ValidateSingle = "validate"
 const Validate = "validatemap"
+const Health = "health"
 
 const DefaultOracleServerAddress = "http://localhost:3030"
 
+// DefaultRequestRetries is the number of attempts made before the oracle server is considered unreachable
+const DefaultRequestRetries = 3
+
 // ServerAddress is the oracle server we're using
 var ServerAddress = DefaultOracleServerAddress
 
+// ErrOracleUnreachable is returned when the oracle server could not be reached after all retries
+var ErrOracleUnreachable = errors.New("oracle server is unreachable")
+
 func SetServerAddress(addr string) {
 	ServerAddress = addr
 }
 
 type Requester interface {
-	Get(api, data string) []byte
+	Get(api, data string) ([]byte, error)
+}
+
+// ContextRequester is a Requester that can cancel a request when its context is done
+type ContextRequester interface {
+	Requester
+	GetContext(ctx context.Context, api, data string) ([]byte, error)
 }
 
+// RequestLogger is called when an oracle request completes
+type RequestLogger func(reqID string, api string, duration time.Duration, err error)
+
 type HTTPRequester struct {
-	url string
-	c   *http.Client
+	url       string
+	c         *http.Client
+	reqLogger RequestLogger
+	reqCount  uint64
 }
 
 func NewHTTPRequester(url string) *HTTPRequester {
-	return &HTTPRequester{url, &http.Client{}}
+	return &HTTPRequester{url: url, c: &http.Client{}}
+}
+
+// WithRequestLogger sets a logger to be called with the request id and duration of each request
+func (hr *HTTPRequester) WithRequestLogger(fn RequestLogger) *HTTPRequester {
+	hr.reqLogger = fn
+	return hr
 }
 
-func (hr *HTTPRequester) Get(api, data string) []byte {
+// Clone returns a requester for newURL that shares the http client, and so the connection pool and transport
+// settings, and the request logger of hr
+func (hr *HTTPRequester) Clone(newURL string) *HTTPRequester {
+	return &HTTPRequester{url: newURL, c: hr.c, reqLogger: hr.reqLogger}
+}
+
+func (hr *HTTPRequester) Get(api, data string) ([]byte, error) {
+	return hr.GetContext(context.Background(), api, data)
+}
+
+// GetContext sends the request like Get, the request is canceled when ctx is done
+func (hr *HTTPRequester) GetContext(ctx context.Context, api, data string) ([]byte, error) {
+	reqID := strconv.FormatUint(atomic.AddUint64(&hr.reqCount, 1), 10)
+	start := time.Now()
+	res, err := hr.get(ctx, reqID, api, data)
+	log.Debug("Oracle request %v to %v finished. duration: %v err: %v", reqID, api, time.Since(start), err)
+	if hr.reqLogger != nil {
+		hr.reqLogger(reqID, api, time.Since(start), err)
+	}
+	return res, err
+}
+
+func (hr *HTTPRequester) get(ctx context.Context, reqID, api, data string) ([]byte, error) {
 	var jsonStr = []byte(data)
-	log.Debug("Sending oracle request : %s ", jsonStr)
+	log.Debug("Sending oracle request %v : %s ", reqID, jsonStr)
 	req, err := http.NewRequest("POST", hr.url+"/"+api, bytes.NewBuffer(jsonStr))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", reqID)
 
 	resp, err := hr.c.Do(req)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	buf := bytes.NewBuffer([]byte{})
 	_, err = io.Copy(buf, resp.Body)
+	resp.Body.Close()
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	resp.Body.Close()
-	return buf.Bytes()
+	return buf.Bytes(), nil
+}
+
+// LocalEligibilityFallback decides eligibility locally when the oracle server can't be reached
+type LocalEligibilityFallback interface {
+	Eligible(instanceID uint32, committeeSize int, pubKey string) bool
+}
+
+type noopFallback struct {
+}
+
+func (nf noopFallback) Eligible(instanceID uint32, committeeSize int, pubKey string) bool {
+	return false
+}
+
+// OracleClientStats is a snapshot of the runtime statistics of an OracleClient
+type OracleClientStats struct {
+	RegisterCalls           int
+	UnregisterCalls         int
+	EligibleCacheMisses     int
+	EligibleCacheHits       int
+	FailedRequests          int // failed attempts, including ones that were retried
+	LastSuccessfulRequestAt time.Time
+	LastFailedRequestAt     time.Time
 }
 
 // OracleClient is a temporary replacement fot the real oracle. its gets accurate results from a server.
 type OracleClient struct {
-	world  uint64
-	client Requester
+	world    uint64
+	client   Requester
+	retries  int
+	fallback LocalEligibilityFallback
+	ctx      context.Context // requests are canceled when ctx is done
+
+	*clientState
+}
+
+// clientState is the state shared by an OracleClient and the clients derived from it with WithContext
+type clientState struct {
+	healthy    int32 // 1 if the last health check succeeded
+	healthMtx  sync.Mutex
+	healthStop chan struct{}
+
+	statsMtx sync.Mutex
+	stats    OracleClientStats
 
 	eMtx           sync.Mutex
 	instMtx        map[uint32]*sync.Mutex
 	eligibilityMap map[uint32]map[string]struct{}
+	cacheDisabled  int32 // 1 if eligibility is fetched from the server on every query
 }
 
 // NewOracleClient creates a new client to query the oracle. it generates a random worldid
@@ -90,7 +183,126 @@ func NewOracleClientWithWorldID(world uint64) *OracleClient {
 	c := NewHTTPRequester(ServerAddress)
 	instMtx := make(map[uint32]*sync.Mutex)
 	eligibilityMap := make(map[uint32]map[string]struct{})
-	return &OracleClient{world: world, client: c, eligibilityMap: eligibilityMap, instMtx: instMtx}
+	state := &clientState{healthy: 1, eligibilityMap: eligibilityMap, instMtx: instMtx}
+	return &OracleClient{world: world, client: c, retries: DefaultRequestRetries, fallback: noopFallback{}, ctx: context.Background(), clientState: state}
+}
+
+// WithContext returns a client sharing the cache, statistics and health of oc whose requests are canceled when ctx is done
+func (oc *OracleClient) WithContext(ctx context.Context) *OracleClient {
+	c := *oc
+	c.ctx = ctx
+	return &c
+}
+
+// request sends a single request to the oracle server, canceling it if the client's context is done
+func (oc *OracleClient) request(api, data string) ([]byte, error) {
+	if cr, ok := oc.client.(ContextRequester); ok {
+		return cr.GetContext(oc.ctx, api, data)
+	}
+	return oc.client.Get(api, data)
+}
+
+// SetFallback sets the eligibility fallback used when the oracle server is unreachable
+func (oc *OracleClient) SetFallback(f LocalEligibilityFallback) {
+	if f == nil {
+		f = noopFallback{}
+	}
+	oc.fallback = f
+}
+
+// get sends a request to the oracle server, retrying before giving up with ErrOracleUnreachable.
+// returns the context's error once the client's context is done
+func (oc *OracleClient) get(api, data string) ([]byte, error) {
+	for i := 0; i < oc.retries; i++ {
+		if err := oc.ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, err := oc.request(api, data)
+		if err != nil && oc.ctx.Err() != nil {
+			return nil, oc.ctx.Err()
+		}
+		oc.updateStats(func(s *OracleClientStats) {
+			if err != nil {
+				s.FailedRequests++
+				s.LastFailedRequestAt = time.Now()
+			} else {
+				s.LastSuccessfulRequestAt = time.Now()
+			}
+		})
+		if err == nil {
+			return resp, nil
+		}
+		log.Warning("oracle request %v in %v failed (attempt %v/%v) err: %v", api, oc.WorldString(), i+1, oc.retries, err)
+	}
+	return nil, ErrOracleUnreachable
+}
+
+func (oc *OracleClient) updateStats(update func(s *OracleClientStats)) {
+	oc.statsMtx.Lock()
+	update(&oc.stats)
+	oc.statsMtx.Unlock()
+}
+
+// Stats returns a snapshot of the runtime statistics of the client
+func (oc *OracleClient) Stats() OracleClientStats {
+	oc.statsMtx.Lock()
+	defer oc.statsMtx.Unlock()
+	return oc.stats
+}
+
+// HealthCheck sends a single request to the oracle server and returns an error if it can't be reached
+func (oc *OracleClient) HealthCheck() error {
+	_, err := oc.request(Health, "")
+	return err
+}
+
+// StartHealthPolling runs HealthCheck every interval and caches the result for IsHealthy
+func (oc *OracleClient) StartHealthPolling(interval time.Duration) {
+	oc.healthMtx.Lock()
+	defer oc.healthMtx.Unlock()
+	if oc.healthStop != nil {
+		close(oc.healthStop)
+	}
+	stop := make(chan struct{})
+	oc.healthStop = stop
+
+	oc.updateHealth()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				oc.updateHealth()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopHealthPolling stops the polling started by StartHealthPolling
+func (oc *OracleClient) StopHealthPolling() {
+	oc.healthMtx.Lock()
+	if oc.healthStop != nil {
+		close(oc.healthStop)
+		oc.healthStop = nil
+	}
+	oc.healthMtx.Unlock()
+}
+
+func (oc *OracleClient) updateHealth() {
+	if err := oc.HealthCheck(); err != nil {
+		log.Warning("oracle health check in %v failed err: %v", oc.WorldString(), err)
+		atomic.StoreInt32(&oc.healthy, 0)
+		return
+	}
+	atomic.StoreInt32(&oc.healthy, 1)
+}
+
+// IsHealthy returns the result of the last health check, true if no check was made
+func (oc *OracleClient) IsHealthy() bool {
+	return atomic.LoadInt32(&oc.healthy) == 1
 }
 
 // World returns the world this oracle works in
@@ -98,22 +310,62 @@ func (oc *OracleClient) World() uint64 {
 	return oc.world
 }
 
-func registerQuery(world uint64, id string, honest bool) string {
+// WorldString returns a human readable identifier of the world this oracle works in
+func (oc *OracleClient) WorldString() string {
+	return fmt.Sprintf("world-0x%016X", oc.world)
+}
+
+// RegisterQuery returns the JSON body of the register and unregister requests of id in world
+func RegisterQuery(world uint64, id string, honest bool) string {
 	return fmt.Sprintf(`{ "World": %d, "ID": "%v", "Honest": %t }`, world, id, honest)
 }
 
-func validateQuery(world uint64, instid uint32, committeeSize int) string {
-	return fmt.Sprintf(`{ "World": %d, "InstanceID": %d, "CommitteeSize": %d}`, world, instid, committeeSize)
+// ValidateQuery returns the JSON body of the request for the eligible set of an instance in world
+func ValidateQuery(world uint64, instanceID uint32, committeeSize int) string {
+	return fmt.Sprintf(`{ "World": %d, "InstanceID": %d, "CommitteeSize": %d}`, world, instanceID, committeeSize)
 }
 
-// Register asks the oracle server to add this node to the active set
+// ValidateQuery returns the request sent to the oracle server to fetch the eligible set of an instance
+func (oc *OracleClient) ValidateQuery(instanceID uint32, committeeSize int) string {
+	return ValidateQuery(oc.world, instanceID, committeeSize)
+}
+
+// Register asks the oracle server to add this node to the active set. it panics if the server is unreachable,
+// unless the client's context is done
 func (oc *OracleClient) Register(honest bool, id string) {
-	oc.client.Get(Register, registerQuery(oc.world, id, honest))
+	oc.updateStats(func(s *OracleClientStats) { s.RegisterCalls++ })
+	if _, err := oc.get(Register, RegisterQuery(oc.world, id, honest)); err != nil {
+		if err == oc.ctx.Err() {
+			log.Warning("register of %v in %v canceled: %v", id, oc.WorldString(), err)
+			return
+		}
+		panic(err)
+	}
+}
+
+// RegisterAsync asks the oracle server to add this node to the active set without blocking.
+// the returned channel receives nil on success or the final error once all attempts failed
+func (oc *OracleClient) RegisterAsync(honest bool, id string) <-chan error {
+	oc.updateStats(func(s *OracleClientStats) { s.RegisterCalls++ })
+	res := make(chan error, 1)
+	go func() {
+		_, err := oc.get(Register, RegisterQuery(oc.world, id, honest))
+		res <- err
+	}()
+	return res
 }
 
-// Unregister asks the oracle server to de-list this node from the active set
+// Unregister asks the oracle server to de-list this node from the active set. it panics if the server is unreachable,
+// unless the client's context is done
 func (oc *OracleClient) Unregister(honest bool, id string) {
-	oc.client.Get(Unregister, registerQuery(oc.world, id, honest))
+	oc.updateStats(func(s *OracleClientStats) { s.UnregisterCalls++ })
+	if _, err := oc.get(Unregister, RegisterQuery(oc.world, id, honest)); err != nil {
+		if err == oc.ctx.Err() {
+			log.Warning("unregister of %v in %v canceled: %v", id, oc.WorldString(), err)
+			return
+		}
+		panic(err)
+	}
 }
 
 type validRes struct {
@@ -132,10 +384,13 @@ func (oc *OracleClient) ValidateSingle(instanceID []byte, K int, committeeSize i
 	val := int64(h.Hash(append(instanceID, byte(K))))
 
 	req := fmt.Sprintf(`{ "World": %d, "InstanceID": %d, "CommitteeSize": %d, "ID": "%v"}`, oc.world, val, committeeSize, pubKey)
-	resp := oc.client.Get(ValidateSingle, req)
+	resp, err := oc.get(ValidateSingle, req)
+	if err != nil {
+		panic(err)
+	}
 
 	res := &validRes{}
-	err := json.Unmarshal(resp, res)
+	err = json.Unmarshal(resp, res)
 	if err != nil {
 		panic(err)
 	}
@@ -149,31 +404,43 @@ func hashInstanceAndK(instanceID []byte, K int) uint32 {
 	return val
 }
 
-// Eligible checks whether a given ID is in the eligible list or not. it fetches the list once and gives answers locally after that.
-func (oc *OracleClient) Eligible(id uint32, committeeSize int, pubKey string) bool {
-
-	// make special instance ID
+// eligibleSet returns the eligible set of an instance. it fetches the set from the server once and caches it.
+func (oc *OracleClient) eligibleSet(id uint32, committeeSize int) (map[string]struct{}, error) {
+	// a mutex per instance makes concurrent queries of the same instance wait for a single request.
+	// eMtx must not be held while waiting on the instance mutex since the goroutine holding it takes eMtx to cache the result
 	oc.eMtx.Lock()
-	_, mok := oc.instMtx[id]
+	instMtx, mok := oc.instMtx[id]
 	if !mok {
-		oc.instMtx[id] = &sync.Mutex{}
+		instMtx = &sync.Mutex{}
+		oc.instMtx[id] = instMtx
 	}
-	oc.instMtx[id].Lock()
-	if r, ok := oc.eligibilityMap[id]; ok {
+	oc.eMtx.Unlock()
+
+	instMtx.Lock()
+	defer instMtx.Unlock()
+
+	cached := atomic.LoadInt32(&oc.cacheDisabled) == 0
+	if cached {
+		oc.eMtx.Lock()
+		r, ok := oc.eligibilityMap[id]
 		oc.eMtx.Unlock()
-		_, valid := r[pubKey]
-		oc.instMtx[id].Unlock()
-		return valid
+		if ok {
+			oc.updateStats(func(s *OracleClientStats) { s.EligibleCacheHits++ })
+			return r, nil
+		}
+		oc.updateStats(func(s *OracleClientStats) { s.EligibleCacheMisses++ })
 	}
 
-	oc.eMtx.Unlock()
-
-	req := validateQuery(oc.world, id, committeeSize)
+	req := ValidateQuery(oc.world, id, committeeSize)
 
-	resp := oc.client.Get(Validate, req)
+	resp, err := oc.get(Validate, req)
+	if err != nil {
+		// don't cache anything, the server might be back on the next query
+		return nil, err
+	}
 
 	res := &validList{}
-	err := json.Unmarshal(resp, res)
+	err = json.Unmarshal(resp, res)
 	if err != nil {
 		panic(err)
 	}
@@ -184,12 +451,67 @@ func (oc *OracleClient) Eligible(id uint32, committeeSize int, pubKey string) bo
 		elgmap[v] = struct{}{}
 	}
 
-	_, valid := elgmap[pubKey]
+	if cached {
+		oc.eMtx.Lock()
+		oc.eligibilityMap[id] = elgmap
+		oc.eMtx.Unlock()
+	}
 
-	oc.eMtx.Lock()
-	oc.eligibilityMap[id] = elgmap
-	oc.eMtx.Unlock()
-	oc.instMtx[id].Unlock()
+	return elgmap, nil
+}
+
+// DisableCache makes every eligibility query fetch the eligible set from the server without caching it
+func (oc *OracleClient) DisableCache() {
+	atomic.StoreInt32(&oc.cacheDisabled, 1)
+}
+
+// EnableCache restores answering eligibility queries from the sets cached before the cache was disabled
+func (oc *OracleClient) EnableCache() {
+	atomic.StoreInt32(&oc.cacheDisabled, 0)
+}
 
+// Eligible checks whether a given ID is in the eligible list or not. it fetches the list once and gives answers locally after that.
+func (oc *OracleClient) Eligible(id uint32, committeeSize int, pubKey string) bool {
+	elgmap, err := oc.eligibleSet(id, committeeSize)
+	if err != nil {
+		log.Error("could not validate instance %v in %v using oracle server, using local fallback. err: %v", id, oc.WorldString(), err)
+		return oc.fallback.Eligible(id, committeeSize, pubKey)
+	}
+
+	_, valid := elgmap[pubKey]
 	return valid
 }
+
+// ValidateGroup checks whether all pubKeys are in the eligible set of the instance. invalid holds the pubKeys that aren't.
+func (oc *OracleClient) ValidateGroup(instanceID uint32, committeeSize int, pubKeys []string) (valid bool, invalid []string, err error) {
+	elgmap, err := oc.eligibleSet(instanceID, committeeSize)
+	if err != nil {
+		return false, nil, err
+	}
+
+	invalid = make([]string, 0)
+	for _, pk := range pubKeys {
+		if _, ok := elgmap[pk]; !ok {
+			invalid = append(invalid, pk)
+		}
+	}
+
+	return len(invalid) == 0, invalid, nil
+}
+
+// EligibleSet returns the sorted IDs of all the eligible nodes of the instance. it fetches the list once and answers
+// from the cache after that.
+func (oc *OracleClient) EligibleSet(instanceID uint32, committeeSize int) ([]string, error) {
+	elgmap, err := oc.eligibleSet(instanceID, committeeSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(elgmap))
+	for id := range elgmap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
@@ -1,78 +1,80 @@
 package oracle
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/btcsuite/btcutil/base58"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-const TestServerOnline = false
-
 func generateID() string {
 	rnd := make([]byte, 32)
 	rand.Read(rnd)
 	return base58.Encode(rnd)
 }
 
-type requestCounter struct {
-	client     Requester
-	mtx        sync.Mutex
-	count      bool
-	reqCounter int
+type unreachableRequester struct {
 }
 
-func (mcd *requestCounter) Get(api, data string) []byte {
-	var res []byte
-	mcd.mtx.Lock()
-	if mcd.count {
-		mcd.reqCounter++
-	}
-	if mcd.client != nil {
-		res = mcd.client.Get(api, data)
-	}
-	mcd.mtx.Unlock()
-	return res
+func (ur *unreachableRequester) Get(api, data string) ([]byte, error) {
+	return nil, errors.New("connection refused")
 }
 
-func (mcd *requestCounter) setCounting(b bool) {
-	mcd.mtx.Lock()
-	mcd.count = b
-	mcd.mtx.Unlock()
+// flakyRequester fails the first failures requests and then delegates to client
+type flakyRequester struct {
+	client   Requester
+	mtx      sync.Mutex
+	failures int
 }
 
-type mockRequester struct {
-	resMutex sync.Mutex
-	results  map[string][]byte
+func (fr *flakyRequester) Get(api, data string) ([]byte, error) {
+	fr.mtx.Lock()
+	if fr.failures > 0 {
+		fr.failures--
+		fr.mtx.Unlock()
+		return nil, errors.New("connection refused")
+	}
+	fr.mtx.Unlock()
+	return fr.client.Get(api, data)
 }
 
-func (mcd *mockRequester) SetResult(api, data string, res []byte) {
-	mcd.results[api+data] = res
+// vrfFallback computes eligibility locally from a hash of the instance and the pubkey
+type vrfFallback struct {
+	total int
 }
 
-func (mcd *mockRequester) Get(api, data string) []byte {
-	r, ok := mcd.results[api+data]
-	if ok {
-		return r
-	}
-	return nil
+func (vf *vrfFallback) Eligible(instanceID uint32, committeeSize int, pubKey string) bool {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v%v", instanceID, pubKey)))
+	val := binary.LittleEndian.Uint64(h[:8])
+	return float64(val) < float64(math.MaxUint64)*float64(committeeSize)/float64(vf.total)
 }
 
 func Test_MockOracleClientValidate(t *testing.T) {
 	oc := NewOracleClient()
-	mr := &mockRequester{results: make(map[string][]byte)}
+	mr := NewMockRequester()
 	id := generateID()
-	mr.SetResult(Register, id, []byte(`{ "message": "ok" }"`))
-	counter := &requestCounter{client: mr}
-	counter.setCounting(true)
-	oc.client = counter
+	mr.AddResponse(Register, RegisterQuery(oc.world, id, true), []byte(`{ "message": "ok" }"`))
+	oc.client = mr
 	oc.Register(true, id)
-	require.Equal(t, counter.reqCounter, 1)
+	require.Equal(t, []MockCall{{Register, RegisterQuery(oc.world, id, true)}}, mr.Calls())
 
-	mr.SetResult(Validate, validateQuery(oc.world, 0, 2),
+	mr.AddResponse(Validate, ValidateQuery(oc.world, 0, 2),
 		[]byte(fmt.Sprintf(`{ "IDs": [ "%v" ] }`, id)))
 
 	valid := oc.Eligible(0, 2, id)
@@ -81,26 +83,239 @@ func Test_MockOracleClientValidate(t *testing.T) {
 
 	valid = oc.Eligible(0, 2, generateID())
 
-	require.Equal(t, counter.reqCounter, 2)
+	require.Equal(t, []MockCall{{Register, RegisterQuery(oc.world, id, true)}, {Validate, ValidateQuery(oc.world, 0, 2)}}, mr.Calls())
 	require.False(t, valid)
 }
 
-func Test_OracleClientValidate(t *testing.T) {
-	if !TestServerOnline {
-		t.Skip()
+func Test_OracleClientRegisterAsync(t *testing.T) {
+	oc := NewOracleClient()
+	mr := NewMockRequester()
+	id := generateID()
+	mr.AddResponse(Register, RegisterQuery(oc.world, id, true), []byte(`{ "message": "ok" }"`))
+	fr := &flakyRequester{client: mr, failures: 2}
+	oc.client = fr
+
+	select {
+	case err := <-oc.RegisterAsync(true, id):
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	require.Equal(t, 0, fr.failures)
+	require.Equal(t, 1, len(mr.Calls()))
+
+	oc.client = &unreachableRequester{}
+	select {
+	case err := <-oc.RegisterAsync(true, id):
+		require.Equal(t, ErrOracleUnreachable, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
 	}
+}
+
+func Test_OracleClientValidateQuery(t *testing.T) {
+	oc := NewOracleClientWithWorldID(42)
+	require.Equal(t, `{ "World": 42, "InstanceID": 7, "CommitteeSize": 10}`, oc.ValidateQuery(7, 10))
+}
+
+func Test_OracleClientWorldString(t *testing.T) {
+	require.Equal(t, "world-0x0000000000000000", NewOracleClientWithWorldID(0).WorldString())
+	require.Equal(t, "world-0xFFFFFFFFFFFFFFFF", NewOracleClientWithWorldID(math.MaxUint64).WorldString())
+	require.Equal(t, "world-0xDEADBEEFCAFEBABE", NewOracleClientWithWorldID(0xDEADBEEFCAFEBABE).WorldString())
+}
+
+func Test_RegisterQuery(t *testing.T) {
+	require.Equal(t, `{ "World": 3, "ID": "abc", "Honest": true }`, RegisterQuery(3, "abc", true))
+	require.Equal(t, `{ "World": 0, "ID": "", "Honest": false }`, RegisterQuery(0, "", false))
+}
+
+func Test_ValidateQuery(t *testing.T) {
+	require.Equal(t, `{ "World": 42, "InstanceID": 7, "CommitteeSize": 10}`, ValidateQuery(42, 7, 10))
+	require.Equal(t, NewOracleClientWithWorldID(42).ValidateQuery(7, 10), ValidateQuery(42, 7, 10))
+}
+
+func Test_OracleClientFallback(t *testing.T) {
+	oc := NewOracleClient()
+	mr := NewMockRequester()
+	mr.AddError(Validate, ValidateQuery(oc.world, 0, 2), errors.New("connection refused"))
+	oc.client = mr
+
+	id := generateID()
+	require.False(t, oc.Eligible(0, 2, id)) // default fallback
+	require.Equal(t, DefaultRequestRetries, len(mr.Calls()))
+
 	size := 100
 	committee := 30
+	mr.AddError(Validate, ValidateQuery(oc.world, 1, committee), errors.New("connection refused"))
+	fb := &vrfFallback{size}
+	oc.SetFallback(fb)
+	eligible := 0
+	for i := 0; i < size; i++ {
+		pk := generateID()
+		valid := oc.Eligible(1, committee, pk)
+		require.Equal(t, fb.Eligible(1, committee, pk), valid)
+		if valid {
+			eligible++
+		}
+	}
+	assert.True(t, eligible > 0 && eligible < size)
+	_, cached := oc.eligibilityMap[1]
+	assert.False(t, cached)
+}
 
+func Test_OracleClientValidateGroup(t *testing.T) {
 	oc := NewOracleClient()
+	mr := NewMockRequester()
+	oc.client = mr
+
+	eligible := make([]string, 5)
+	for i := range eligible {
+		eligible[i] = fmt.Sprintf(`"%v"`, generateID())
+	}
+	mr.AddResponse(Validate, ValidateQuery(oc.world, 0, 5),
+		[]byte(fmt.Sprintf(`{ "IDs": [ %v ] }`, strings.Join(eligible, ","))))
+
+	group := make([]string, 0, 7)
+	for _, e := range eligible {
+		group = append(group, strings.Trim(e, `"`))
+	}
+	valid, invalid, err := oc.ValidateGroup(0, 5, group)
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Empty(t, invalid)
+
+	ineligible := []string{generateID(), generateID()}
+	group = append([]string{ineligible[0]}, append(group, ineligible[1])...)
+	valid, invalid, err = oc.ValidateGroup(0, 5, group)
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Equal(t, ineligible, invalid)
+	require.Equal(t, 1, len(mr.Calls()))
+
+	oc.client = &unreachableRequester{}
+	_, _, err = oc.ValidateGroup(1, 5, group)
+	require.Equal(t, ErrOracleUnreachable, err)
+}
+
+func Test_OracleClientEligibleSet(t *testing.T) {
+	oc := NewOracleClient()
+	mr := NewMockRequester()
+	oc.client = mr
+
+	eligible := make([]string, 10)
+	quoted := make([]string, 10)
+	for i := range eligible {
+		eligible[i] = generateID()
+		quoted[i] = fmt.Sprintf(`"%v"`, eligible[i])
+	}
+	mr.AddResponse(Validate, ValidateQuery(oc.world, 0, 10),
+		[]byte(fmt.Sprintf(`{ "IDs": [ %v ] }`, strings.Join(quoted, ","))))
+
+	set, err := oc.EligibleSet(0, 10)
+	require.NoError(t, err)
+	require.ElementsMatch(t, eligible, set)
+	require.True(t, sort.StringsAreSorted(set))
+
+	set, err = oc.EligibleSet(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(set))
+	require.Equal(t, 1, len(mr.Calls()))
+
+	oc.client = &unreachableRequester{}
+	_, err = oc.EligibleSet(1, 10)
+	require.Equal(t, ErrOracleUnreachable, err)
+}
+
+func Test_OracleClientDisableCache(t *testing.T) {
+	oc := NewOracleClient()
+	mr := NewMockRequester()
+	oc.client = mr
+	id := generateID()
+	mr.AddResponse(Validate, ValidateQuery(oc.world, 0, 2), []byte(fmt.Sprintf(`{ "IDs": [ "%v" ] }`, id)))
+
+	oc.DisableCache()
+	for i := 0; i < 5; i++ {
+		require.True(t, oc.Eligible(0, 2, id))
+	}
+	require.Equal(t, 5, len(mr.Calls()))
+
+	oc.EnableCache()
+	for i := 0; i < 5; i++ {
+		require.True(t, oc.Eligible(0, 2, id))
+	}
+	require.Equal(t, 6, len(mr.Calls()))
+	require.Equal(t, 4, oc.Stats().EligibleCacheHits)
+}
+
+func TestMockRequester(t *testing.T) {
+	mr := NewMockRequester()
+	mr.AddResponse(Register, "a", []byte("ok"))
+	mr.AddResponse(Validate, "b", []byte("valid"))
+
+	tests := []struct {
+		api  string
+		data string
+		res  []byte
+	}{
+		{Register, "a", []byte("ok")},
+		{Validate, "b", []byte("valid")},
+		{Register, "a", []byte("ok")},
+	}
+	expected := make([]MockCall, 0, len(tests))
+	for _, tt := range tests {
+		res, err := mr.Get(tt.api, tt.data)
+		require.NoError(t, err)
+		require.Equal(t, tt.res, res)
+		expected = append(expected, MockCall{tt.api, tt.data})
+	}
+	require.Equal(t, expected, mr.Calls())
+
+	require.Panics(t, func() { mr.Get(Register, "b") })
+	require.Equal(t, MockCall{Register, "b"}, mr.Calls()[len(tests)])
+
+	unreachable := errors.New("connection refused")
+	mr.AddError(Validate, "c", unreachable)
+	_, err := mr.Get(Validate, "c")
+	require.Equal(t, unreachable, err)
+}
 
+// mockCommittee registers size ids with oc and sets the response of mr to the first committee of them
+func mockCommittee(oc *OracleClient, mr *MockRequester, instanceID uint32, size, committee int) []string {
 	pks := make([]string, size)
+	quoted := make([]string, committee)
+	for i := range pks {
+		pks[i] = generateID()
+		mr.AddResponse(Register, RegisterQuery(oc.world, pks[i], true), []byte(`{ "message": "ok" }`))
+		mr.AddResponse(Unregister, RegisterQuery(oc.world, pks[i], true), []byte(`{ "message": "ok" }`))
+		oc.Register(true, pks[i])
+		if i < committee {
+			quoted[i] = fmt.Sprintf(`"%v"`, pks[i])
+		}
+	}
+	mr.AddResponse(Validate, ValidateQuery(oc.world, instanceID, committee),
+		[]byte(fmt.Sprintf(`{ "IDs": [ %v ] }`, strings.Join(quoted, ","))))
+	return pks
+}
 
-	for i := 0; i < size; i++ {
-		pk := generateID()
-		pks[i] = pk
-		oc.Register(true, pk)
+// countCalls returns the number of calls made to mr for api
+func countCalls(mr *MockRequester, api string) int {
+	count := 0
+	for _, c := range mr.Calls() {
+		if c.Api == api {
+			count++
+		}
 	}
+	return count
+}
+
+func Test_OracleClientValidate(t *testing.T) {
+	size := 100
+	committee := 30
+
+	oc := NewOracleClient()
+	mr := NewMockRequester()
+	oc.client = mr
+	pks := mockCommittee(oc, mr, 0, size, committee)
 
 	incommitte := 0
 
@@ -115,43 +330,254 @@ func Test_OracleClientValidate(t *testing.T) {
 	for i := 0; i < size; i++ {
 		oc.Unregister(true, pks[i])
 	}
+	assert.Equal(t, size, countCalls(mr, Register))
+	assert.Equal(t, 1, countCalls(mr, Validate))
+	assert.Equal(t, size, countCalls(mr, Unregister))
 }
 
 func Test_Concurrency(t *testing.T) {
-	if !TestServerOnline {
-		t.Skip()
-	}
-
 	size := 1000
 	committee := 80
 
 	oc := NewOracleClient()
+	mr := NewMockRequester()
+	oc.client = mr
+	pks := mockCommittee(oc, mr, 0, size, committee)
 
-	pks := make([]string, size)
+	var incommitte int32
+	var wg sync.WaitGroup
+	for i := 0; i < size; i++ {
+		wg.Add(1)
+		go func(pk string) {
+			if oc.Eligible(0, committee, pk) {
+				atomic.AddInt32(&incommitte, 1)
+			}
+			wg.Done()
+		}(pks[i])
+	}
+	wg.Wait()
+	assert.Equal(t, int32(committee), incommitte)
 
 	for i := 0; i < size; i++ {
-		pk := generateID()
-		pks[i] = pk
-		oc.Register(true, pk)
+		oc.Unregister(true, pks[i])
 	}
 
-	incommitte := 0
+	assert.Equal(t, 1, countCalls(mr, Validate))
+}
 
-	mc := &requestCounter{client: oc.client}
+func Test_OracleClientEligibleDedup(t *testing.T) {
+	var calls int32
+	id := generateID()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(fmt.Sprintf(`{ "IDs": [ "%v" ] }`, id)))
+	}))
+	defer srv.Close()
 
-	oc.client = mc
-	mc.setCounting(true)
-	for i := 0; i < size; i++ {
-		if oc.Eligible(0, committee, pks[i]) {
-			incommitte++
+	oc := NewOracleClient()
+	oc.client = NewHTTPRequester(srv.URL)
+
+	var wg sync.WaitGroup
+	for inst := uint32(0); inst < 2; inst++ {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(inst uint32) {
+				assert.True(t, oc.Eligible(inst, 5, id))
+				wg.Done()
+			}(inst)
 		}
 	}
-	assert.Equal(t, incommitte, committee)
-	mc.setCounting(false)
+	wg.Wait()
 
-	for i := 0; i < size; i++ {
-		oc.Unregister(true, pks[i])
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func Test_OracleClientStats(t *testing.T) {
+	oc := NewOracleClient()
+	mr := NewMockRequester()
+	id := generateID()
+	mr.AddResponse(Register, RegisterQuery(oc.world, id, true), []byte(`{ "message": "ok" }`))
+	mr.AddResponse(Unregister, RegisterQuery(oc.world, id, true), []byte(`{ "message": "ok" }`))
+	mr.AddResponse(Validate, ValidateQuery(oc.world, 0, 2), []byte(fmt.Sprintf(`{ "IDs": [ "%v" ] }`, id)))
+	oc.client = &flakyRequester{client: mr, failures: 1}
+	assert.Equal(t, OracleClientStats{}, oc.Stats())
+
+	start := time.Now()
+	oc.Register(true, id)
+	require.NoError(t, <-oc.RegisterAsync(true, id))
+	oc.Unregister(true, id)
+	assert.True(t, oc.Eligible(0, 2, id))
+	assert.False(t, oc.Eligible(0, 2, generateID()))
+	assert.True(t, oc.Eligible(0, 2, id))
+
+	stats := oc.Stats()
+	assert.Equal(t, 2, stats.RegisterCalls)
+	assert.Equal(t, 1, stats.UnregisterCalls)
+	assert.Equal(t, 1, stats.EligibleCacheMisses)
+	assert.Equal(t, 2, stats.EligibleCacheHits)
+	assert.Equal(t, 1, stats.FailedRequests)
+	assert.False(t, stats.LastFailedRequestAt.Before(start))
+	assert.False(t, stats.LastSuccessfulRequestAt.Before(stats.LastFailedRequestAt))
+
+	oc.client = &unreachableRequester{}
+	assert.False(t, oc.Eligible(1, 2, id))
+	stats = oc.Stats()
+	assert.Equal(t, 1+DefaultRequestRetries, stats.FailedRequests)
+	assert.Equal(t, 2, stats.EligibleCacheMisses)
+	assert.True(t, stats.LastFailedRequestAt.After(stats.LastSuccessfulRequestAt))
+}
+
+func Test_HTTPRequesterRequestLogger(t *testing.T) {
+	var hdrMtx sync.Mutex
+	headers := make(map[string]struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdrMtx.Lock()
+		headers[r.Header.Get("X-Request-ID")] = struct{}{}
+		hdrMtx.Unlock()
+		w.Write([]byte(`{ "message": "ok" }`))
+	}))
+	defer srv.Close()
+
+	var logMtx sync.Mutex
+	logged := make(map[string]struct{})
+	hr := NewHTTPRequester(srv.URL).WithRequestLogger(func(reqID string, api string, duration time.Duration, err error) {
+		assert.Equal(t, Register, api)
+		assert.NoError(t, err)
+		logMtx.Lock()
+		logged[reqID] = struct{}{}
+		logMtx.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			_, err := hr.Get(Register, RegisterQuery(1, generateID(), true))
+			assert.NoError(t, err)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, len(logged))
+	assert.Equal(t, logged, headers)
+}
+
+func Test_HTTPRequesterClone(t *testing.T) {
+	newServer := func(name string, conns *int32) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			w.Write([]byte(name))
+		}))
+		srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(conns, 1)
+			}
+		}
+		srv.Start()
+		return srv
+	}
+	var conns1, conns2 int32
+	srv1 := newServer("srv1", &conns1)
+	defer srv1.Close()
+	srv2 := newServer("srv2", &conns2)
+	defer srv2.Close()
+
+	hr1 := NewHTTPRequester(srv1.URL)
+	hr1.c.Transport = &http.Transport{MaxIdleConnsPerHost: 1}
+	hr2 := hr1.Clone(srv2.URL)
+	assert.Equal(t, hr1.c, hr2.c)
+	assert.Equal(t, srv2.URL, hr2.url)
+
+	for i := 0; i < 5; i++ {
+		res, err := hr1.Get(Register, RegisterQuery(1, generateID(), true))
+		require.NoError(t, err)
+		assert.Equal(t, "srv1", string(res))
+		res, err = hr2.Get(Register, RegisterQuery(1, generateID(), true))
+		require.NoError(t, err)
+		assert.Equal(t, "srv2", string(res))
+	}
+
+	// sequential requests reuse the single pooled connection to each server
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns1))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns2))
+}
+
+func Test_OracleClientHealthPolling(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{ "message": "ok" }`))
+	}))
+
+	oc := NewOracleClient()
+	oc.client = NewHTTPRequester(srv.URL)
+	oc.StartHealthPolling(10 * time.Millisecond)
+	defer oc.StopHealthPolling()
+	require.True(t, oc.IsHealthy())
+
+	srv.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for oc.IsHealthy() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.False(t, oc.IsHealthy())
+}
+
+func Test_OracleClientWithContext(t *testing.T) {
+	var block int32 = 1
+	started := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request is only canceled on the server side once its body was read
+		ioutil.ReadAll(r.Body)
+		if atomic.LoadInt32(&block) == 1 {
+			started <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(`{ "IDs": ["a", "b"] }`))
+	}))
+	defer srv.Close()
+
+	oc := NewOracleClientWithWorldID(1)
+	oc.client = NewHTTPRequester(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	coc := oc.WithContext(ctx)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := coc.EligibleSet(1, 10)
+		errs <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request didn't reach the server")
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't canceled")
 	}
 
-	assert.Equal(t, mc.reqCounter, 1)
+	// no more requests are sent once the context is done
+	_, err := coc.EligibleSet(2, 10)
+	assert.Equal(t, context.Canceled, err)
+	assert.NotPanics(t, func() { coc.Register(true, "a") })
+	assert.NotPanics(t, func() { coc.Unregister(true, "a") })
+	assert.Equal(t, 0, len(started))
+
+	// the original client isn't canceled and shares the cache and statistics with the derived client
+	atomic.StoreInt32(&block, 0)
+	ids, err := oc.EligibleSet(1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+	assert.Equal(t, 0, oc.Stats().FailedRequests)
+	assert.Equal(t, 3, oc.Stats().EligibleCacheMisses)
+	assert.Equal(t, 1, coc.Stats().RegisterCalls)
+	ids, err = coc.WithContext(context.Background()).EligibleSet(1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+	assert.Equal(t, 1, oc.Stats().EligibleCacheHits)
 }
@@ -0,0 +1,257 @@
+// Package server implements an in-memory oracle server answering the requests of oracle.OracleClient
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/spacemeshos/go-spacemesh/log"
+	"github.com/spacemeshos/go-spacemesh/oracle"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ErrAlreadyStarted is returned by Start when the server is already serving
+var ErrAlreadyStarted = errors.New("oracle server already started")
+
+// ErrNotStarted is returned by Stop when the server isn't serving
+var ErrNotStarted = errors.New("oracle server not started")
+
+type registerReq struct {
+	World  uint64
+	ID     string
+	Honest bool
+}
+
+type validateReq struct {
+	World         uint64
+	InstanceID    uint32
+	CommitteeSize int
+	ID            string
+}
+
+// world holds the ids registered to a single world
+type world struct {
+	honest    map[string]struct{}
+	dishonest map[string]struct{}
+}
+
+// OracleServer keeps the active set of every world in memory and selects committees from it.
+// a committee always has an honest majority when there are enough honest ids registered
+type OracleServer struct {
+	mtx    sync.Mutex
+	worlds map[uint64]*world
+
+	srvMtx   sync.Mutex
+	srv      *http.Server
+	listener net.Listener
+}
+
+// NewOracleServer creates an OracleServer with no registered ids
+func NewOracleServer() *OracleServer {
+	return &OracleServer{worlds: make(map[uint64]*world)}
+}
+
+// Handler returns the handler serving the oracle api
+func (s *OracleServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+oracle.Register, s.handleRegister)
+	mux.HandleFunc("/"+oracle.Unregister, s.handleUnregister)
+	mux.HandleFunc("/"+oracle.ValidateSingle, s.handleValidateSingle)
+	mux.HandleFunc("/"+oracle.Validate, s.handleValidateMap)
+	mux.HandleFunc("/"+oracle.Health, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"message": "ok"})
+	})
+	return mux
+}
+
+// Start listens on addr and serves the oracle api in the background
+func (s *OracleServer) Start(addr string) error {
+	s.srvMtx.Lock()
+	defer s.srvMtx.Unlock()
+	if s.srv != nil {
+		return ErrAlreadyStarted
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: s.Handler()}
+	s.srv, s.listener = srv, l
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("oracle server stopped err: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server listens on, empty if it isn't started
+func (s *OracleServer) Addr() string {
+	s.srvMtx.Lock()
+	defer s.srvMtx.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Stop closes the listener and all connections of the server
+func (s *OracleServer) Stop() error {
+	s.srvMtx.Lock()
+	defer s.srvMtx.Unlock()
+	if s.srv == nil {
+		return ErrNotStarted
+	}
+
+	err := s.srv.Close()
+	s.srv, s.listener = nil, nil
+	return err
+}
+
+// getOrCreateWorld returns the world with id, creating it if it doesn't exist. must be called under mtx
+func (s *OracleServer) getOrCreateWorld(id uint64) *world {
+	w, ok := s.worlds[id]
+	if !ok {
+		w = &world{honest: make(map[string]struct{}), dishonest: make(map[string]struct{})}
+		s.worlds[id] = w
+	}
+	return w
+}
+
+func (s *OracleServer) handleRegister(w http.ResponseWriter, r *http.Request) {
+	req := &registerReq{}
+	if !readJSON(w, r, req) {
+		return
+	}
+
+	s.mtx.Lock()
+	wrld := s.getOrCreateWorld(req.World)
+	if req.Honest {
+		wrld.honest[req.ID] = struct{}{}
+	} else {
+		wrld.dishonest[req.ID] = struct{}{}
+	}
+	s.mtx.Unlock()
+
+	writeJSON(w, map[string]string{"message": "ok"})
+}
+
+func (s *OracleServer) handleUnregister(w http.ResponseWriter, r *http.Request) {
+	req := &registerReq{}
+	if !readJSON(w, r, req) {
+		return
+	}
+
+	s.mtx.Lock()
+	if wrld, ok := s.worlds[req.World]; ok {
+		if req.Honest {
+			delete(wrld.honest, req.ID)
+		} else {
+			delete(wrld.dishonest, req.ID)
+		}
+	}
+	s.mtx.Unlock()
+
+	writeJSON(w, map[string]string{"message": "ok"})
+}
+
+// readValidateReq reads a validate request, a request with a non positive committee size is rejected with 400
+func readValidateReq(w http.ResponseWriter, r *http.Request) (*validateReq, bool) {
+	req := &validateReq{}
+	if !readJSON(w, r, req) {
+		return nil, false
+	}
+	if req.CommitteeSize <= 0 {
+		http.Error(w, "committee size must be positive", http.StatusBadRequest)
+		return nil, false
+	}
+	return req, true
+}
+
+func (s *OracleServer) handleValidateSingle(w http.ResponseWriter, r *http.Request) {
+	req, ok := readValidateReq(w, r)
+	if !ok {
+		return
+	}
+
+	valid := false
+	for _, id := range s.committee(req.World, req.InstanceID, req.CommitteeSize) {
+		if id == req.ID {
+			valid = true
+			break
+		}
+	}
+	writeJSON(w, map[string]bool{"valid": valid})
+}
+
+func (s *OracleServer) handleValidateMap(w http.ResponseWriter, r *http.Request) {
+	req, ok := readValidateReq(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, map[string][]string{"IDs": s.committee(req.World, req.InstanceID, req.CommitteeSize)})
+}
+
+// committee deterministically selects size ids of world for instance.
+// at most (size-1)/2 dishonest ids are selected as long as there are enough honest ids. the committee of an unknown
+// world is empty
+func (s *OracleServer) committee(worldID uint64, instance uint32, size int) []string {
+	s.mtx.Lock()
+	wrld, ok := s.worlds[worldID]
+	if !ok {
+		s.mtx.Unlock()
+		return []string{}
+	}
+	honest := sortedIDs(wrld.honest)
+	dishonest := sortedIDs(wrld.dishonest)
+	s.mtx.Unlock()
+
+	rng := rand.New(rand.NewSource(int64(worldID) ^ int64(instance)))
+	rng.Shuffle(len(honest), func(i, j int) { honest[i], honest[j] = honest[j], honest[i] })
+	rng.Shuffle(len(dishonest), func(i, j int) { dishonest[i], dishonest[j] = dishonest[j], dishonest[i] })
+
+	numDishonest := min(len(dishonest), (size-1)/2)
+	numHonest := min(len(honest), size-numDishonest)
+	numDishonest = min(len(dishonest), size-numHonest)
+
+	committee := make([]string, 0, numHonest+numDishonest)
+	committee = append(committee, honest[:numHonest]...)
+	return append(committee, dishonest[:numDishonest]...)
+}
+
+func sortedIDs(ids map[string]struct{}) []string {
+	res := make([]string, 0, len(ids))
+	for id := range ids {
+		res = append(res, id)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("oracle server failed writing response err: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spacemeshos/go-spacemesh/oracle"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func startServer(t *testing.T) *OracleServer {
+	srv := NewOracleServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	oracle.SetServerAddress("http://" + srv.Addr())
+	return srv
+}
+
+func TestOracleServer_StartStop(t *testing.T) {
+	srv := NewOracleServer()
+	assert.Equal(t, ErrNotStarted, srv.Stop())
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	assert.Equal(t, ErrAlreadyStarted, srv.Start("127.0.0.1:0"))
+	assert.NotEmpty(t, srv.Addr())
+
+	oracle.SetServerAddress("http://" + srv.Addr())
+	oc := oracle.NewOracleClientWithWorldID(1)
+	assert.NoError(t, oc.HealthCheck())
+
+	require.NoError(t, srv.Stop())
+	assert.Empty(t, srv.Addr())
+	assert.Error(t, oc.HealthCheck())
+}
+
+func TestOracleServer_Eligible(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Stop()
+
+	oc := oracle.NewOracleClientWithWorldID(7)
+	ids := make([]string, 10)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("honest%d", i)
+		oc.Register(true, ids[i])
+	}
+
+	eligible := 0
+	for _, id := range ids {
+		if oc.Eligible(1, 4, id) {
+			eligible++
+		}
+	}
+	assert.Equal(t, 4, eligible)
+
+	// a different world doesn't see the registered ids
+	other := oracle.NewOracleClientWithWorldID(8)
+	assert.False(t, other.Eligible(1, 4, ids[0]))
+
+	// the single validation selects a committee of the same size
+	eligible = 0
+	for _, id := range ids {
+		if oc.ValidateSingle([]byte{1, 2, 3}, 1, 4, nil, id) {
+			eligible++
+		}
+	}
+	assert.Equal(t, 4, eligible)
+}
+
+func TestOracleServer_HonestMajority(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Stop()
+
+	oc := oracle.NewOracleClientWithWorldID(3)
+	for i := 0; i < 5; i++ {
+		oc.Register(true, fmt.Sprintf("honest%d", i))
+		oc.Register(false, fmt.Sprintf("dishonest%d", i))
+	}
+
+	for inst := uint32(0); inst < 10; inst++ {
+		valid, _, err := oc.ValidateGroup(inst, 5, []string{"honest0", "honest1", "honest2", "honest3", "honest4"})
+		require.NoError(t, err)
+		committee := srv.committee(3, inst, 5)
+		assert.Equal(t, 5, len(committee))
+		dishonest := 0
+		for _, id := range committee {
+			if id[0] == 'd' {
+				dishonest++
+			}
+		}
+		assert.Equal(t, 2, dishonest)
+		assert.False(t, valid)
+	}
+
+	oc.Unregister(false, "dishonest0")
+	oc.Unregister(false, "dishonest1")
+	oc.Unregister(false, "dishonest2")
+	oc.Unregister(false, "dishonest3")
+	assert.Equal(t, 5, len(srv.committee(3, 100, 5)))
+	assert.Equal(t, 2, len(srv.committee(3, 100, 2)))
+}
+
+func TestOracleServer_Queries(t *testing.T) {
+	var reg registerReq
+	require.NoError(t, json.Unmarshal([]byte(oracle.RegisterQuery(5, "node", true)), &reg))
+	assert.Equal(t, registerReq{World: 5, ID: "node", Honest: true}, reg)
+	buf, err := json.Marshal(reg)
+	require.NoError(t, err)
+	assert.JSONEq(t, oracle.RegisterQuery(5, "node", true), string(buf))
+
+	var val validateReq
+	require.NoError(t, json.Unmarshal([]byte(oracle.ValidateQuery(5, 9, 20)), &val))
+	assert.Equal(t, validateReq{World: 5, InstanceID: 9, CommitteeSize: 20}, val)
+	buf, err = json.Marshal(struct {
+		World         uint64
+		InstanceID    uint32
+		CommitteeSize int
+	}{val.World, val.InstanceID, val.CommitteeSize})
+	require.NoError(t, err)
+	assert.JSONEq(t, oracle.ValidateQuery(5, 9, 20), string(buf))
+}
+
+func TestOracleServer_InvalidCommitteeSize(t *testing.T) {
+	srv := NewOracleServer()
+	h := srv.Handler()
+	for _, api := range []string{oracle.Validate, oracle.ValidateSingle} {
+		for _, size := range []int{0, -1} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "/"+api, strings.NewReader(oracle.ValidateQuery(1, 1, size))))
+			assert.Equal(t, http.StatusBadRequest, rec.Code, "%v with committee size %v", api, size)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/"+api, strings.NewReader(oracle.ValidateQuery(1, 1, 5))))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+}
+
+func TestOracleServer_QueriesDontCreateWorlds(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Stop()
+
+	oc := oracle.NewOracleClientWithWorldID(9)
+	assert.False(t, oc.Eligible(1, 4, "node"))
+	assert.False(t, oc.ValidateSingle([]byte{1, 2, 3}, 1, 4, nil, "node"))
+	oc.Unregister(true, "node")
+	srv.mtx.Lock()
+	assert.Empty(t, srv.worlds)
+	srv.mtx.Unlock()
+
+	oc.Register(true, "node")
+	assert.True(t, oc.Eligible(2, 4, "node")) // the client caches the committee of instance 1
+	srv.mtx.Lock()
+	assert.Len(t, srv.worlds, 1)
+	srv.mtx.Unlock()
+}
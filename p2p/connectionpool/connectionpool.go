@@ -3,11 +3,67 @@ package connectionpool
 import (
 	"github.com/spacemeshos/go-spacemesh/log"
 	"github.com/spacemeshos/go-spacemesh/p2p/net"
+	"github.com/spacemeshos/go-spacemesh/p2p/node"
 	"github.com/spacemeshos/go-spacemesh/p2p/p2pcrypto"
 
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	inet "net"
+	"sort"
 	"sync"
+	"time"
+)
+
+// ErrNoConnections is returned when an operation requires at least one connection and the pool is empty
+var ErrNoConnections = errors.New("no connections in pool")
+
+// ErrWriteDeadlineExceeded is returned when a send didn't complete within the write deadline
+var ErrWriteDeadlineExceeded = errors.New("write deadline exceeded")
+
+// ErrBlacklistedAddress is returned when the remote address of a connection is in a blacklisted IP range
+var ErrBlacklistedAddress = errors.New("remote address is blacklisted")
+
+// ErrPeerNotFound is returned when there's no connection to the requested peer
+var ErrPeerNotFound = errors.New("peer not found")
+
+// ErrNotStaticConnection is returned when removing a static connection that wasn't added
+var ErrNotStaticConnection = errors.New("not a static connection")
+
+// ErrMessageTooLarge is returned when an incoming message exceeds the message size limit
+var ErrMessageTooLarge = errors.New("message exceeds size limit")
+
+// WaitCanceledError is returned when the context of a caller waiting for a connection is done, Err is the context's error
+type WaitCanceledError struct {
+	Address   string
+	RemotePub p2pcrypto.PublicKey
+	Err       error
+}
+
+func (e *WaitCanceledError) Error() string {
+	return fmt.Sprintf("waiting for connection to %v at %v: %v", e.RemotePub, e.Address, e.Err)
+}
+
+// DefaultMaxDialDuration is the default time a single dial may take before it fails with context.DeadlineExceeded
+const DefaultMaxDialDuration = 30 * time.Second
+
+// DefaultMaxSizeViolations is the default number of oversized messages a peer may send before its connection is closed
+const DefaultMaxSizeViolations = 3
+
+// QualityMaxLatency is the average send latency at which the latency part of a connection's quality score drops to zero
+const QualityMaxLatency = time.Second
+
+// QualityMaxAge is the connection age at which the age part of a connection's quality score drops to zero
+const QualityMaxAge = time.Hour
+
+// weights of the latency, reliability and age parts of the quality score
+const (
+	latencyWeight     = 0.4
+	reliabilityWeight = 0.4
+	ageWeight         = 0.2
 )
 
 type dialResult struct {
@@ -15,6 +71,35 @@ type dialResult struct {
 	err  error
 }
 
+// ConnectionSnapshot is a point-in-time copy of a connection's metadata
+type ConnectionSnapshot struct {
+	PublicKey     p2pcrypto.PublicKey
+	RemoteAddress string
+	Source        net.ConnectionSource
+	SessionID     p2pcrypto.PublicKey
+	EstablishedAt time.Time
+	LastActivity  time.Time
+}
+
+type connectionMeta struct {
+	source        net.ConnectionSource
+	establishedAt time.Time
+	lastActivity  time.Time
+	sends         int
+	okSends       int
+	sendLatency   time.Duration // total latency of all sends
+}
+
+// bufferSizeSetter is implemented by connections that allow setting their socket buffer sizes
+type bufferSizeSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+type sendTimeoutSetter interface {
+	SetSendTimeout(d time.Duration)
+}
+
 type networker interface {
 	Dial(address string, remotePublicKey p2pcrypto.PublicKey) (net.Connection, error) // Connect to a remote node. Can send when no error.
 	SubscribeOnNewRemoteConnections(func(event net.NewConnectionEvent))
@@ -31,11 +116,29 @@ type ConnectionPool struct {
 	localPub    p2pcrypto.PublicKey
 	net         networker
 	connections map[string]net.Connection
+	addresses   map[string]string
+	meta        map[string]*connectionMeta
+	violations  map[string]int
+	maxMsgSize  int
+	maxViolate  int
+	writeDl     time.Duration
+	maxDialDur  time.Duration
+	readBufSize int
+	writeBufSz  int
 	connMutex   sync.RWMutex
+	subs        map[string]chan<- net.NewConnectionEvent
+	muxConns    map[string][]net.Connection
+	muxNext     map[string]int
+	ipBlacklist map[string]*inet.IPNet
+	static      map[string]struct{}
+	subsMutex   sync.RWMutex
 	pending     map[string][]chan dialResult
+	dialCancel  map[string]context.CancelFunc
 	pendMutex   sync.Mutex
 	dialWait    sync.WaitGroup
 	shutdown    bool
+	metrics     *Metrics
+	RetryQueue
 }
 
 // NewConnectionPool creates new ConnectionPool
@@ -44,11 +147,24 @@ func NewConnectionPool(network networker, lPub p2pcrypto.PublicKey) *ConnectionP
 		localPub:    lPub,
 		net:         network,
 		connections: make(map[string]net.Connection),
+		addresses:   make(map[string]string),
+		meta:        make(map[string]*connectionMeta),
+		violations:  make(map[string]int),
+		maxViolate:  DefaultMaxSizeViolations,
+		maxDialDur:  DefaultMaxDialDuration,
 		connMutex:   sync.RWMutex{},
+		subs:        make(map[string]chan<- net.NewConnectionEvent),
+		muxConns:    make(map[string][]net.Connection),
+		muxNext:     make(map[string]int),
+		ipBlacklist: make(map[string]*inet.IPNet),
+		static:      make(map[string]struct{}),
 		pending:     make(map[string][]chan dialResult),
+		dialCancel:  make(map[string]context.CancelFunc),
 		pendMutex:   sync.Mutex{},
 		dialWait:    sync.WaitGroup{},
 		shutdown:    false,
+		metrics:     newMetrics(),
+		RetryQueue:  newRetryQueue(),
 	}
 
 	return cPool
@@ -58,7 +174,9 @@ func (cp *ConnectionPool) OnNewConnection(nce net.NewConnectionEvent) {
 	if cp.isShuttingDown() {
 		return
 	}
-	cp.handleNewConnection(nce.Conn.RemotePublicKey(), nce.Conn, net.Remote)
+	if cp.handleNewConnection(nce.Conn.RemotePublicKey(), nce.Conn, net.Remote) {
+		cp.publishNewConnection(nce)
+	}
 }
 
 func (cp *ConnectionPool) OnClosedConnection(c net.Connection) {
@@ -88,6 +206,7 @@ func (cp *ConnectionPool) Shutdown() {
 	}
 	cp.shutdown = true
 	cp.connMutex.Unlock()
+	close(cp.RetryQueue.quit)
 
 	cp.dialWait.Wait()
 	// we won't handle the closing connection events for these connections since we exit the loop once the teardown is done
@@ -100,6 +219,11 @@ func (cp *ConnectionPool) closeConnections() {
 	for _, c := range cp.connections {
 		c.Close()
 	}
+	for _, conns := range cp.muxConns {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
 	cp.connMutex.Unlock()
 }
 
@@ -109,6 +233,7 @@ func (cp *ConnectionPool) handleDialResult(rPub p2pcrypto.PublicKey, result dial
 		p <- result
 	}
 	delete(cp.pending, rPub.String())
+	delete(cp.dialCancel, rPub.String())
 	cp.pendMutex.Unlock()
 }
 
@@ -116,8 +241,18 @@ func compareConnections(conn1 net.Connection, conn2 net.Connection) int {
 	return bytes.Compare(conn1.Session().ID().Bytes(), conn2.Session().ID().Bytes())
 }
 
-func (cp *ConnectionPool) handleNewConnection(rPub p2pcrypto.PublicKey, newConn net.Connection, source net.ConnectionSource) {
+// handleNewConnection adds newConn to the pool, returns false if the connection was rejected because its remote address is blacklisted
+func (cp *ConnectionPool) handleNewConnection(rPub p2pcrypto.PublicKey, newConn net.Connection, source net.ConnectionSource) bool {
+	cp.applyBufferSizes(newConn)
+	cp.applyWriteDeadline(newConn)
 	cp.connMutex.Lock()
+	if cp.isBlacklisted(newConn.RemoteAddr()) {
+		cp.connMutex.Unlock()
+		cp.net.Logger().Warning("rejecting connection from %s with blacklisted address %v", rPub, newConn.RemoteAddr())
+		newConn.Close()
+		cp.handleDialResult(rPub, dialResult{nil, ErrBlacklistedAddress})
+		return false
+	}
 	var srcPub, dstPub string
 	if source == net.Local {
 		srcPub = cp.localPub.String()
@@ -143,6 +278,7 @@ func (cp *ConnectionPool) handleNewConnection(rPub p2pcrypto.PublicKey, newConn
 			}
 			closeConn = curConn
 			cp.connections[rPub.String()] = newConn
+			cp.setConnectionMeta(rPub.String(), source)
 		} else { // newConn < curConn
 			cp.net.Logger().Info("connection created while connection already exists between peers, closing new connection. existing session ID=%v, new session ID=%v, remote=%s", curConn.Session().ID(), newConn.Session().ID(), rPub)
 			closeConn = newConn
@@ -150,17 +286,71 @@ func (cp *ConnectionPool) handleNewConnection(rPub p2pcrypto.PublicKey, newConn
 		cp.connMutex.Unlock()
 		if closeConn != nil {
 			closeConn.Close()
+			cp.metrics.DuplicateConnClosed.Inc()
 		}
 
 		// we don't need to update on the new connection since there were already a connection in the table and there shouldn't be any registered channel waiting for updates
-		return
+		return true
 	}
 	cp.connections[rPub.String()] = newConn
+	cp.setConnectionMeta(rPub.String(), source)
+	cp.metrics.ConnCount.Set(float64(len(cp.connections)))
 	cp.connMutex.Unlock()
 
 	// update all registered channels
 	res := dialResult{newConn, nil}
 	cp.handleDialResult(rPub, res)
+	return true
+}
+
+// BlacklistIPRange rejects new connections from remote addresses in the given CIDR range (e.g. "10.0.0.0/8")
+func (cp *ConnectionPool) BlacklistIPRange(cidr string) error {
+	_, ipNet, err := inet.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	cp.connMutex.Lock()
+	cp.ipBlacklist[ipNet.String()] = ipNet
+	cp.connMutex.Unlock()
+	return nil
+}
+
+// UnblacklistIPRange removes a CIDR range previously added with BlacklistIPRange
+func (cp *ConnectionPool) UnblacklistIPRange(cidr string) {
+	_, ipNet, err := inet.ParseCIDR(cidr)
+	if err != nil {
+		return
+	}
+	cp.connMutex.Lock()
+	delete(cp.ipBlacklist, ipNet.String())
+	cp.connMutex.Unlock()
+}
+
+// isBlacklisted checks addr against the blacklisted ranges, must be called under connMutex
+func (cp *ConnectionPool) isBlacklisted(addr inet.Addr) bool {
+	if addr == nil || len(cp.ipBlacklist) == 0 {
+		return false
+	}
+	host, _, err := inet.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := inet.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range cp.ipBlacklist {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setConnectionMeta resets the metadata of the connection to rPub, must be called under connMutex
+func (cp *ConnectionPool) setConnectionMeta(rPub string, source net.ConnectionSource) {
+	now := time.Now()
+	cp.meta[rPub] = &connectionMeta{source: source, establishedAt: now, lastActivity: now}
 }
 
 func (cp *ConnectionPool) handleClosedConnection(conn net.Connection) {
@@ -171,12 +361,111 @@ func (cp *ConnectionPool) handleClosedConnection(conn net.Connection) {
 	// only delete if the closed connection is the same as the cached one (it is possible that the closed connection is a duplication and therefore was closed)
 	if ok && cur.ID() == conn.ID() {
 		delete(cp.connections, rPub)
+		delete(cp.meta, rPub)
+		delete(cp.violations, rPub)
+		cp.metrics.ConnCount.Set(float64(len(cp.connections)))
 	}
 	cp.connMutex.Unlock()
 }
 
+// SetMessageSizeLimit sets the maximal size of an incoming message accepted by CheckIncomingMessage, 0 means no limit
+func (cp *ConnectionPool) SetMessageSizeLimit(maxBytes int) {
+	cp.connMutex.Lock()
+	cp.maxMsgSize = maxBytes
+	cp.connMutex.Unlock()
+}
+
+// SetMaxSizeViolations sets the number of oversized messages a peer may send before its connection is closed
+func (cp *ConnectionPool) SetMaxSizeViolations(n int) {
+	cp.connMutex.Lock()
+	cp.maxViolate = n
+	cp.connMutex.Unlock()
+}
+
+// CheckIncomingMessage returns ErrMessageTooLarge if the message exceeds the message size limit and should be discarded.
+// the connection of a peer that sent more oversized messages than the max size violations is closed
+func (cp *ConnectionPool) CheckIncomingMessage(ime net.IncomingMessageEvent) error {
+	cp.connMutex.Lock()
+	if cp.maxMsgSize == 0 || len(ime.Message) <= cp.maxMsgSize {
+		cp.connMutex.Unlock()
+		return nil
+	}
+	rPub := ime.Conn.RemotePublicKey().String()
+	cp.violations[rPub]++
+	violations, limit, maxViolations := cp.violations[rPub], cp.maxMsgSize, cp.maxViolate
+	cp.connMutex.Unlock()
+
+	cp.net.Logger().Warning("discarding message of %v bytes from %s exceeding the limit of %v bytes (%v/%v)", len(ime.Message), rPub, limit, violations, maxViolations)
+	if violations > maxViolations {
+		ime.Conn.Close()
+		cp.handleClosedConnection(ime.Conn)
+	}
+	return ErrMessageTooLarge
+}
+
+// SetMaxDialDuration sets the time a single dial may take before it fails with context.DeadlineExceeded
+func (cp *ConnectionPool) SetMaxDialDuration(d time.Duration) {
+	cp.connMutex.Lock()
+	cp.maxDialDur = d
+	cp.connMutex.Unlock()
+}
+
+// dial dials the remote peer and gives up after the max dial duration, a connection established after that is closed
+func (cp *ConnectionPool) dial(address string, remotePub p2pcrypto.PublicKey) (net.Connection, error) {
+	return cp.dialContext(context.Background(), address, remotePub)
+}
+
+// dialContext is like dial but also gives up when ctx is done
+func (cp *ConnectionPool) dialContext(parent context.Context, address string, remotePub p2pcrypto.PublicKey) (net.Connection, error) {
+	cp.connMutex.RLock()
+	d := cp.maxDialDur
+	cp.connMutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(parent, d)
+	defer cancel()
+
+	res := make(chan dialResult, 1)
+	go func() {
+		conn, err := cp.net.Dial(address, remotePub)
+		res <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-res:
+		return r.conn, r.err
+	case <-ctx.Done():
+	}
+
+	if parent.Err() == nil {
+		cp.net.Logger().Warning("dial to %v at %v didn't complete within %v", remotePub, address, d)
+	}
+	go func() {
+		if r := <-res; r.err == nil {
+			r.conn.Close()
+		}
+	}()
+	return nil, ctx.Err()
+}
+
 // GetConnection fetches or creates if don't exist a connection to the address which is associated with the remote public key
 func (cp *ConnectionPool) GetConnection(address string, remotePub p2pcrypto.PublicKey) (net.Connection, error) {
+	return cp.GetConnectionWithContext(context.Background(), address, remotePub)
+}
+
+// GetConnectionWithContext is like GetConnection but stops waiting for the connection when ctx is done. the pending
+// dial is canceled if no one else is waiting for it
+func (cp *ConnectionPool) GetConnectionWithContext(ctx context.Context, address string, remotePub p2pcrypto.PublicKey) (net.Connection, error) {
+	return cp.getConnection(ctx, address, remotePub, RetryPolicy{MaxAttempts: 1})
+}
+
+// GetConnectionWithRetry is like GetConnectionWithContext but if it starts a dial, the dial is retried according to
+// policy before its error is returned to everyone waiting for the connection. a caller joining a pending dial
+// waits for it as is
+func (cp *ConnectionPool) GetConnectionWithRetry(ctx context.Context, address string, remotePub p2pcrypto.PublicKey, policy RetryPolicy) (net.Connection, error) {
+	return cp.getConnection(ctx, address, remotePub, policy)
+}
+
+func (cp *ConnectionPool) getConnection(ctx context.Context, address string, remotePub p2pcrypto.PublicKey, policy RetryPolicy) (net.Connection, error) {
 	cp.connMutex.RLock()
 	if cp.shutdown {
 		cp.connMutex.RUnlock()
@@ -191,28 +480,73 @@ func (cp *ConnectionPool) GetConnection(address string, remotePub p2pcrypto.Publ
 	// register for signal when connection is established - must be called under the connMutex otherwise there is a race
 	// where it is possible that the connection will be established and all registered channels will be notified before
 	// the current registration
+	key := remotePub.String()
 	cp.pendMutex.Lock()
-	_, found = cp.pending[remotePub.String()]
-	pendChan := make(chan dialResult)
-	cp.pending[remotePub.String()] = append(cp.pending[remotePub.String()], pendChan)
+	_, found = cp.pending[key]
+	// buffered so the result can be delivered after the caller stopped waiting
+	pendChan := make(chan dialResult, 1)
+	cp.pending[key] = append(cp.pending[key], pendChan)
 	if !found {
 		// No one is waiting for a connection with the remote peer, need to call Dial
+		dialCtx, cancel := context.WithCancel(context.Background())
+		cp.dialCancel[key] = cancel
 		go func() {
 			cp.dialWait.Add(1)
-			conn, err := cp.net.Dial(address, remotePub)
+			defer cancel()
+			conn, err := cp.dialWithRetry(dialCtx, address, remotePub, policy)
 			if err != nil {
-				cp.handleDialResult(remotePub, dialResult{nil, err})
+				// a dial canceled by its waiters has no one to report to
+				if dialCtx.Err() == nil {
+					cp.handleDialResult(remotePub, dialResult{nil, err})
+					cp.scheduleRetry(address, remotePub, 0)
+				}
 			} else {
-				cp.handleNewConnection(remotePub, conn, net.Local)
+				cp.connMutex.Lock()
+				cp.addresses[key] = address
+				cp.connMutex.Unlock()
+				if cp.handleNewConnection(remotePub, conn, net.Local) {
+					cp.publishNewConnection(net.NewConnectionEvent{Conn: conn, Node: node.New(remotePub, address)})
+				}
 			}
 			cp.dialWait.Done()
 		}()
 	}
 	cp.pendMutex.Unlock()
 	cp.connMutex.RUnlock()
-	// wait for the connection to be established, if the channel is closed (in case of dialing error) will return nil
-	res := <-pendChan
-	return res.conn, res.err
+
+	select {
+	case res := <-pendChan:
+		return res.conn, res.err
+	case <-ctx.Done():
+	}
+
+	cp.pendMutex.Lock()
+	waiting := false
+	waiters := cp.pending[key]
+	for i, ch := range waiters {
+		if ch == pendChan {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			waiting = true
+			break
+		}
+	}
+	if waiting && len(waiters) == 0 {
+		delete(cp.pending, key)
+		if cancel, found := cp.dialCancel[key]; found {
+			cancel()
+			delete(cp.dialCancel, key)
+		}
+	} else if waiting {
+		cp.pending[key] = waiters
+	}
+	cp.pendMutex.Unlock()
+
+	if !waiting {
+		// the result was delivered while ctx was done
+		res := <-pendChan
+		return res.conn, res.err
+	}
+	return nil, &WaitCanceledError{Address: address, RemotePub: remotePub, Err: ctx.Err()}
 }
 
 // GetConnectionIfExists checks if the connection is exists or pending
@@ -246,3 +580,516 @@ func (cp *ConnectionPool) GetConnectionIfExists(remotePub p2pcrypto.PublicKey) (
 	res := <-pendChan
 	return res.conn, res.err
 }
+
+// GetRandom returns a random connection from the pool, picked using rng
+func (cp *ConnectionPool) GetRandom(rng *rand.Rand) (p2pcrypto.PublicKey, net.Connection, error) {
+	cp.connMutex.RLock()
+	conns := make([]net.Connection, 0, len(cp.connections))
+	for _, c := range cp.connections {
+		conns = append(conns, c)
+	}
+	cp.connMutex.RUnlock()
+
+	if len(conns) == 0 {
+		return nil, nil, ErrNoConnections
+	}
+
+	conn := conns[rng.Intn(len(conns))]
+	return conn.RemotePublicKey(), conn, nil
+}
+
+// UpdateAddress replaces the connection to the remote public key with a new connection to newAddr.
+// The existing connection keeps serving GetConnection until the new one is established, only then it is closed.
+// if the remote address of the new connection is blacklisted it is closed and the existing connection is kept
+func (cp *ConnectionPool) UpdateAddress(pub p2pcrypto.PublicKey, newAddr string) error {
+	if cp.isShuttingDown() {
+		return errors.New("ConnectionPool was shut down")
+	}
+
+	cp.dialWait.Add(1)
+	defer cp.dialWait.Done()
+	conn, err := cp.dial(newAddr, pub)
+	if err != nil {
+		return err
+	}
+
+	cp.applyBufferSizes(conn)
+	cp.applyWriteDeadline(conn)
+	cp.connMutex.Lock()
+	if cp.shutdown {
+		cp.connMutex.Unlock()
+		conn.Close()
+		return errors.New("ConnectionPool was shut down")
+	}
+	if cp.isBlacklisted(conn.RemoteAddr()) {
+		cp.connMutex.Unlock()
+		cp.net.Logger().Warning("not updating address of %s, new connection has blacklisted address %v", pub, conn.RemoteAddr())
+		conn.Close()
+		return ErrBlacklistedAddress
+	}
+	oldConn, found := cp.connections[pub.String()]
+	cp.connections[pub.String()] = conn
+	cp.addresses[pub.String()] = newAddr
+	cp.setConnectionMeta(pub.String(), net.Local)
+	cp.connMutex.Unlock()
+
+	cp.net.Logger().Info("address of %s updated to %s. id=%s, sessionID=%v", pub, newAddr, conn.ID(), conn.Session().ID())
+	if found {
+		oldConn.Close()
+	}
+
+	// release anyone waiting for a connection with the remote peer
+	cp.handleDialResult(pub, dialResult{conn, nil})
+	return nil
+}
+
+// ConnectAll concurrently fetches or creates connections to all peers and blocks until every dial completes or ctx is done.
+// results are returned in the same order as peers, peers that weren't connected when ctx is done get ctx's error
+func (cp *ConnectionPool) ConnectAll(ctx context.Context, peers []node.Node) ([]net.Connection, []error) {
+	conns := make([]net.Connection, len(peers))
+	errs := make([]error, len(peers))
+
+	type connectResult struct {
+		idx int
+		dialResult
+	}
+	results := make(chan connectResult, len(peers))
+	for i, p := range peers {
+		go func(idx int, peer node.Node) {
+			conn, err := cp.GetConnectionWithContext(ctx, peer.Address(), peer.PublicKey())
+			results <- connectResult{idx, dialResult{conn, err}}
+		}(i, p)
+	}
+
+	done := make([]bool, len(peers))
+	for i := 0; i < len(peers); i++ {
+		select {
+		case res := <-results:
+			conns[res.idx], errs[res.idx] = res.conn, res.err
+			done[res.idx] = true
+		case <-ctx.Done():
+			for idx := range peers {
+				if !done[idx] {
+					errs[idx] = ctx.Err()
+				}
+			}
+			return conns, errs
+		}
+	}
+
+	return conns, errs
+}
+
+// WarmUp concurrently connects to all seeds so the first requests don't wait for a dial, and returns the number of
+// seeds connected. failed dials are logged and otherwise ignored
+func (cp *ConnectionPool) WarmUp(ctx context.Context, seeds []node.Node) int {
+	_, errs := cp.ConnectAll(ctx, seeds)
+	connected := 0
+	for i, err := range errs {
+		if err != nil {
+			cp.net.Logger().Warning("warm up failed to connect to %v at %v: %v", seeds[i].PublicKey(), seeds[i].Address(), err)
+			continue
+		}
+		connected++
+	}
+
+	return connected
+}
+
+// LastActivity records that a message was just sent or received on the connection to pub
+func (cp *ConnectionPool) LastActivity(pub p2pcrypto.PublicKey) {
+	cp.connMutex.Lock()
+	if m, found := cp.meta[pub.String()]; found {
+		m.lastActivity = time.Now()
+	}
+	cp.connMutex.Unlock()
+}
+
+// AddStaticConnection connects to pub at address and marks the connection as static, static connections are never
+// evicted by EvictIdle. pub stays static after reconnecting until RemoveStaticConnection is called
+func (cp *ConnectionPool) AddStaticConnection(address string, pub p2pcrypto.PublicKey) error {
+	if _, err := cp.GetConnection(address, pub); err != nil {
+		return err
+	}
+
+	cp.connMutex.Lock()
+	cp.static[pub.String()] = struct{}{}
+	cp.connMutex.Unlock()
+	return nil
+}
+
+// RemoveStaticConnection unmarks the connection to pub as static, the connection itself stays open
+func (cp *ConnectionPool) RemoveStaticConnection(pub p2pcrypto.PublicKey) error {
+	cp.connMutex.Lock()
+	defer cp.connMutex.Unlock()
+	if _, found := cp.static[pub.String()]; !found {
+		return ErrNotStaticConnection
+	}
+	delete(cp.static, pub.String())
+	return nil
+}
+
+// EvictIdle closes all non static connections with no activity in the last ttl and returns the number of closed connections
+func (cp *ConnectionPool) EvictIdle(ttl time.Duration) int {
+	now := time.Now()
+	evicted := make([]net.Connection, 0)
+	cp.connMutex.Lock()
+	for pub, conn := range cp.connections {
+		if _, found := cp.static[pub]; found {
+			continue
+		}
+		if m, found := cp.meta[pub]; found && now.Sub(m.lastActivity) > ttl {
+			evicted = append(evicted, conn)
+			delete(cp.connections, pub)
+			delete(cp.meta, pub)
+			delete(cp.violations, pub)
+		}
+	}
+	cp.metrics.ConnCount.Set(float64(len(cp.connections)))
+	cp.connMutex.Unlock()
+
+	for _, conn := range evicted {
+		cp.net.Logger().Debug("evicting idle connection %v with %v", conn.String(), conn.RemotePublicKey().String())
+		conn.Close()
+	}
+	return len(evicted)
+}
+
+// ConnectionAge returns the time since the connection to pub was established
+func (cp *ConnectionPool) ConnectionAge(pub p2pcrypto.PublicKey) (time.Duration, error) {
+	cp.connMutex.RLock()
+	defer cp.connMutex.RUnlock()
+	if _, found := cp.connections[pub.String()]; !found {
+		return 0, ErrPeerNotFound
+	}
+	m, found := cp.meta[pub.String()]
+	if !found {
+		return 0, ErrPeerNotFound
+	}
+	return time.Since(m.establishedAt), nil
+}
+
+// OldestConnection returns the peer with the longest established connection and its age
+func (cp *ConnectionPool) OldestConnection() (p2pcrypto.PublicKey, time.Duration, error) {
+	return cp.connectionByAge(func(age, other time.Duration) bool { return age > other })
+}
+
+// NewestConnection returns the peer with the most recently established connection and its age
+func (cp *ConnectionPool) NewestConnection() (p2pcrypto.PublicKey, time.Duration, error) {
+	return cp.connectionByAge(func(age, other time.Duration) bool { return age < other })
+}
+
+// connectionByAge returns the connection whose age is preferred over all others by better
+func (cp *ConnectionPool) connectionByAge(better func(age, other time.Duration) bool) (p2pcrypto.PublicKey, time.Duration, error) {
+	now := time.Now()
+	cp.connMutex.RLock()
+	defer cp.connMutex.RUnlock()
+
+	var pub p2pcrypto.PublicKey
+	var age time.Duration
+	for key, conn := range cp.connections {
+		m, found := cp.meta[key]
+		if !found {
+			continue
+		}
+		if a := now.Sub(m.establishedAt); pub == nil || better(a, age) {
+			pub, age = conn.RemotePublicKey(), a
+		}
+	}
+	if pub == nil {
+		return nil, 0, ErrNoConnections
+	}
+	return pub, age, nil
+}
+
+// Snapshot returns a consistent copy of the metadata of all connections in the pool
+func (cp *ConnectionPool) Snapshot() []ConnectionSnapshot {
+	cp.connMutex.RLock()
+	snapshot := make([]ConnectionSnapshot, 0, len(cp.connections))
+	for pub, conn := range cp.connections {
+		cs := ConnectionSnapshot{PublicKey: conn.RemotePublicKey(), RemoteAddress: cp.addresses[pub]}
+		if cs.RemoteAddress == "" && conn.RemoteAddr() != nil {
+			cs.RemoteAddress = conn.RemoteAddr().String()
+		}
+		if conn.Session() != nil {
+			cs.SessionID = conn.Session().ID()
+		}
+		if m, found := cp.meta[pub]; found {
+			cs.Source = m.source
+			cs.EstablishedAt = m.establishedAt
+			cs.LastActivity = m.lastActivity
+		}
+		snapshot = append(snapshot, cs)
+	}
+	cp.connMutex.RUnlock()
+
+	return snapshot
+}
+
+// WalkConnections calls fn with each connection in the pool and its remote public key until fn returns false.
+// the pool is read locked during the walk so fn must not add or remove connections
+func (cp *ConnectionPool) WalkConnections(fn func(p2pcrypto.PublicKey, net.Connection) bool) {
+	cp.connMutex.RLock()
+	defer cp.connMutex.RUnlock()
+	for _, conn := range cp.connections {
+		if !fn(conn.RemotePublicKey(), conn) {
+			return
+		}
+	}
+}
+
+// SetWriteDeadline sets the time a send on a connection may take, 0 means no deadline. it is set as the send timeout of
+// the existing and new connections so it applies to every send on them
+func (cp *ConnectionPool) SetWriteDeadline(d time.Duration) {
+	cp.connMutex.Lock()
+	cp.writeDl = d
+	conns := make([]net.Connection, 0, len(cp.connections))
+	for _, conn := range cp.connections {
+		conns = append(conns, conn)
+	}
+	cp.connMutex.Unlock()
+
+	for _, conn := range conns {
+		cp.applyWriteDeadline(conn)
+	}
+}
+
+func (cp *ConnectionPool) applyWriteDeadline(conn net.Connection) {
+	cp.connMutex.RLock()
+	d := cp.writeDl
+	cp.connMutex.RUnlock()
+
+	if sts, ok := conn.(sendTimeoutSetter); ok {
+		sts.SetSendTimeout(d)
+	}
+}
+
+// Send sends m on the existing connection to pub within the write deadline.
+// a connection that misses the deadline is closed, since the timed out write may have left a partial message on the wire
+func (cp *ConnectionPool) Send(pub p2pcrypto.PublicKey, m []byte) error {
+	cp.connMutex.RLock()
+	conn, found := cp.connections[pub.String()]
+	cp.connMutex.RUnlock()
+	if !found {
+		return errors.New("no connection in cpool")
+	}
+
+	start := time.Now()
+	err := conn.Send(m)
+	cp.recordSend(pub, time.Since(start), err == nil)
+	if err != net.ErrSendTimeout {
+		if err == nil {
+			cp.LastActivity(pub)
+		}
+		return err
+	}
+
+	cp.net.Logger().Warning("send to %s missed write deadline, closing connection", pub)
+	conn.Close()
+	cp.handleClosedConnection(conn)
+	return ErrWriteDeadlineExceeded
+}
+
+// recordSend updates the send statistics used for the quality score of the connection to pub
+func (cp *ConnectionPool) recordSend(pub p2pcrypto.PublicKey, latency time.Duration, ok bool) {
+	cp.connMutex.Lock()
+	if m, found := cp.meta[pub.String()]; found {
+		m.sends++
+		m.sendLatency += latency
+		if ok {
+			m.okSends++
+		}
+	}
+	cp.connMutex.Unlock()
+}
+
+// quality computes the quality score of a connection from its metadata, must be called under connMutex
+func (m *connectionMeta) quality(now time.Time) float64 {
+	latency, reliability := 1.0, 1.0
+	if m.sends > 0 {
+		avg := m.sendLatency / time.Duration(m.sends)
+		latency = 1 - math.Min(float64(avg)/float64(QualityMaxLatency), 1)
+		reliability = float64(m.okSends) / float64(m.sends)
+	}
+	age := 1 - math.Min(float64(now.Sub(m.establishedAt))/float64(QualityMaxAge), 1)
+
+	return latencyWeight*latency + reliabilityWeight*reliability + ageWeight*age
+}
+
+// QualityScore returns a score between 0 and 1 of the connection to pub combining its average send latency,
+// the fraction of successful sends and its age. returns 0 if there's no connection to pub
+func (cp *ConnectionPool) QualityScore(pub p2pcrypto.PublicKey) float64 {
+	cp.connMutex.RLock()
+	defer cp.connMutex.RUnlock()
+	m, found := cp.meta[pub.String()]
+	if !found {
+		return 0
+	}
+	return m.quality(time.Now())
+}
+
+// PeersByQuality returns the public keys of all connected peers ordered from the highest quality score to the lowest
+func (cp *ConnectionPool) PeersByQuality() []p2pcrypto.PublicKey {
+	now := time.Now()
+	cp.connMutex.RLock()
+	peers := make([]p2pcrypto.PublicKey, 0, len(cp.connections))
+	scores := make(map[string]float64, len(cp.connections))
+	for pub, conn := range cp.connections {
+		peers = append(peers, conn.RemotePublicKey())
+		if m, found := cp.meta[pub]; found {
+			scores[pub] = m.quality(now)
+		}
+	}
+	cp.connMutex.RUnlock()
+
+	sort.SliceStable(peers, func(i, j int) bool { return scores[peers[i].String()] > scores[peers[j].String()] })
+	return peers
+}
+
+// SetReadBufferSize sets the socket read buffer size applied to every new connection, 0 keeps the os default
+func (cp *ConnectionPool) SetReadBufferSize(n int) {
+	cp.connMutex.Lock()
+	cp.readBufSize = n
+	cp.connMutex.Unlock()
+}
+
+// SetWriteBufferSize sets the socket write buffer size applied to every new connection, 0 keeps the os default
+func (cp *ConnectionPool) SetWriteBufferSize(n int) {
+	cp.connMutex.Lock()
+	cp.writeBufSz = n
+	cp.connMutex.Unlock()
+}
+
+func (cp *ConnectionPool) applyBufferSizes(conn net.Connection) {
+	cp.connMutex.RLock()
+	readSize, writeSize := cp.readBufSize, cp.writeBufSz
+	cp.connMutex.RUnlock()
+	if readSize == 0 && writeSize == 0 {
+		return
+	}
+
+	bss, ok := conn.(bufferSizeSetter)
+	if !ok {
+		return
+	}
+	if readSize > 0 {
+		if err := bss.SetReadBuffer(readSize); err != nil {
+			cp.net.Logger().Warning("failed to set read buffer size of connection %v err: %v", conn.ID(), err)
+		}
+	}
+	if writeSize > 0 {
+		if err := bss.SetWriteBuffer(writeSize); err != nil {
+			cp.net.Logger().Warning("failed to set write buffer size of connection %v err: %v", conn.ID(), err)
+		}
+	}
+}
+
+// Subscribe registers ch to receive an event for every new connection under id, replacing any channel registered under id.
+// events are dropped for subscribers that aren't ready to receive them
+func (cp *ConnectionPool) Subscribe(id string, ch chan<- net.NewConnectionEvent) {
+	cp.subsMutex.Lock()
+	cp.subs[id] = ch
+	cp.subsMutex.Unlock()
+}
+
+// Unsubscribe removes the channel registered under id
+func (cp *ConnectionPool) Unsubscribe(id string) {
+	cp.subsMutex.Lock()
+	delete(cp.subs, id)
+	cp.subsMutex.Unlock()
+}
+
+func (cp *ConnectionPool) publishNewConnection(nce net.NewConnectionEvent) {
+	cp.subsMutex.RLock()
+	for id, ch := range cp.subs {
+		select {
+		case ch <- nce:
+		default:
+			cp.net.Logger().Warning("subscriber %v isn't ready, dropping new connection event of %v", id, nce.Conn.RemotePublicKey())
+		}
+	}
+	cp.subsMutex.RUnlock()
+}
+
+// MultiplexedDial opens exactly n new connections to the peer, regardless of existing connections, for load distribution.
+// the connections replace previously multiplexed connections to the peer and are served by GetMultiplexed
+func (cp *ConnectionPool) MultiplexedDial(address string, pub p2pcrypto.PublicKey, n int) ([]net.Connection, error) {
+	if n <= 0 {
+		return nil, errors.New("number of connections must be positive")
+	}
+	if cp.isShuttingDown() {
+		return nil, errors.New("ConnectionPool was shut down")
+	}
+
+	cp.dialWait.Add(1)
+	defer cp.dialWait.Done()
+
+	type muxResult struct {
+		idx int
+		dialResult
+	}
+	results := make(chan muxResult, n)
+	for i := 0; i < n; i++ {
+		go func(idx int) {
+			conn, err := cp.dial(address, pub)
+			results <- muxResult{idx, dialResult{conn, err}}
+		}(i)
+	}
+
+	conns := make([]net.Connection, n)
+	var err error
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		conns[res.idx] = res.conn
+	}
+
+	closeAll := func() {
+		for _, c := range conns {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	cp.connMutex.Lock()
+	if cp.shutdown {
+		cp.connMutex.Unlock()
+		closeAll()
+		return nil, errors.New("ConnectionPool was shut down")
+	}
+	old := cp.muxConns[pub.String()]
+	cp.muxConns[pub.String()] = conns
+	cp.muxNext[pub.String()] = 0
+	cp.connMutex.Unlock()
+
+	for _, c := range old {
+		c.Close()
+	}
+
+	result := make([]net.Connection, n)
+	copy(result, conns)
+	return result, nil
+}
+
+// GetMultiplexed returns the next multiplexed connection to the peer in round-robin order
+func (cp *ConnectionPool) GetMultiplexed(pub p2pcrypto.PublicKey) (net.Connection, error) {
+	cp.connMutex.Lock()
+	defer cp.connMutex.Unlock()
+
+	conns := cp.muxConns[pub.String()]
+	if len(conns) == 0 {
+		return nil, errors.New("no multiplexed connections to peer")
+	}
+
+	next := cp.muxNext[pub.String()]
+	cp.muxNext[pub.String()] = (next + 1) % len(conns)
+	return conns[next], nil
+}
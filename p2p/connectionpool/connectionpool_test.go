@@ -1,14 +1,17 @@
 package connectionpool
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spacemeshos/go-spacemesh/p2p/net"
 	"github.com/spacemeshos/go-spacemesh/p2p/node"
 	"github.com/spacemeshos/go-spacemesh/p2p/p2pcrypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"math/rand"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -358,3 +361,843 @@ func TestConnectionPool_GetConnectionIfExists_Concurrency(t *testing.T) {
 	}
 
 }
+
+func TestConnectionPool_GetRandom(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	_, _, err := cPool.GetRandom(rng)
+	assert.Equal(t, ErrNoConnections, err)
+
+	conns := make(map[string]net.Connection)
+	for i := 0; i < 10; i++ {
+		rPub := generatePublicKey()
+		rConn := net.NewConnectionMock(rPub)
+		rConn.SetSession(net.NewSessionMock(rPub))
+		cPool.OnNewConnection(net.NewConnectionEvent{rConn, node.EmptyNode})
+		conns[rPub.String()] = rConn
+	}
+
+	seen := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		pub, conn, err := cPool.GetRandom(rng)
+		require.NoError(t, err)
+		assert.Equal(t, conns[pub.String()].ID(), conn.ID())
+		seen[pub.String()] = struct{}{}
+	}
+	assert.Equal(t, len(conns), len(seen))
+}
+
+func TestConnectionPool_UpdateAddress(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	remotePub := generatePublicKey()
+	oldConn, err := cPool.GetConnection("1.1.1.1", remotePub)
+	require.NoError(t, err)
+	assert.Equal(t, "1.1.1.1", cPool.addresses[remotePub.String()])
+
+	n.SetDialDelayMs(50)
+	done := make(chan error)
+	go func() {
+		done <- cPool.UpdateAddress(remotePub, "2.2.2.2")
+	}()
+
+	// while dialing the new address the old connection is still served
+	time.Sleep(10 * time.Millisecond)
+	conn, err := cPool.GetConnection("1.1.1.1", remotePub)
+	require.NoError(t, err)
+	assert.Equal(t, oldConn.ID(), conn.ID())
+
+	require.NoError(t, <-done)
+	conn, err = cPool.GetConnection("2.2.2.2", remotePub)
+	require.NoError(t, err)
+	assert.NotEqual(t, oldConn.ID(), conn.ID())
+	assert.True(t, oldConn.Closed())
+	assert.Equal(t, "2.2.2.2", cPool.addresses[remotePub.String()])
+	assert.Equal(t, int32(2), n.DialCount())
+
+	// closing event of the old connection doesn't remove the new one
+	cPool.OnClosedConnection(oldConn)
+	conn2, err := cPool.GetConnectionIfExists(remotePub)
+	require.NoError(t, err)
+	assert.Equal(t, conn.ID(), conn2.ID())
+
+	n.SetDialResult(errors.New("err"))
+	assert.Error(t, cPool.UpdateAddress(remotePub, "3.3.3.3"))
+	conn2, err = cPool.GetConnectionIfExists(remotePub)
+	require.NoError(t, err)
+	assert.Equal(t, conn.ID(), conn2.ID())
+}
+
+// addrNetwork sets the dialed address as the remote address of the connection
+type addrNetwork struct {
+	*net.NetworkMock
+}
+
+func (n *addrNetwork) Dial(address string, remotePublicKey p2pcrypto.PublicKey) (net.Connection, error) {
+	conn, err := n.NetworkMock.Dial(address, remotePublicKey)
+	conn.(*net.ConnectionMock).SetRemoteAddr(address)
+	return conn, err
+}
+
+func TestConnectionPool_UpdateAddressBlacklisted(t *testing.T) {
+	n := &addrNetwork{net.NewNetworkMock()}
+	cPool := NewConnectionPool(n, generatePublicKey())
+	require.NoError(t, cPool.BlacklistIPRange("10.0.0.0/8"))
+	remotePub := generatePublicKey()
+	oldConn, err := cPool.GetConnection("1.1.1.1:7513", remotePub)
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrBlacklistedAddress, cPool.UpdateAddress(remotePub, "10.0.0.1:7513"))
+	conn, err := cPool.GetConnectionIfExists(remotePub)
+	require.NoError(t, err)
+	assert.Equal(t, oldConn.ID(), conn.ID())
+	assert.False(t, oldConn.Closed())
+	assert.Equal(t, "1.1.1.1:7513", cPool.addresses[remotePub.String()])
+}
+
+type failingAddrNetwork struct {
+	*net.NetworkMock
+	failAddr string
+}
+
+func (n *failingAddrNetwork) Dial(address string, remotePublicKey p2pcrypto.PublicKey) (net.Connection, error) {
+	conn, err := n.NetworkMock.Dial(address, remotePublicKey)
+	if address == n.failAddr {
+		return nil, errors.New("dial failed")
+	}
+	return conn, err
+}
+
+// blockingDialNetwork blocks dials until release is closed
+type blockingDialNetwork struct {
+	*net.NetworkMock
+	release chan struct{}
+	conns   chan *net.ConnectionMock
+}
+
+func (n *blockingDialNetwork) Dial(address string, remotePublicKey p2pcrypto.PublicKey) (net.Connection, error) {
+	<-n.release
+	conn := net.NewConnectionMock(remotePublicKey)
+	conn.SetSession(net.NewSessionMock(remotePublicKey))
+	n.conns <- conn
+	return conn, nil
+}
+
+func TestConnectionPool_SetMaxDialDuration(t *testing.T) {
+	n := &blockingDialNetwork{net.NewNetworkMock(), make(chan struct{}), make(chan *net.ConnectionMock, 1)}
+	cPool := NewConnectionPool(n, generatePublicKey())
+	assert.Equal(t, DefaultMaxDialDuration, cPool.maxDialDur)
+	cPool.SetMaxDialDuration(20 * time.Millisecond)
+
+	start := time.Now()
+	conn, err := cPool.GetConnection("1.1.1.1", generatePublicKey())
+	assert.Nil(t, conn)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// a connection established after the deadline is closed
+	close(n.release)
+	select {
+	case late := <-n.conns:
+		time.Sleep(50 * time.Millisecond)
+		assert.True(t, late.Closed())
+	case <-time.After(time.Second):
+		t.Fatal("dial didn't complete")
+	}
+}
+
+func TestConnectionPool_GetConnectionWithContext(t *testing.T) {
+	n := &blockingDialNetwork{net.NewNetworkMock(), make(chan struct{}), make(chan *net.ConnectionMock, 1)}
+	cPool := NewConnectionPool(n, generatePublicKey())
+	remotePub := generatePublicKey()
+
+	// the only waiter gives up, the dial is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	conn, err := cPool.GetConnectionWithContext(ctx, "1.1.1.1", remotePub)
+	assert.Nil(t, conn)
+	require.IsType(t, &WaitCanceledError{}, err)
+	assert.Equal(t, context.DeadlineExceeded, err.(*WaitCanceledError).Err)
+	cPool.pendMutex.Lock()
+	assert.Equal(t, 0, len(cPool.pending))
+	assert.Equal(t, 0, len(cPool.dialCancel))
+	cPool.pendMutex.Unlock()
+
+	close(n.release)
+	select {
+	case late := <-n.conns:
+		time.Sleep(50 * time.Millisecond)
+		assert.True(t, late.Closed())
+	case <-time.After(time.Second):
+		t.Fatal("dial didn't complete")
+	}
+	_, err = cPool.GetConnectionIfExists(remotePub)
+	assert.Error(t, err)
+}
+
+func TestConnectionPool_GetConnectionWithContextOtherWaiter(t *testing.T) {
+	n := &blockingDialNetwork{net.NewNetworkMock(), make(chan struct{}), make(chan *net.ConnectionMock, 1)}
+	cPool := NewConnectionPool(n, generatePublicKey())
+	remotePub := generatePublicKey()
+
+	waitCh := make(chan dialResult, 1)
+	go func() {
+		conn, err := cPool.GetConnection("1.1.1.1", remotePub)
+		waitCh <- dialResult{conn, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// one waiter giving up doesn't cancel the dial the other waits for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conn, err := cPool.GetConnectionWithContext(ctx, "1.1.1.1", remotePub)
+	assert.Nil(t, conn)
+	require.IsType(t, &WaitCanceledError{}, err)
+	assert.Equal(t, context.Canceled, err.(*WaitCanceledError).Err)
+
+	close(n.release)
+	select {
+	case res := <-waitCh:
+		require.NoError(t, res.err)
+		assert.Equal(t, remotePub.String(), res.conn.RemotePublicKey().String())
+		assert.False(t, (<-n.conns).Closed())
+	case <-time.After(time.Second):
+		t.Fatal("dial didn't complete")
+	}
+}
+
+func TestConnectionPool_ConnectAll(t *testing.T) {
+	n := &failingAddrNetwork{net.NewNetworkMock(), "6.6.6.6"}
+	n.SetDialDelayMs(20)
+	cPool := NewConnectionPool(n, generatePublicKey())
+
+	peers := make([]node.Node, 0, 6)
+	for i := 0; i < 6; i++ {
+		addr := generateIpAddress()
+		if i%2 == 1 {
+			addr = n.failAddr
+		}
+		peers = append(peers, node.New(generatePublicKey(), addr))
+	}
+
+	conns, errs := cPool.ConnectAll(context.Background(), peers)
+	require.Equal(t, len(peers), len(conns))
+	require.Equal(t, len(peers), len(errs))
+	for i, p := range peers {
+		if i%2 == 1 {
+			assert.Error(t, errs[i])
+			assert.Nil(t, conns[i])
+		} else {
+			assert.NoError(t, errs[i])
+			assert.Equal(t, p.PublicKey().String(), conns[i].RemotePublicKey().String())
+		}
+	}
+	assert.Equal(t, int32(6), n.DialCount())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	n.SetDialDelayMs(100)
+	_, errs = cPool.ConnectAll(ctx, []node.Node{node.New(generatePublicKey(), generateIpAddress())})
+	assert.Equal(t, context.DeadlineExceeded, errs[0])
+}
+
+func TestConnectionPool_WarmUp(t *testing.T) {
+	n := &failingAddrNetwork{net.NewNetworkMock(), "6.6.6.6"}
+	cPool := NewConnectionPool(n, generatePublicKey())
+
+	seeds := make([]node.Node, 0, 5)
+	for i := 0; i < 5; i++ {
+		addr := generateIpAddress()
+		if i%2 == 1 {
+			addr = n.failAddr
+		}
+		seeds = append(seeds, node.New(generatePublicKey(), addr))
+	}
+
+	assert.Equal(t, 3, cPool.WarmUp(context.Background(), seeds))
+	for i, s := range seeds {
+		_, err := cPool.GetConnectionIfExists(s.PublicKey())
+		assert.Equal(t, i%2 == 0, err == nil)
+	}
+}
+
+func TestConnectionPool_Snapshot(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	assert.Empty(t, cPool.Snapshot())
+
+	localPub := generatePublicKey()
+	localConn, err := cPool.GetConnection("1.1.1.1", localPub)
+	require.NoError(t, err)
+
+	remotePub := generatePublicKey()
+	rConn := net.NewConnectionMock(remotePub)
+	rConn.SetSession(net.NewSessionMock(remotePub))
+	cPool.OnNewConnection(net.NewConnectionEvent{rConn, node.EmptyNode})
+
+	snapshot := cPool.Snapshot()
+	require.Equal(t, 2, len(snapshot))
+	byPub := make(map[string]ConnectionSnapshot)
+	for _, cs := range snapshot {
+		byPub[cs.PublicKey.String()] = cs
+		assert.False(t, cs.EstablishedAt.IsZero())
+		assert.Equal(t, cs.EstablishedAt, cs.LastActivity)
+	}
+
+	local := byPub[localPub.String()]
+	assert.Equal(t, "1.1.1.1", local.RemoteAddress)
+	assert.Equal(t, net.Local, local.Source)
+	assert.Equal(t, localConn.Session().ID().String(), local.SessionID.String())
+
+	remote := byPub[remotePub.String()]
+	assert.Equal(t, net.Remote, remote.Source)
+	assert.Equal(t, remotePub.String(), remote.SessionID.String())
+
+	time.Sleep(time.Millisecond)
+	cPool.LastActivity(remotePub)
+	cPool.LastActivity(generatePublicKey()) // unknown peer is ignored
+	for _, cs := range cPool.Snapshot() {
+		if cs.PublicKey.String() == remotePub.String() {
+			assert.True(t, cs.LastActivity.After(cs.EstablishedAt))
+		} else {
+			assert.Equal(t, cs.EstablishedAt, cs.LastActivity)
+		}
+	}
+
+	// a snapshot is a copy, later changes don't affect it
+	cPool.OnClosedConnection(rConn)
+	assert.Equal(t, 1, len(cPool.Snapshot()))
+	assert.Equal(t, 2, len(snapshot))
+	assert.Equal(t, remote.LastActivity, byPub[remotePub.String()].LastActivity)
+}
+
+func TestConnectionPool_WalkConnections(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	cPool.WalkConnections(func(p2pcrypto.PublicKey, net.Connection) bool {
+		t.Fatal("walked an empty pool")
+		return true
+	})
+
+	pubs := make(map[string]struct{})
+	for i := 0; i < 3; i++ {
+		pub := generatePublicKey()
+		_, err := cPool.GetConnection(generateIpAddress(), pub)
+		require.NoError(t, err)
+		pubs[pub.String()] = struct{}{}
+	}
+
+	walked := make(map[string]struct{})
+	cPool.WalkConnections(func(pub p2pcrypto.PublicKey, conn net.Connection) bool {
+		assert.Equal(t, pub.String(), conn.RemotePublicKey().String())
+		walked[pub.String()] = struct{}{}
+		return true
+	})
+	assert.Equal(t, pubs, walked)
+
+	// the walk stops once fn returns false
+	count := 0
+	cPool.WalkConnections(func(p2pcrypto.PublicKey, net.Connection) bool {
+		count++
+		return count < 2
+	})
+	assert.Equal(t, 2, count)
+}
+
+func TestConnectionPool_SetWriteDeadline(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	assert.Error(t, cPool.Send(generatePublicKey(), []byte("msg")))
+
+	rPub := generatePublicKey()
+	rConn := net.NewConnectionMock(rPub)
+	rConn.SetSession(net.NewSessionMock(rPub))
+	cPool.OnNewConnection(net.NewConnectionEvent{rConn, node.EmptyNode})
+
+	rConn.SetSendDelay(100)
+	assert.NoError(t, cPool.Send(rPub, []byte("msg"))) // no deadline
+
+	cPool.SetWriteDeadline(10 * time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, rConn.SendTimeout())
+	rConn.SetSendDelay(0)
+	assert.NoError(t, cPool.Send(rPub, []byte("msg")))
+
+	rConn.SetSendDelay(100)
+	start := time.Now()
+	assert.Equal(t, ErrWriteDeadlineExceeded, cPool.Send(rPub, []byte("msg")))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.True(t, rConn.Closed())
+	_, err := cPool.GetConnectionIfExists(rPub)
+	assert.Error(t, err)
+	assert.Error(t, cPool.Send(rPub, []byte("msg")))
+
+	// new connections get the deadline too
+	newPub := generatePublicKey()
+	newConn := net.NewConnectionMock(newPub)
+	newConn.SetSession(net.NewSessionMock(newPub))
+	cPool.OnNewConnection(net.NewConnectionEvent{newConn, node.EmptyNode})
+	assert.Equal(t, 10*time.Millisecond, newConn.SendTimeout())
+}
+
+func TestConnectionPool_SetBufferSize(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	cPool.SetReadBufferSize(1 << 20)
+	cPool.SetWriteBufferSize(1 << 19)
+
+	// local
+	conn, err := cPool.GetConnection(generateIpAddress(), generatePublicKey())
+	require.NoError(t, err)
+	assert.Equal(t, 1<<20, conn.(*net.ConnectionMock).ReadBufferSize())
+	assert.Equal(t, 1<<19, conn.(*net.ConnectionMock).WriteBufferSize())
+
+	// remote
+	rPub := generatePublicKey()
+	rConn := net.NewConnectionMock(rPub)
+	rConn.SetSession(net.NewSessionMock(rPub))
+	cPool.OnNewConnection(net.NewConnectionEvent{rConn, node.EmptyNode})
+	assert.Equal(t, 1<<20, rConn.ReadBufferSize())
+	assert.Equal(t, 1<<19, rConn.WriteBufferSize())
+}
+
+func TestConnectionPool_Subscribe(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	ch1 := make(chan net.NewConnectionEvent, 2)
+	ch2 := make(chan net.NewConnectionEvent, 2)
+	cPool.Subscribe("first", ch1)
+	cPool.Subscribe("second", ch2)
+
+	rPub := generatePublicKey()
+	rConn := net.NewConnectionMock(rPub)
+	rConn.SetSession(net.NewSessionMock(rPub))
+	cPool.OnNewConnection(net.NewConnectionEvent{rConn, node.EmptyNode})
+	for _, ch := range []chan net.NewConnectionEvent{ch1, ch2} {
+		select {
+		case nce := <-ch:
+			assert.Equal(t, rConn.ID(), nce.Conn.ID())
+		default:
+			t.Fatal("no event received")
+		}
+	}
+
+	cPool.Unsubscribe("first")
+	lPub := generatePublicKey()
+	conn, err := cPool.GetConnection("1.1.1.1", lPub)
+	require.NoError(t, err)
+	select {
+	case nce := <-ch2:
+		assert.Equal(t, conn.ID(), nce.Conn.ID())
+		assert.Equal(t, "1.1.1.1", nce.Node.Address())
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	assert.Equal(t, 0, len(ch1))
+
+	// a full subscriber doesn't block the pool
+	full := make(chan net.NewConnectionEvent)
+	cPool.Subscribe("second", full)
+	rPub2 := generatePublicKey()
+	rConn2 := net.NewConnectionMock(rPub2)
+	rConn2.SetSession(net.NewSessionMock(rPub2))
+	cPool.OnNewConnection(net.NewConnectionEvent{rConn2, node.EmptyNode})
+	_, err = cPool.GetConnectionIfExists(rPub2)
+	assert.NoError(t, err)
+}
+
+func TestConnectionPool_MultiplexedDial(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	rPub := generatePublicKey()
+	_, err := cPool.GetMultiplexed(rPub)
+	assert.Error(t, err)
+
+	conn, err := cPool.GetConnection("1.1.1.1", rPub)
+	require.NoError(t, err)
+
+	conns, err := cPool.MultiplexedDial("1.1.1.1", rPub, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(conns))
+	assert.Equal(t, int32(4), n.DialCount())
+
+	// the deduplicated connection is kept
+	c, err := cPool.GetConnectionIfExists(rPub)
+	require.NoError(t, err)
+	assert.Equal(t, conn.ID(), c.ID())
+
+	for i := 0; i < 6; i++ {
+		mc, err := cPool.GetMultiplexed(rPub)
+		require.NoError(t, err)
+		assert.Equal(t, conns[i%3].ID(), mc.ID())
+	}
+
+	n.SetDialResult(errors.New("err"))
+	_, err = cPool.MultiplexedDial("1.1.1.1", rPub, 2)
+	assert.Error(t, err)
+	mc, err := cPool.GetMultiplexed(rPub)
+	require.NoError(t, err)
+	assert.Equal(t, conns[0].ID(), mc.ID())
+
+	cPool.Shutdown()
+	for _, c := range conns {
+		assert.True(t, c.Closed())
+	}
+}
+
+func TestConnectionPool_BlacklistIPRange(t *testing.T) {
+	cPool := NewConnectionPool(net.NewNetworkMock(), generatePublicKey())
+	assert.Error(t, cPool.BlacklistIPRange("10.0.0.0"))
+	require.NoError(t, cPool.BlacklistIPRange("10.0.0.0/8"))
+
+	newConn := func(addr string) *net.ConnectionMock {
+		rPub := generatePublicKey()
+		rConn := net.NewConnectionMock(rPub)
+		rConn.SetSession(net.NewSessionMock(rPub))
+		rConn.SetRemoteAddr(addr)
+		return rConn
+	}
+
+	blocked := newConn("10.0.0.1:7513")
+	cPool.OnNewConnection(net.NewConnectionEvent{blocked, node.EmptyNode})
+	assert.True(t, blocked.Closed())
+	_, err := cPool.GetConnectionIfExists(blocked.RemotePublicKey())
+	assert.Error(t, err)
+
+	allowed := newConn("11.0.0.1:7513")
+	cPool.OnNewConnection(net.NewConnectionEvent{allowed, node.EmptyNode})
+	assert.False(t, allowed.Closed())
+	conn, err := cPool.GetConnectionIfExists(allowed.RemotePublicKey())
+	require.NoError(t, err)
+	assert.Equal(t, allowed.ID(), conn.ID())
+
+	cPool.UnblacklistIPRange("10.0.0.0/8")
+	unblocked := newConn("10.0.0.1:7513")
+	cPool.OnNewConnection(net.NewConnectionEvent{unblocked, node.EmptyNode})
+	assert.False(t, unblocked.Closed())
+}
+
+func TestConnectionPool_QualityScore(t *testing.T) {
+	cPool := NewConnectionPool(net.NewNetworkMock(), generatePublicKey())
+	newConn := func() *net.ConnectionMock {
+		rPub := generatePublicKey()
+		rConn := net.NewConnectionMock(rPub)
+		rConn.SetSession(net.NewSessionMock(rPub))
+		cPool.OnNewConnection(net.NewConnectionEvent{rConn, node.EmptyNode})
+		return rConn
+	}
+	fast, slow, failing := newConn(), newConn(), newConn()
+	slow.SetSendDelay(100)
+	failing.SetSendResult(errors.New("fail"))
+
+	assert.Equal(t, float64(0), cPool.QualityScore(generatePublicKey()))
+	// no sends yet, only age lowers the score
+	assert.InDelta(t, 1, cPool.QualityScore(fast.RemotePublicKey()), 0.01)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, cPool.Send(fast.RemotePublicKey(), []byte("msg")))
+		assert.NoError(t, cPool.Send(slow.RemotePublicKey(), []byte("msg")))
+		assert.Error(t, cPool.Send(failing.RemotePublicKey(), []byte("msg")))
+	}
+
+	assert.InDelta(t, 1, cPool.QualityScore(fast.RemotePublicKey()), 0.01)
+	assert.InDelta(t, 1-latencyWeight*0.1, cPool.QualityScore(slow.RemotePublicKey()), 0.02)
+	assert.InDelta(t, 1-reliabilityWeight, cPool.QualityScore(failing.RemotePublicKey()), 0.01)
+
+	peers := cPool.PeersByQuality()
+	require.Equal(t, 3, len(peers))
+	assert.Equal(t, fast.RemotePublicKey().String(), peers[0].String())
+	assert.Equal(t, slow.RemotePublicKey().String(), peers[1].String())
+	assert.Equal(t, failing.RemotePublicKey().String(), peers[2].String())
+}
+
+func TestConnectionPool_AddStaticConnection(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+
+	staticPub := generatePublicKey()
+	require.NoError(t, cPool.AddStaticConnection("1.1.1.1", staticPub))
+	staticConn, err := cPool.GetConnectionIfExists(staticPub)
+	require.NoError(t, err)
+
+	pub := generatePublicKey()
+	conn, err := cPool.GetConnection("2.2.2.2", pub)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, cPool.EvictIdle(5*time.Millisecond))
+	assert.True(t, conn.(*net.ConnectionMock).Closed())
+	assert.False(t, staticConn.(*net.ConnectionMock).Closed())
+	_, err = cPool.GetConnectionIfExists(pub)
+	assert.Error(t, err)
+	_, err = cPool.GetConnectionIfExists(staticPub)
+	assert.NoError(t, err)
+
+	require.NoError(t, cPool.RemoveStaticConnection(staticPub))
+	assert.Equal(t, ErrNotStaticConnection, cPool.RemoveStaticConnection(staticPub))
+	assert.Equal(t, 1, cPool.EvictIdle(5*time.Millisecond))
+	assert.True(t, staticConn.(*net.ConnectionMock).Closed())
+}
+
+func TestConnectionPool_ConnectionAge(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	_, _, err := cPool.OldestConnection()
+	assert.Equal(t, ErrNoConnections, err)
+	_, _, err = cPool.NewestConnection()
+	assert.Equal(t, ErrNoConnections, err)
+
+	oldPub := generatePublicKey()
+	_, err = cPool.ConnectionAge(oldPub)
+	assert.Equal(t, ErrPeerNotFound, err)
+	_, err = cPool.GetConnection("1.1.1.1", oldPub)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	newPub := generatePublicKey()
+	_, err = cPool.GetConnection("2.2.2.2", newPub)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	oldAge, err := cPool.ConnectionAge(oldPub)
+	require.NoError(t, err)
+	assert.True(t, oldAge >= 60*time.Millisecond)
+	newAge, err := cPool.ConnectionAge(newPub)
+	require.NoError(t, err)
+	assert.True(t, newAge >= 10*time.Millisecond && newAge < oldAge)
+
+	pub, age, err := cPool.OldestConnection()
+	require.NoError(t, err)
+	assert.Equal(t, oldPub.String(), pub.String())
+	assert.True(t, age >= oldAge)
+	pub, age, err = cPool.NewestConnection()
+	require.NoError(t, err)
+	assert.Equal(t, newPub.String(), pub.String())
+	assert.True(t, age >= newAge && age < oldAge)
+}
+
+func TestConnectionPool_SetRetryPolicy(t *testing.T) {
+	n := net.NewNetworkMock()
+	n.SetDialResult(errors.New("err"))
+	cPool := NewConnectionPool(n, generatePublicKey())
+	cPool.SetRetryPolicy(3, 10, 10*time.Millisecond)
+
+	_, err := cPool.GetConnection("1.1.1.1", generatePublicKey())
+	require.Error(t, err)
+	timeout := time.After(time.Second)
+	for n.DialCount() < 4 {
+		select {
+		case <-timeout:
+			t.Fatalf("failed peer was retried %v times", n.DialCount()-1)
+		default:
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(4), n.DialCount())
+	assert.Equal(t, 0, cPool.depth())
+
+	// the queue doesn't grow beyond its max depth
+	cPool.SetRetryPolicy(1, 1, time.Hour)
+	_, err = cPool.GetConnection("1.1.1.1", generatePublicKey())
+	require.Error(t, err)
+	_, err = cPool.GetConnection("2.2.2.2", generatePublicKey())
+	require.Error(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, cPool.depth())
+	cPool.Shutdown()
+	assert.Equal(t, int32(6), n.DialCount())
+}
+
+// flakyDialNetwork fails the first failures dials
+type flakyDialNetwork struct {
+	*net.NetworkMock
+	failures int32
+	dials    int32
+}
+
+func (n *flakyDialNetwork) Dial(address string, remotePublicKey p2pcrypto.PublicKey) (net.Connection, error) {
+	if atomic.AddInt32(&n.dials, 1) <= n.failures {
+		return nil, errors.New("err")
+	}
+	return n.NetworkMock.Dial(address, remotePublicKey)
+}
+
+func TestConnectionPool_GetConnectionWithRetry(t *testing.T) {
+	n := &flakyDialNetwork{NetworkMock: net.NewNetworkMock(), failures: 2}
+	n.SetDialResult(nil)
+	cPool := NewConnectionPool(n, generatePublicKey())
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 15 * time.Millisecond}
+	remotePub := generatePublicKey()
+
+	// a waiter joining the dial gets the connection of the last retry
+	waitCh := make(chan dialResult, 1)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		conn, err := cPool.GetConnection("1.1.1.1", remotePub)
+		waitCh <- dialResult{conn, err}
+	}()
+	conn, err := cPool.GetConnectionWithRetry(context.Background(), "1.1.1.1", remotePub, policy)
+	require.NoError(t, err)
+	assert.Equal(t, remotePub.String(), conn.RemotePublicKey().String())
+	res := <-waitCh
+	require.NoError(t, res.err)
+	assert.Equal(t, conn.ID(), res.conn.ID())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&n.dials))
+
+	// the error of the last attempt is returned
+	n.failures = 10
+	_, err = cPool.GetConnectionWithRetry(context.Background(), "2.2.2.2", generatePublicKey(), policy)
+	assert.Error(t, err)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&n.dials))
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempts, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := policy.delay(attempts + 1)
+		assert.True(t, d > max/2 && d <= max, "delay %v after %v attempts", d, attempts+1)
+	}
+
+	// no cap
+	policy.MaxDelay = 0
+	for attempts, max := range []time.Duration{100, 200, 400, 800, 1600, 3200} {
+		max *= time.Millisecond
+		d := policy.delay(attempts + 1)
+		assert.True(t, d > max/2 && d <= max, "delay %v after %v attempts", d, attempts+1)
+	}
+	assert.True(t, policy.delay(100) > 0)
+}
+
+func TestTypedConnectionPool_SendTyped(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewTypedConnectionPool(n, generatePublicKey())
+	assert.Equal(t, ErrNoConnections, cPool.SendTyped(1, []byte("msg")))
+
+	blocksPub, votesPub := generatePublicKey(), generatePublicKey()
+	blocksConn, err := cPool.GetConnection("1.1.1.1", blocksPub)
+	require.NoError(t, err)
+	votesConn, err := cPool.GetConnection("2.2.2.2", votesPub)
+	require.NoError(t, err)
+	cPool.RegisterMessageType(1, blocksPub)
+	cPool.RegisterMessageType(2, votesPub)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, cPool.SendTyped(1, []byte("block")))
+	}
+	require.NoError(t, cPool.SendTyped(2, []byte("vote")))
+	assert.Equal(t, int32(3), blocksConn.(*net.ConnectionMock).SendCount())
+	assert.Equal(t, int32(1), votesConn.(*net.ConnectionMock).SendCount())
+
+	// the preferred peer of type 2 is gone, and type 3 has no preferred peer
+	votesConn.Close()
+	cPool.OnClosedConnection(votesConn)
+	require.NoError(t, cPool.SendTyped(2, []byte("vote")))
+	require.NoError(t, cPool.SendTyped(3, []byte("atx")))
+	assert.Equal(t, int32(5), blocksConn.(*net.ConnectionMock).SendCount())
+	assert.Equal(t, int32(1), votesConn.(*net.ConnectionMock).SendCount())
+}
+
+func TestConnectionPool_SetMessageSizeLimit(t *testing.T) {
+	n := net.NewNetworkMock()
+	cPool := NewConnectionPool(n, generatePublicKey())
+	rPub := generatePublicKey()
+	rConn := net.NewConnectionMock(rPub)
+	rConn.SetSession(net.NewSessionMock(rPub))
+	cPool.OnNewConnection(net.NewConnectionEvent{Conn: rConn, Node: node.EmptyNode})
+
+	small := net.IncomingMessageEvent{Conn: rConn, Message: make([]byte, 10)}
+	large := net.IncomingMessageEvent{Conn: rConn, Message: make([]byte, 11)}
+	assert.NoError(t, cPool.CheckIncomingMessage(large)) // no limit
+
+	cPool.SetMessageSizeLimit(10)
+	cPool.SetMaxSizeViolations(2)
+	assert.NoError(t, cPool.CheckIncomingMessage(small))
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, ErrMessageTooLarge, cPool.CheckIncomingMessage(large))
+		assert.NoError(t, cPool.CheckIncomingMessage(small))
+	}
+	assert.False(t, rConn.Closed())
+	_, err := cPool.GetConnectionIfExists(rPub)
+	assert.NoError(t, err)
+
+	// the third violation closes the connection
+	assert.Equal(t, ErrMessageTooLarge, cPool.CheckIncomingMessage(large))
+	assert.True(t, rConn.Closed())
+	_, err = cPool.GetConnectionIfExists(rPub)
+	assert.Error(t, err)
+
+	// violations of a new connection are counted from zero
+	rConn = net.NewConnectionMock(rPub)
+	rConn.SetSession(net.NewSessionMock(rPub))
+	cPool.OnNewConnection(net.NewConnectionEvent{Conn: rConn, Node: node.EmptyNode})
+	assert.Equal(t, ErrMessageTooLarge, cPool.CheckIncomingMessage(net.IncomingMessageEvent{Conn: rConn, Message: large.Message}))
+	assert.False(t, rConn.Closed())
+}
+
+func BenchmarkConnectionPool_GetMultiplexed(b *testing.B) {
+	cPool := NewConnectionPool(net.NewNetworkMock(), generatePublicKey())
+	rPub := generatePublicKey()
+	if _, err := cPool.MultiplexedDial("1.1.1.1", rPub, 8); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := cPool.GetMultiplexed(rPub); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNewConnectionPoolWithMetrics(t *testing.T) {
+	n := net.NewNetworkMock()
+	n.SetDialResult(nil)
+	reg := prometheus.NewRegistry()
+	cPool := NewConnectionPoolWithMetrics(n, generatePublicKey(), reg)
+	assert.Panics(t, func() { NewConnectionPoolWithMetrics(n, generatePublicKey(), reg) })
+
+	gather := func() map[string]float64 {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		metrics := make(map[string]float64)
+		for _, f := range families {
+			m := f.GetMetric()[0]
+			switch {
+			case m.Histogram != nil:
+				metrics[f.GetName()] = float64(m.Histogram.GetSampleCount())
+			case m.Gauge != nil:
+				metrics[f.GetName()] = m.Gauge.GetValue()
+			case m.Counter != nil:
+				metrics[f.GetName()] = m.Counter.GetValue()
+			}
+		}
+		return metrics
+	}
+
+	remotePub := generatePublicKey()
+	conn, err := cPool.GetConnection("1.1.1.1", remotePub)
+	require.NoError(t, err)
+	_, err = cPool.GetConnection("2.2.2.2", generatePublicKey())
+	require.NoError(t, err)
+
+	// a remote connection to the same peer closes one of the two
+	rConn := net.NewConnectionMock(remotePub)
+	rConn.SetSession(net.NewSessionMock(remotePub))
+	cPool.OnNewConnection(net.NewConnectionEvent{Conn: rConn, Node: node.EmptyNode})
+	assert.Equal(t, map[string]float64{
+		"spacemesh_connectionpool_connections":                        2,
+		"spacemesh_connectionpool_dial_duration_seconds":              2,
+		"spacemesh_connectionpool_duplicate_connections_closed_total": 1,
+	}, gather())
+
+	if conn.(*net.ConnectionMock).Closed() {
+		conn = rConn
+	}
+	cPool.OnClosedConnection(conn)
+	assert.Equal(t, float64(1), gather()["spacemesh_connectionpool_connections"])
+}
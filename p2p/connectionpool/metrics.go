@@ -0,0 +1,51 @@
+package connectionpool
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spacemeshos/go-spacemesh/p2p/p2pcrypto"
+)
+
+const (
+	// Namespace is the metrics namespace
+	Namespace = "spacemesh"
+	// Subsystem is the subsystem of the metrics of the connection pool
+	Subsystem = "connectionpool"
+)
+
+// Metrics are the metrics of a ConnectionPool
+type Metrics struct {
+	ConnCount           prometheus.Gauge
+	DialDuration        prometheus.Histogram
+	DuplicateConnClosed prometheus.Counter
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		ConnCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "connections",
+			Help:      "Number of open connections in the pool.",
+		}),
+		DialDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "dial_duration_seconds",
+			Help:      "Time it took to dial a remote peer, including failed dials.",
+		}),
+		DuplicateConnClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "duplicate_connections_closed_total",
+			Help:      "Number of connections closed because another connection to the same peer existed.",
+		}),
+	}
+}
+
+// NewConnectionPoolWithMetrics creates new ConnectionPool and registers its metrics with reg, it panics if the metrics
+// are already registered
+func NewConnectionPoolWithMetrics(network networker, lPub p2pcrypto.PublicKey, reg prometheus.Registerer) *ConnectionPool {
+	cPool := NewConnectionPool(network, lPub)
+	reg.MustRegister(cPool.metrics.ConnCount, cPool.metrics.DialDuration, cPool.metrics.DuplicateConnClosed)
+	return cPool
+}
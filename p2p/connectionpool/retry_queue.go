@@ -0,0 +1,204 @@
+package connectionpool
+
+import (
+	"github.com/spacemeshos/go-spacemesh/p2p/net"
+	"github.com/spacemeshos/go-spacemesh/p2p/node"
+	"github.com/spacemeshos/go-spacemesh/p2p/p2pcrypto"
+
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultRetryBaseDelay is the default time to wait before re-dialing a peer whose dial failed
+const DefaultRetryBaseDelay = 5 * time.Second
+
+// DefaultMaxRetryQueueDepth is the default number of failed dials waiting to be retried
+const DefaultMaxRetryQueueDepth = 100
+
+// RetryPolicy sets how GetConnectionWithRetry re-dials a peer before giving up. the delay before the n-th retry is
+// BaseDelay*2^(n-1) capped at MaxDelay, of which a random jitter of up to half is taken off
+type RetryPolicy struct {
+	MaxAttempts int // number of dials including the first one
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration // 0 means no cap
+}
+
+// delay returns the time to wait before the retry following the given number of failed attempts
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempts && (p.MaxDelay == 0 || d < p.MaxDelay) && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if jitter := int64(d / 2); jitter > 0 {
+		d -= time.Duration(rand.Int63n(jitter))
+	}
+	return d
+}
+
+type retryEntry struct {
+	address string
+	pub     p2pcrypto.PublicKey
+	retries int // number of retries already made
+	due     time.Time
+}
+
+// RetryQueue holds peers whose dial failed in FIFO order until they are re-dialed.
+// retrying is disabled until SetRetryPolicy is called with a positive maxRetries
+type RetryQueue struct {
+	retryMutex sync.Mutex
+	entries    []retryEntry
+	maxRetries int
+	maxDepth   int
+	baseDelay  time.Duration
+	running    bool
+	quit       chan struct{}
+}
+
+func newRetryQueue() RetryQueue {
+	return RetryQueue{
+		maxDepth:  DefaultMaxRetryQueueDepth,
+		baseDelay: DefaultRetryBaseDelay,
+		quit:      make(chan struct{}),
+	}
+}
+
+// SetRetryPolicy sets the number of times a failed dial is retried, the maximal number of dials waiting to be retried
+// and the delay before each retry. the actual delay is baseDelay plus a random jitter of up to half of it
+func (rq *RetryQueue) SetRetryPolicy(maxRetries int, maxQueueDepth int, baseDelay time.Duration) {
+	rq.retryMutex.Lock()
+	rq.maxRetries = maxRetries
+	rq.maxDepth = maxQueueDepth
+	rq.baseDelay = baseDelay
+	rq.retryMutex.Unlock()
+}
+
+// push adds a retry of the failed dial to the back of the queue, returns false if the dial shouldn't be retried
+// and true if the retry loop needs to be started
+func (rq *RetryQueue) push(address string, pub p2pcrypto.PublicKey, retries int) (queued bool, start bool) {
+	rq.retryMutex.Lock()
+	defer rq.retryMutex.Unlock()
+	if retries >= rq.maxRetries || len(rq.entries) >= rq.maxDepth {
+		return false, false
+	}
+
+	delay := rq.baseDelay
+	if jitter := int64(rq.baseDelay / 2); jitter > 0 {
+		delay += time.Duration(rand.Int63n(jitter))
+	}
+	rq.entries = append(rq.entries, retryEntry{address, pub, retries, time.Now().Add(delay)})
+	start = !rq.running
+	rq.running = true
+	return true, start
+}
+
+// pop removes the entry at the front of the queue, returns false and marks the loop as stopped if the queue is empty
+func (rq *RetryQueue) pop() (retryEntry, bool) {
+	rq.retryMutex.Lock()
+	defer rq.retryMutex.Unlock()
+	if len(rq.entries) == 0 {
+		rq.running = false
+		return retryEntry{}, false
+	}
+	e := rq.entries[0]
+	rq.entries = rq.entries[1:]
+	return e, true
+}
+
+// depth returns the number of dials waiting to be retried
+func (rq *RetryQueue) depth() int {
+	rq.retryMutex.Lock()
+	defer rq.retryMutex.Unlock()
+	return len(rq.entries)
+}
+
+// scheduleRetry queues a retry of the failed dial to pub and starts the retry loop if it isn't running
+func (cp *ConnectionPool) scheduleRetry(address string, pub p2pcrypto.PublicKey, retries int) {
+	queued, start := cp.RetryQueue.push(address, pub, retries)
+	if !queued {
+		if retries > 0 {
+			cp.net.Logger().Debug("giving up on dialing %v at %v after %v retries", pub, address, retries)
+		}
+		return
+	}
+	if start {
+		go cp.retryLoop()
+	}
+}
+
+// retryLoop re-dials the queued peers in order, each after its delay. it returns when the queue is empty or on shutdown
+func (cp *ConnectionPool) retryLoop() {
+	for {
+		e, ok := cp.RetryQueue.pop()
+		if !ok {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(e.due))
+		select {
+		case <-timer.C:
+		case <-cp.RetryQueue.quit:
+			timer.Stop()
+			return
+		}
+		cp.retry(e)
+	}
+}
+
+// retry re-dials the peer of e unless it was connected in the meantime, a failed dial is queued again
+func (cp *ConnectionPool) retry(e retryEntry) {
+	cp.connMutex.RLock()
+	_, connected := cp.connections[e.pub.String()]
+	shutdown := cp.shutdown
+	cp.connMutex.RUnlock()
+	if connected || shutdown {
+		return
+	}
+
+	cp.dialWait.Add(1)
+	defer cp.dialWait.Done()
+	conn, err := cp.dial(e.address, e.pub)
+	if err != nil {
+		cp.net.Logger().Debug("retry %v of dial to %v at %v failed: %v", e.retries+1, e.pub, e.address, err)
+		cp.scheduleRetry(e.address, e.pub, e.retries+1)
+		return
+	}
+
+	cp.connMutex.Lock()
+	cp.addresses[e.pub.String()] = e.address
+	cp.connMutex.Unlock()
+	if cp.handleNewConnection(e.pub, conn, net.Local) {
+		cp.publishNewConnection(net.NewConnectionEvent{Conn: conn, Node: node.New(e.pub, e.address)})
+	}
+}
+
+// dialWithRetry dials the remote peer up to policy.MaxAttempts times and returns the result of the last dial.
+// it stops retrying when ctx is done or on shutdown
+func (cp *ConnectionPool) dialWithRetry(ctx context.Context, address string, pub p2pcrypto.PublicKey, policy RetryPolicy) (net.Connection, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		conn, err := cp.dialContext(ctx, address, pub)
+		cp.metrics.DialDuration.Observe(time.Since(start).Seconds())
+		if err == nil || attempt >= policy.MaxAttempts {
+			return conn, err
+		}
+
+		delay := policy.delay(attempt)
+		cp.net.Logger().Debug("dial %v to %v at %v failed, retrying in %v: %v", attempt, pub, address, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-cp.RetryQueue.quit:
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
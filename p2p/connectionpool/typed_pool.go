@@ -0,0 +1,62 @@
+package connectionpool
+
+import (
+	"github.com/spacemeshos/go-spacemesh/p2p/p2pcrypto"
+
+	"sync"
+)
+
+// TypedConnectionPool is a ConnectionPool that sends each message type to the peer registered for it
+type TypedConnectionPool struct {
+	*ConnectionPool
+	preferred map[byte]p2pcrypto.PublicKey
+	typeMutex sync.RWMutex
+}
+
+// NewTypedConnectionPool creates new TypedConnectionPool
+func NewTypedConnectionPool(network networker, lPub p2pcrypto.PublicKey) *TypedConnectionPool {
+	return &TypedConnectionPool{
+		ConnectionPool: NewConnectionPool(network, lPub),
+		preferred:      make(map[byte]p2pcrypto.PublicKey),
+	}
+}
+
+// RegisterMessageType sets the peer messages of msgType are sent to, replacing any peer previously registered for it
+func (tp *TypedConnectionPool) RegisterMessageType(msgType byte, preferredPeer p2pcrypto.PublicKey) {
+	tp.typeMutex.Lock()
+	tp.preferred[msgType] = preferredPeer
+	tp.typeMutex.Unlock()
+}
+
+// SendTyped sends data on the connection to the peer registered for msgType. if no peer is registered or there's
+// no connection to it, data is sent on any other connection in the pool
+func (tp *TypedConnectionPool) SendTyped(msgType byte, data []byte) error {
+	tp.typeMutex.RLock()
+	pub, found := tp.preferred[msgType]
+	tp.typeMutex.RUnlock()
+
+	if !found || !tp.hasConnection(pub) {
+		var err error
+		if pub, err = tp.anyPeer(); err != nil {
+			return err
+		}
+	}
+	return tp.Send(pub, data)
+}
+
+func (tp *TypedConnectionPool) hasConnection(pub p2pcrypto.PublicKey) bool {
+	tp.connMutex.RLock()
+	defer tp.connMutex.RUnlock()
+	_, found := tp.connections[pub.String()]
+	return found
+}
+
+// anyPeer returns the public key of an arbitrary connected peer
+func (tp *TypedConnectionPool) anyPeer() (p2pcrypto.PublicKey, error) {
+	tp.connMutex.RLock()
+	defer tp.connMutex.RUnlock()
+	for _, conn := range tp.connections {
+		return conn.RemotePublicKey(), nil
+	}
+	return nil, ErrNoConnections
+}
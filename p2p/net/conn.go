@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/spacemeshos/go-spacemesh/crypto"
 	"github.com/spacemeshos/go-spacemesh/p2p/net/wire"
@@ -21,6 +22,10 @@ var (
 	ErrClosedIncomingChannel = errors.New("unexpected closed incoming channel")
 	// ErrConnectionClosed is sent when the connection is closed after Close was called
 	ErrConnectionClosed = errors.New("connections was intentionally closed")
+	// ErrBufferSizeNotSupported is returned when setting socket buffer sizes on a connection that isn't a TCP connection
+	ErrBufferSizeNotSupported = errors.New("socket buffer size is only supported on tcp connections")
+	// ErrSendTimeout is returned when a send didn't complete within the send timeout of the connection
+	ErrSendTimeout = errors.New("send timeout exceeded")
 )
 
 // ConnectionSource specifies the connection originator - local or remote node.
@@ -59,12 +64,14 @@ type FormattedConnection struct {
 	created    time.Time
 	remotePub  p2pcrypto.PublicKey
 	remoteAddr net.Addr
+	conn       readWriteCloseAddresser
 	closeChan  chan struct{}
 	formatter  wire.Formatter // format messages in some way
 	networker  networker      // network context
 	session    NetworkSession
 	closeOnce  sync.Once
 	closed     bool
+	sendTmout  int64 // the send timeout in nanoseconds, accessed atomically
 }
 
 type networker interface {
@@ -80,6 +87,10 @@ type readWriteCloseAddresser interface {
 	RemoteAddr() net.Addr
 }
 
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
 // Create a new connection wrapping a net.Conn with a provided connection manager
 func newConnection(conn readWriteCloseAddresser, netw networker, formatter wire.Formatter,
 	remotePub p2pcrypto.PublicKey, session NetworkSession, log log.Log) *FormattedConnection {
@@ -91,6 +102,7 @@ func newConnection(conn readWriteCloseAddresser, netw networker, formatter wire.
 		created:    time.Now(),
 		remotePub:  remotePub,
 		remoteAddr: conn.RemoteAddr(),
+		conn:       conn,
 		formatter:  formatter,
 		networker:  netw,
 		session:    session,
@@ -149,7 +161,20 @@ func (c *FormattedConnection) incomingChannel() chan []byte {
 // data is copied over so caller can get rid of the data
 // Concurrency: can be called from any go routine
 func (c *FormattedConnection) Send(m []byte) error {
+	if d := time.Duration(atomic.LoadInt64(&c.sendTmout)); d > 0 {
+		if wd, ok := c.conn.(writeDeadliner); ok {
+			if err := wd.SetWriteDeadline(time.Now().Add(d)); err != nil {
+				return err
+			}
+		}
+	}
 	err := c.formatter.Out(m)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// a timed out write may have left a partial message on the wire, the stream can't be used anymore
+		c.logger.Warning("send to %v missed the write deadline, closing connection %v", c.remotePub, c.id)
+		c.formatter.Close()
+		return ErrSendTimeout
+	}
 	if err != nil {
 		return err
 	}
@@ -157,6 +182,33 @@ func (c *FormattedConnection) Send(m []byte) error {
 	return nil
 }
 
+// SetSendTimeout sets the time a send may take from the call to Send until the message is written, 0 means no timeout.
+// it is applied as the write deadline of the underlying connection, a send missing it returns ErrSendTimeout and closes the connection
+func (c *FormattedConnection) SetSendTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.sendTmout, int64(d))
+	if wd, ok := c.conn.(writeDeadliner); ok && d == 0 {
+		wd.SetWriteDeadline(time.Time{})
+	}
+}
+
+// SetReadBuffer sets the size of the operating system's receive buffer of the underlying tcp connection
+func (c *FormattedConnection) SetReadBuffer(bytes int) error {
+	tcpConn, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		return ErrBufferSizeNotSupported
+	}
+	return tcpConn.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the size of the operating system's transmit buffer of the underlying tcp connection
+func (c *FormattedConnection) SetWriteBuffer(bytes int) error {
+	tcpConn, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		return ErrBufferSizeNotSupported
+	}
+	return tcpConn.SetWriteBuffer(bytes)
+}
+
 // Close closes the connection (implements io.Closer). It is go safe.
 func (c *FormattedConnection) Close() {
 	c.closeOnce.Do(func() {
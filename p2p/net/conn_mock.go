@@ -20,6 +20,10 @@ type ConnectionMock struct {
 	sendDelayMs int
 	sendRes     error
 	sendCnt     int32
+	sendTimeout time.Duration
+
+	readBuf  int
+	writeBuf int
 
 	closed bool
 }
@@ -56,6 +60,10 @@ func (cm *ConnectionMock) RemoteAddr() net.Addr {
 	return &net.TCPAddr{net.ParseIP(addr), portstr, ""}
 }
 
+func (cm *ConnectionMock) SetRemoteAddr(addr string) {
+	cm.addr = addr
+}
+
 func (cm *ConnectionMock) SetSession(session NetworkSession) {
 	cm.session = session
 }
@@ -80,12 +88,47 @@ func (cm ConnectionMock) SendCount() int32 {
 	return atomic.LoadInt32(&cm.sendCnt)
 }
 
+// SetSendTimeout sets the time a send may take, a send delayed longer returns ErrSendTimeout once it elapses
+func (cm *ConnectionMock) SetSendTimeout(d time.Duration) {
+	cm.sendTimeout = d
+}
+
+// SendTimeout returns the send timeout last set on the connection
+func (cm ConnectionMock) SendTimeout() time.Duration {
+	return cm.sendTimeout
+}
+
 func (cm *ConnectionMock) Send(m []byte) error {
 	atomic.AddInt32(&cm.sendCnt, int32(1))
-	time.Sleep(time.Duration(cm.sendDelayMs) * time.Millisecond)
+	delay := time.Duration(cm.sendDelayMs) * time.Millisecond
+	if cm.sendTimeout > 0 && delay > cm.sendTimeout {
+		time.Sleep(cm.sendTimeout)
+		return ErrSendTimeout
+	}
+	time.Sleep(delay)
 	return cm.sendRes
 }
 
+func (cm *ConnectionMock) SetReadBuffer(bytes int) error {
+	cm.readBuf = bytes
+	return nil
+}
+
+func (cm *ConnectionMock) SetWriteBuffer(bytes int) error {
+	cm.writeBuf = bytes
+	return nil
+}
+
+// ReadBufferSize returns the read buffer size last set on the connection
+func (cm ConnectionMock) ReadBufferSize() int {
+	return cm.readBuf
+}
+
+// WriteBufferSize returns the write buffer size last set on the connection
+func (cm ConnectionMock) WriteBufferSize() int {
+	return cm.writeBuf
+}
+
 func (cm ConnectionMock) Closed() bool {
 	return cm.closed
 }
@@ -6,6 +6,8 @@ import (
 	"github.com/spacemeshos/go-spacemesh/p2p/delimited"
 	"github.com/spacemeshos/go-spacemesh/p2p/p2pcrypto"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
 	"net"
 	"runtime"
 	"sync"
@@ -167,3 +169,83 @@ func TestGettersToBoostCoverage(t *testing.T) {
 	assert.Equal(t, addr.String(), conn.RemoteAddr().String())
 
 }
+
+func TestFormattedConnection_SetBufferSize(t *testing.T) {
+	netw := NewNetworkMock()
+	rwcam := NewReadWriteCloseAddresserMock()
+	formatter := delimited.NewChan(10)
+	conn := newConnection(rwcam, netw, formatter, p2pcrypto.NewRandomPubkey(), &networkSessionImpl{}, netw.logger)
+	assert.Equal(t, ErrBufferSizeNotSupported, conn.SetReadBuffer(1024))
+	assert.Equal(t, ErrBufferSizeNotSupported, conn.SetWriteBuffer(1024))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer tcpConn.Close()
+
+	conn = newConnection(tcpConn.(*net.TCPConn), netw, delimited.NewChan(10), p2pcrypto.NewRandomPubkey(), &networkSessionImpl{}, netw.logger)
+	assert.NoError(t, conn.SetReadBuffer(1024*1024))
+	assert.NoError(t, conn.SetWriteBuffer(1024*1024))
+}
+
+func TestFormattedConnection_SetSendTimeout(t *testing.T) {
+	netw := NewNetworkMock()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := newConnection(&pipeConn{local}, netw, delimited.NewChan(10), p2pcrypto.NewRandomPubkey(), &networkSessionImpl{}, netw.logger)
+
+	closed := make(chan struct{})
+	netw.SubscribeClosingConnections(func(closedConn Connection) {
+		assert.Equal(t, conn.id, closedConn.ID())
+		close(closed)
+	})
+	go conn.beginEventProcessing()
+
+	// nothing reads from remote so the write blocks until the deadline
+	conn.SetSendTimeout(10 * time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, ErrSendTimeout, conn.Send([]byte("hello")))
+	assert.True(t, time.Since(start) < time.Second)
+
+	// the stream may hold a partial message so the connection is closed
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection wasn't closed after a missed write deadline")
+	}
+	assert.True(t, conn.Closed())
+	assert.Error(t, conn.Send([]byte("hello")))
+
+	// the remote end sees the connection closed too
+	_, err := remote.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFormattedConnection_NoSendTimeout(t *testing.T) {
+	netw := NewNetworkMock()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := newConnection(&pipeConn{local}, netw, delimited.NewChan(10), p2pcrypto.NewRandomPubkey(), &networkSessionImpl{}, netw.logger)
+
+	conn.SetSendTimeout(10 * time.Millisecond)
+	conn.SetSendTimeout(0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		io.Copy(ioutil.Discard, remote)
+	}()
+	assert.NoError(t, conn.Send([]byte("hello")))
+	assert.False(t, conn.Closed())
+}
+
+// pipeConn is a net.Pipe end with a remote address
+type pipeConn struct {
+	net.Conn
+}
+
+func (pc *pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7513}
+}
@@ -72,8 +72,9 @@ func (pm gossipProtocolMessage) ReportValidation(protocol string, isValid bool)
 }
 
 type cPool interface {
-	GetConnection(address string, pk p2pcrypto.PublicKey) (net.Connection, error)
+	GetConnectionWithContext(ctx context.Context, address string, pk p2pcrypto.PublicKey) (net.Connection, error)
 	GetConnectionIfExists(pk p2pcrypto.PublicKey) (net.Connection, error)
+	CheckIncomingMessage(ime net.IncomingMessageEvent) error
 	Shutdown()
 }
 
@@ -296,7 +297,7 @@ func (s *swarm) establishConnection(peerPubKey p2pcrypto.PublicKey) (net.Connect
 			return err, 1
 		}
 
-		conn, err = s.cPool.GetConnection(peer.Address(), peer.PublicKey()) // blocking, might take some time in case there is no connection
+		conn, err = s.cPool.GetConnectionWithContext(s.ctx, peer.Address(), peer.PublicKey()) // blocking, might take some time in case there is no connection
 		if err != nil {
 			s.lNode.Warning("failed to send message to %v, no valid connection. err: %v", peer.String(), err)
 			return err, 1
@@ -409,6 +410,9 @@ func (s *swarm) Shutdown() {
 
 // process an incoming message
 func (s *swarm) processMessage(ime net.IncomingMessageEvent) {
+	if err := s.cPool.CheckIncomingMessage(ime); err != nil {
+		return
+	}
 
 	err := s.onRemoteClientMessage(ime)
 	if err != nil {
@@ -464,7 +468,7 @@ func (s *swarm) retryOrDisconnect(key p2pcrypto.PublicKey) {
 		return
 	}
 
-	_, err := s.cPool.GetConnection(peer.Address(), peer.PublicKey())
+	_, err := s.cPool.GetConnectionWithContext(s.ctx, peer.Address(), peer.PublicKey())
 	if err != nil { // we could'nt connect :/
 		s.Disconnect(key)
 	}
@@ -727,7 +731,7 @@ func (s *swarm) getMorePeers(numpeers int) int {
 	// TODO: try splitting the load and don't connect to more than X at a time
 	for i := 0; i < ndsLen; i++ {
 		go func(nd node.Node, reportChan chan cnErr) {
-			_, err := s.cPool.GetConnection(nd.Address(), nd.PublicKey())
+			_, err := s.cPool.GetConnectionWithContext(s.ctx, nd.Address(), nd.PublicKey())
 			reportChan <- cnErr{nd, err}
 		}(nds[i], res)
 	}
@@ -29,7 +29,7 @@ type cpoolMock struct {
 	f func(address string, pk p2pcrypto.PublicKey) (net.Connection, error)
 }
 
-func (cp *cpoolMock) GetConnection(address string, pk p2pcrypto.PublicKey) (net.Connection, error) {
+func (cp *cpoolMock) GetConnectionWithContext(ctx context.Context, address string, pk p2pcrypto.PublicKey) (net.Connection, error) {
 	if cp.f != nil {
 		return cp.f(address, pk)
 	}
@@ -40,6 +40,10 @@ func (cp *cpoolMock) GetConnectionIfExists(pk p2pcrypto.PublicKey) (net.Connecti
 	return net.NewConnectionMock(pk), nil
 }
 
+func (cp *cpoolMock) CheckIncomingMessage(ime net.IncomingMessageEvent) error {
+	return nil
+}
+
 func (cp *cpoolMock) Shutdown() {
 
 }